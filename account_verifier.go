@@ -0,0 +1,187 @@
+package tmpmail
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"tmpmail/entity"
+	"tmpmail/pow"
+)
+
+// AccountVerifier verifies anonymous account creation requests, e.g. by
+// captcha or proof of work.
+type AccountVerifier interface {
+	// Challenge returns data client needs to pass verification.
+	Challenge() (entity.AccountChallenge, error)
+	// Verify checks client response to challenge.
+	Verify(ctx context.Context, response, clientIP string) (bool, error)
+}
+
+// Counter is a storage of expiring counters shared by server instances.
+type Counter interface {
+	IncrCounter(key string, ttl time.Duration) (int, error)
+	// DecrCounter releases an increment of IncrCounter. Expired and
+	// nonexistent counters stay so.
+	DecrCounter(key string) error
+}
+
+// powChallengeTTL limits time to solve proof of work challenge.
+const powChallengeTTL = 5 * time.Minute
+
+type powVerifier struct {
+	counter    Counter
+	secret     []byte
+	difficulty int
+}
+
+// NewPoWVerifier creates verifier requiring proof of work with difficulty
+// leading zero bits. Challenges are signed by secret, so instances sharing
+// secret and counter accept challenges of each other. Every challenge is
+// accepted once.
+func NewPoWVerifier(c Counter, secret []byte, difficulty int) AccountVerifier {
+	return &powVerifier{counter: c, secret: secret, difficulty: difficulty}
+}
+
+func (v *powVerifier) sign(payload string) string {
+	m := hmac.New(sha256.New, v.secret)
+	m.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// Challenge is "expires.random.signature" where expires is Unix time.
+func (v *powVerifier) Challenge() (entity.AccountChallenge, error) {
+	payload := strconv.FormatInt(time.Now().Add(powChallengeTTL).Unix(), 10) +
+		"." + generateRandomString(16)
+	return entity.AccountChallenge{
+		Type:       entity.AccountChallengePoW,
+		Challenge:  payload + "." + v.sign(payload),
+		Difficulty: v.difficulty,
+	}, nil
+}
+
+// Verify checks response "challenge:nonce".
+func (v *powVerifier) Verify(_ context.Context, response, _ string) (bool, error) {
+	i := strings.LastIndex(response, ":")
+	if i < 0 {
+		return false, nil
+	}
+	challenge, nonce := response[:i], response[i+1:]
+
+	j := strings.LastIndex(challenge, ".")
+	if j < 0 {
+		return false, nil
+	}
+	payload, signature := challenge[:j], challenge[j+1:]
+	if !hmac.Equal([]byte(signature), []byte(v.sign(payload))) {
+		return false, nil
+	}
+	expiresStr, _, _ := strings.Cut(payload, ".")
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false, nil
+	}
+	if !pow.Check(challenge, nonce, v.difficulty) {
+		return false, nil
+	}
+
+	n, err := v.counter.IncrCounter("pow/"+challenge, powChallengeTTL)
+	if err != nil {
+		return false, fmt.Errorf("count challenge use: %w", err)
+	}
+	return n == 1, nil
+}
+
+type captchaVerifier struct {
+	verifyURL  string
+	provider   string
+	siteKey    string
+	secret     string
+	httpClient *http.Client
+}
+
+// NewCaptchaVerifier creates verifier of captcha tokens by siteverify API of
+// hCaptcha, reCAPTCHA or Turnstile at verifyURL. Nil httpClient means
+// http.DefaultClient.
+func NewCaptchaVerifier(verifyURL, siteKey, secret string, httpClient *http.Client) AccountVerifier {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &captchaVerifier{
+		verifyURL:  verifyURL,
+		provider:   captchaProvider(verifyURL),
+		siteKey:    siteKey,
+		secret:     secret,
+		httpClient: httpClient,
+	}
+}
+
+// captchaProvider detects captcha provider by host of its siteverify API URL,
+// so web interface can load widget of the provider. It is empty for unknown
+// hosts.
+func captchaProvider(verifyURL string) string {
+	u, err := url.Parse(verifyURL)
+	if err != nil {
+		return ""
+	}
+	host := u.Hostname()
+	switch {
+	case host == "hcaptcha.com" || strings.HasSuffix(host, ".hcaptcha.com"):
+		return "hcaptcha"
+	case host == "www.google.com" || host == "www.recaptcha.net":
+		return "recaptcha"
+	case host == "challenges.cloudflare.com":
+		return "turnstile"
+	}
+	return ""
+}
+
+func (v *captchaVerifier) Challenge() (entity.AccountChallenge, error) {
+	return entity.AccountChallenge{
+		Type:     entity.AccountChallengeCaptcha,
+		Provider: v.provider,
+		SiteKey:  v.siteKey,
+	}, nil
+}
+
+func (v *captchaVerifier) Verify(ctx context.Context, response, clientIP string) (bool, error) {
+	if response == "" {
+		return false, nil
+	}
+	form := url.Values{
+		"secret":   {v.secret},
+		"response": {response},
+		"remoteip": {clientIP},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.verifyURL,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var res struct {
+		Success bool `json:"success"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return false, fmt.Errorf("json decode response: %w", err)
+	}
+	return res.Success, nil
+}
@@ -0,0 +1,185 @@
+package tmpmail
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"tmpmail/entity"
+	"tmpmail/memory"
+	"tmpmail/pow"
+)
+
+type failingCounter struct{}
+
+func (failingCounter) IncrCounter(string, time.Duration) (int, error) {
+	return 0, errors.New("storage is down")
+}
+
+func (failingCounter) DecrCounter(string) error {
+	return errors.New("storage is down")
+}
+
+func solve(t *testing.T, challenge string, difficulty int) string {
+	t.Helper()
+	nonce, err := pow.Solve(context.Background(), challenge, difficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return challenge + ":" + nonce
+}
+
+func TestPoWVerifier(t *testing.T) {
+	st := memory.NewStorage()
+	defer st.Close()
+	const difficulty = 8
+	v := NewPoWVerifier(st, []byte("secret"), difficulty)
+	ctx := context.Background()
+
+	c, err := v.Challenge()
+	if err != nil {
+		t.Fatalf("Challenge() error = %v", err)
+	}
+	if c.Type != entity.AccountChallengePoW || c.Difficulty != difficulty {
+		t.Errorf("Challenge() = %+v, want pow with difficulty %d", c, difficulty)
+	}
+	response := solve(t, c.Challenge, difficulty)
+
+	var wrongNonce string
+	for i := 0; ; i++ {
+		if nonce := strconv.Itoa(i); !pow.Check(c.Challenge, nonce, difficulty) {
+			wrongNonce = c.Challenge + ":" + nonce
+			break
+		}
+	}
+	pv := v.(*powVerifier)
+	expired := strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10) + ".random"
+	other, err := NewPoWVerifier(st, []byte("other"), difficulty).Challenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := strings.LastIndex(c.Challenge, ".")
+	tampered := "9999999999" + c.Challenge[strings.Index(c.Challenge, "."):i] + c.Challenge[i:]
+
+	tests := []struct {
+		name     string
+		response string
+		want     bool
+	}{
+		{name: "solved", response: response, want: true},
+		{name: "reused", response: response},
+		{name: "wrong nonce", response: wrongNonce},
+		{name: "other secret", response: solve(t, other.Challenge, difficulty)},
+		{name: "tampered expiry", response: solve(t, tampered, difficulty)},
+		{name: "expired", response: solve(t, expired+"."+pv.sign(expired), difficulty)},
+		{name: "no nonce", response: c.Challenge},
+		{name: "empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := v.Verify(ctx, tt.response, "192.0.2.1")
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if ok != tt.want {
+				t.Errorf("Verify() = %t, want %t", ok, tt.want)
+			}
+		})
+	}
+
+	// Challenges can't be checked for reuse without storage.
+	fv := NewPoWVerifier(failingCounter{}, []byte("secret"), difficulty)
+	if c, err = fv.Challenge(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := fv.Verify(ctx, solve(t, c.Challenge, difficulty), "192.0.2.1"); err == nil || ok {
+		t.Errorf("Verify() with failing counter = %t, %v, want error", ok, err)
+	}
+}
+
+func TestCaptchaVerifier(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.FormValue("secret") != "secret" || r.FormValue("remoteip") != "192.0.2.1" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		switch r.FormValue("response") {
+		case "valid":
+			w.Write([]byte(`{"success": true}`))
+		case "broken":
+			w.Write([]byte(`<html>`))
+		default:
+			w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-response"]}`))
+		}
+	}))
+	defer ts.Close()
+
+	v := NewCaptchaVerifier(ts.URL, "site-key", "secret", ts.Client())
+	c, err := v.Challenge()
+	if err != nil {
+		t.Fatalf("Challenge() error = %v", err)
+	}
+	if c.Type != entity.AccountChallengeCaptcha || c.SiteKey != "site-key" || c.Provider != "" {
+		t.Errorf("Challenge() = %+v, want captcha with site key and no provider", c)
+	}
+
+	tests := []struct {
+		name     string
+		response string
+		clientIP string
+		want     bool
+		wantErr  bool
+	}{
+		{name: "valid", response: "valid", clientIP: "192.0.2.1", want: true},
+		{name: "invalid", response: "invalid", clientIP: "192.0.2.1"},
+		{name: "bad status", response: "valid", clientIP: "192.0.2.2", wantErr: true},
+		{name: "bad body", response: "broken", clientIP: "192.0.2.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := v.Verify(context.Background(), tt.response, tt.clientIP)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, want error %t", err, tt.wantErr)
+			}
+			if ok != tt.want {
+				t.Errorf("Verify() = %t, want %t", ok, tt.want)
+			}
+		})
+	}
+
+	// Empty response isn't sent to provider.
+	requests = 0
+	if ok, err := v.Verify(context.Background(), "", "192.0.2.1"); err != nil || ok {
+		t.Errorf("Verify() of empty response = %t, %v, want false", ok, err)
+	}
+	if requests != 0 {
+		t.Errorf("Verify() of empty response made %d requests", requests)
+	}
+}
+
+func TestCaptchaProvider(t *testing.T) {
+	tests := []struct {
+		verifyURL string
+		want      string
+	}{
+		{verifyURL: "https://api.hcaptcha.com/siteverify", want: "hcaptcha"},
+		{verifyURL: "https://hcaptcha.com/siteverify", want: "hcaptcha"},
+		{verifyURL: "https://www.google.com/recaptcha/api/siteverify", want: "recaptcha"},
+		{verifyURL: "https://www.recaptcha.net/recaptcha/api/siteverify", want: "recaptcha"},
+		{verifyURL: "https://challenges.cloudflare.com/turnstile/v0/siteverify", want: "turnstile"},
+		{verifyURL: "https://nothcaptcha.com/siteverify"},
+		{verifyURL: "http://127.0.0.1:8080/verify"},
+	}
+	for _, tt := range tests {
+		if got := captchaProvider(tt.verifyURL); got != tt.want {
+			t.Errorf("captchaProvider(%q) = %q, want %q", tt.verifyURL, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package tmpmail
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"tmpmail/entity"
+)
+
+// APIKeyStorage keeps API keys shared by server instances.
+type APIKeyStorage interface {
+	CreateAPIKey(k entity.APIKey) error
+	APIKey(id string) (entity.APIKey, error)
+	APIKeys() ([]entity.APIKey, error)
+	RemoveAPIKey(id string) error
+	TouchAPIKey(id string, lastUsedAt time.Time) error
+}
+
+const (
+	// apiKeyPrefix makes API keys recognizable, e.g. by secret scanners.
+	apiKeyPrefix       = "tmk_"
+	apiKeyIDLength     = 9
+	apiKeySecretLength = 32
+
+	// apiKeyTouchInterval limits storage writes of last key use.
+	apiKeyTouchInterval = time.Minute
+)
+
+func hashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// parseAPIKey returns ID of key "tmk_<id>_<secret>".
+func parseAPIKey(key string) (string, bool) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return "", false
+	}
+	id, secret, ok := strings.Cut(strings.TrimPrefix(key, apiKeyPrefix), "_")
+	if !ok || id == "" || secret == "" {
+		return "", false
+	}
+	return id, true
+}
+
+func validScope(scope string) bool {
+	for _, s := range entity.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IssueAPIKey creates API key with scopes which expires in ttl, zero ttl
+// means key doesn't expire. The key is returned once, only its hash is stored.
+func IssueAPIKey(s APIKeyStorage, name string, scopes []string, ttl time.Duration) (string, entity.APIKey, error) {
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return "", entity.APIKey{}, fmt.Errorf("unknown scope: %q", scope)
+		}
+	}
+	id := generateRandomString(apiKeyIDLength)
+	secret := generateRandomString(apiKeySecretLength)
+	if id == "" || secret == "" {
+		return "", entity.APIKey{}, errors.New("generate random key")
+	}
+	key := apiKeyPrefix + id + "_" + secret
+
+	now := time.Now().UTC()
+	k := entity.APIKey{
+		ID:        id,
+		Name:      name,
+		Hash:      hashAPIKey(key),
+		Scopes:    scopes,
+		CreatedAt: now,
+	}
+	if ttl > 0 {
+		k.ExpiresAt = now.Add(ttl)
+	}
+	if err := s.CreateAPIKey(k); err != nil {
+		return "", entity.APIKey{}, fmt.Errorf("create api key: %w", err)
+	}
+	return key, k, nil
+}
+
+// checkAPIKey returns stored key matching key if it isn't expired.
+func checkAPIKey(s APIKeyStorage, key string, now time.Time) (entity.APIKey, bool, error) {
+	id, ok := parseAPIKey(key)
+	if !ok {
+		return entity.APIKey{}, false, nil
+	}
+	k, err := s.APIKey(id)
+	if err != nil {
+		if errors.Is(err, entity.ErrAPIKeyDoesntExists) {
+			return entity.APIKey{}, false, nil
+		}
+		return entity.APIKey{}, false, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(key)), []byte(k.Hash)) != 1 {
+		return entity.APIKey{}, false, nil
+	}
+	if !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt) {
+		return entity.APIKey{}, false, nil
+	}
+	return k, true, nil
+}
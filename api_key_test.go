@@ -0,0 +1,51 @@
+package tmpmail
+
+import (
+	"testing"
+	"time"
+
+	"tmpmail/entity"
+	"tmpmail/memory"
+)
+
+func TestCheckAPIKey(t *testing.T) {
+	st := memory.NewStorage()
+	defer st.Close()
+
+	key, k, err := IssueAPIKey(st, "ci", []string{entity.ScopeAdminRead}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = IssueAPIKey(st, "ci", []string{"root"}, 0); err == nil {
+		t.Error("IssueAPIKey() with unknown scope succeeded")
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name   string
+		key    string
+		now    time.Time
+		wantOK bool
+	}{
+		{name: "valid", key: key, now: now, wantOK: true},
+		{name: "wrong secret", key: key[:len(key)-1] + "x", now: now},
+		{name: "unknown id", key: apiKeyPrefix + "unknown_" + key[len(key)-apiKeySecretLength:], now: now},
+		{name: "malformed", key: "Bearer " + key, now: now},
+		{name: "empty", now: now},
+		{name: "expired", key: key, now: k.ExpiresAt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := checkAPIKey(st, tt.key, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.wantOK {
+				t.Fatalf("checkAPIKey() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && got.ID != k.ID {
+				t.Errorf("checkAPIKey() ID = %s, want %s", got.ID, k.ID)
+			}
+		})
+	}
+}
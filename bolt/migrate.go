@@ -0,0 +1,121 @@
+package bolt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// schemaVersionKey keeps version of the last migration applied to database,
+// so migrations read it only once.
+var schemaVersionKey = []byte("schema-version")
+
+// Schema versions set by migrations.
+const schemaAccountDomains = 1
+
+// MigrateAccountDomains re-keys accounts and tokens of versions before
+// multiple domains, whose usernames have no domain, to addresses of domain.
+// It returns number of re-keyed accounts and is a no-op once database is
+// migrated.
+func (s *Storage) MigrateAccountDomains(domain string) (int, error) {
+	migrated := 0
+	err := s.update(func(tx *bolt.Tx) error {
+		migrated = 0
+		meta := tx.Bucket(metaBucket)
+		version, _ := strconv.Atoi(string(meta.Get(schemaVersionKey)))
+		if version >= schemaAccountDomains {
+			return nil
+		}
+
+		accounts := tx.Bucket(accountsBucket)
+		var usernames []string
+		err := accounts.ForEach(func(k, _ []byte) error {
+			if !strings.Contains(string(k), "@") {
+				usernames = append(usernames, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, username := range usernames {
+			address := username + "@" + domain
+			if accounts.Get([]byte(address)) != nil {
+				continue
+			}
+			if err = renameAccount(tx, username, address); err != nil {
+				return fmt.Errorf("rename account %s: %w", username, err)
+			}
+			migrated++
+		}
+
+		tokens := tx.Bucket(tokensBucket)
+		type tokenUpdate struct {
+			token string
+			t     tokenRecord
+		}
+		var updates []tokenUpdate
+		err = tokens.ForEach(func(k, v []byte) error {
+			var t tokenRecord
+			if err := json.Unmarshal(v, &t); err != nil {
+				return fmt.Errorf("json unmarshal token: %w", err)
+			}
+			if !strings.Contains(t.Username, "@") {
+				updates = append(updates, tokenUpdate{string(k), t})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, u := range updates {
+			u.t.Username += "@" + domain
+			if err = putJSON(tokens, u.token, u.t); err != nil {
+				return fmt.Errorf("put token: %w", err)
+			}
+			// Admin API prolongs accounts by their tokens.
+			var a accountRecord
+			exists, err := getJSON(accounts, u.t.Username, &a)
+			if err != nil {
+				return fmt.Errorf("get account: %w", err)
+			}
+			if exists && a.Token == "" {
+				a.Token = u.token
+				if err = putJSON(accounts, u.t.Username, a); err != nil {
+					return fmt.Errorf("put account: %w", err)
+				}
+			}
+		}
+		return meta.Put(schemaVersionKey, []byte(strconv.Itoa(schemaAccountDomains)))
+	})
+	return migrated, err
+}
+
+// renameAccount moves account record, emails and files of username to
+// address.
+func renameAccount(tx *bolt.Tx, username, address string) error {
+	accounts := tx.Bucket(accountsBucket)
+	if err := accounts.Put([]byte(address), accounts.Get([]byte(username))); err != nil {
+		return fmt.Errorf("put account: %w", err)
+	}
+	for _, parent := range []*bolt.Bucket{tx.Bucket(emailsBucket), tx.Bucket(filesBucket)} {
+		src := parent.Bucket([]byte(username))
+		if src == nil {
+			continue
+		}
+		dst, err := parent.CreateBucket([]byte(address))
+		if err != nil {
+			return fmt.Errorf("create bucket: %w", err)
+		}
+		err = src.ForEach(func(k, v []byte) error {
+			return dst.Put(k, v)
+		})
+		if err != nil {
+			return fmt.Errorf("copy bucket: %w", err)
+		}
+	}
+	return deleteAccount(tx, username)
+}
@@ -0,0 +1,66 @@
+package bolt
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"tmpmail/entity"
+)
+
+func TestMigrateAccountDomains(t *testing.T) {
+	s, err := NewStorage(zap.NewNop(), filepath.Join(t.TempDir(), "tmpmail.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Account of version before multiple domains.
+	if err = s.CreateAccount("token", "alice", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	email := entity.Email{
+		ID:          "0001",
+		Subject:     "hello",
+		Attachments: []entity.Attachment{{Filename: "a.txt", Data: []byte("data")}},
+	}
+	if err = s.AddEmail("alice", email, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := s.MigrateAccountDomains("tmp-mail.ru")
+	if err != nil {
+		t.Fatalf("MigrateAccountDomains() error = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("MigrateAccountDomains() = %d, want 1", n)
+	}
+
+	a, err := s.Account("token")
+	if err != nil {
+		t.Fatalf("Account() error = %v", err)
+	}
+	if a.Address != "alice@tmp-mail.ru" || len(a.Emails) != 1 {
+		t.Errorf("Account() = %s with %d emails, want alice@tmp-mail.ru with 1", a.Address, len(a.Emails))
+	}
+	att, err := s.Attachment("token", "0001", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(att.Data) != "data" {
+		t.Errorf("Attachment() data = %q, want %q", att.Data, "data")
+	}
+	if ok, _ := s.AccountExists("alice"); ok {
+		t.Error("account alice wasn't re-keyed")
+	}
+
+	// Migrated database isn't scanned again.
+	if err = s.CreateAccount("token2", "bob", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = s.MigrateAccountDomains("tmp-mail.ru"); err != nil || n != 0 {
+		t.Errorf("second MigrateAccountDomains() = %d, %v, want 0, nil", n, err)
+	}
+}
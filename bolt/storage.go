@@ -0,0 +1,1189 @@
+package bolt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+
+	"tmpmail/entity"
+	"tmpmail/events"
+)
+
+const (
+	sweepInterval = time.Minute
+
+	// Database file is compacted when at least compactMinFreeBytes and at
+	// least half of it is occupied by free pages left from removed emails.
+	compactMinFreeBytes = 32 << 20
+	compactTxMaxSize    = 64 << 20
+	// Compaction copies database while it is in use and discards the copy if
+	// anything was written meanwhile. After compactMaxRaces such attempts in a
+	// row writes are blocked until compaction is done.
+	compactMaxRaces = 3
+)
+
+var (
+	tokensBucket   = []byte("tokens")
+	accountsBucket = []byte("accounts")
+	// emailsBucket has nested bucket of emails keyed by time ordered email
+	// ID for each account.
+	emailsBucket = []byte("emails")
+	// filesBucket has nested bucket of attachments, embedded files data and
+	// raw emails keyed by fileKey for each account.
+	filesBucket = []byte("files")
+	// countersBucket has counters of IncrCounter.
+	countersBucket = []byte("counters")
+	// apiKeysBucket has entity.APIKey JSONs keyed by ID.
+	apiKeysBucket = []byte("api-keys")
+	// metaBucket has database schema version under schemaVersionKey.
+	metaBucket = []byte("meta")
+)
+
+func fileKey(emailID, kind string, n int) []byte {
+	return []byte(emailID + "/" + kind + "/" + strconv.Itoa(n))
+}
+
+const (
+	attachmentKind   = "a"
+	embeddedFileKind = "e"
+	rawEmailKind     = "raw"
+)
+
+type tokenRecord struct {
+	Username  string    `json:"username"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type counterRecord struct {
+	N         int       `json:"n"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type accountRecord struct {
+	// Token is used by admin to prolong account by address. It is empty for
+	// accounts created by older versions.
+	Token     string    `json:"token,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// Size is a total RawSize of account emails.
+	Size int `json:"size,omitempty"`
+}
+
+func expiresAt(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+func expired(now, expiresAt time.Time) bool {
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
+
+// Storage keeps accounts and emails in a single bbolt database file.
+// Expired accounts are invisible immediately and removed from the file by
+// background sweeper which also compacts it.
+type Storage struct {
+	path   string
+	logger *zap.Logger
+
+	// mu guards db which is replaced on compaction.
+	mu sync.RWMutex
+	db *bolt.DB
+	// writes counts committed updates, so compaction can tell whether its
+	// copy is stale.
+	writes uint64
+
+	events *events.Hub
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewStorage(l *zap.Logger, path string) (*Storage, error) {
+	db, err := openDB(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Storage{
+		path:   path,
+		logger: l,
+		db:     db,
+		events: events.NewHub(),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go s.sweeper()
+	return s, nil
+}
+
+// ErrLocked is returned by NewStorage if database file is used by another
+// process.
+var ErrLocked = errors.New("bolt db is locked by another process")
+
+func openDB(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		if errors.Is(err, bolt.ErrTimeout) {
+			err = ErrLocked
+		}
+		return nil, fmt.Errorf("open bolt db: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{tokensBucket, accountsBucket, emailsBucket, filesBucket, countersBucket, apiKeysBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return fmt.Errorf("create bucket %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (s *Storage) Close() error {
+	close(s.stop)
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.Close()
+}
+
+func (s *Storage) sweeper() {
+	defer close(s.done)
+
+	t := time.NewTicker(sweepInterval)
+	defer t.Stop()
+
+	races := 0
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-t.C:
+			// Failed sweeps and compactions are retried on the next tick.
+			if err := s.sweep(now); err != nil {
+				s.logger.Error("sweep expired accounts", zap.Error(err))
+				continue
+			}
+			raced, err := s.compactIfNeeded(races >= compactMaxRaces)
+			if err != nil {
+				s.logger.Error("compact db", zap.Error(err))
+			}
+			if raced {
+				races++
+			} else {
+				races = 0
+			}
+		}
+	}
+}
+
+func (s *Storage) sweep(now time.Time) error {
+	var expiredAccounts []string
+	err := s.update(func(tx *bolt.Tx) error {
+		tokens := tx.Bucket(tokensBucket)
+		var expiredTokens [][]byte
+		err := tokens.ForEach(func(k, v []byte) error {
+			var t tokenRecord
+			if err := json.Unmarshal(v, &t); err != nil {
+				return fmt.Errorf("json unmarshal token: %w", err)
+			}
+			if expired(now, t.ExpiresAt) {
+				expiredTokens = append(expiredTokens, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expiredTokens {
+			if err := tokens.Delete(k); err != nil {
+				return fmt.Errorf("delete token: %w", err)
+			}
+		}
+
+		counters := tx.Bucket(countersBucket)
+		var expiredCounters [][]byte
+		err = counters.ForEach(func(k, v []byte) error {
+			var c counterRecord
+			if err := json.Unmarshal(v, &c); err != nil {
+				return fmt.Errorf("json unmarshal counter: %w", err)
+			}
+			if expired(now, c.ExpiresAt) {
+				expiredCounters = append(expiredCounters, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expiredCounters {
+			if err := counters.Delete(k); err != nil {
+				return fmt.Errorf("delete counter: %w", err)
+			}
+		}
+
+		expiredAccounts = nil
+		err = tx.Bucket(accountsBucket).ForEach(func(k, v []byte) error {
+			var a accountRecord
+			if err := json.Unmarshal(v, &a); err != nil {
+				return fmt.Errorf("json unmarshal account: %w", err)
+			}
+			if expired(now, a.ExpiresAt) {
+				expiredAccounts = append(expiredAccounts, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, username := range expiredAccounts {
+			if err := deleteAccount(tx, username); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, username := range expiredAccounts {
+		s.events.Publish(username, entity.Event{Type: entity.EventAccountExpired})
+	}
+	return nil
+}
+
+// compactIfNeeded compacts database file if it has too many free pages. Unless
+// block is set, reads and writes are served during compaction and raced is
+// reported if copy was discarded since it missed writes.
+func (s *Storage) compactIfNeeded(block bool) (raced bool, err error) {
+	if block {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	} else {
+		s.mu.RLock()
+	}
+	unlock := func() {
+		if !block {
+			s.mu.RUnlock()
+		}
+	}
+
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		unlock()
+		return false, fmt.Errorf("stat db file: %w", err)
+	}
+	free := int64(s.db.Stats().FreePageN) * int64(s.db.Info().PageSize)
+	if free < compactMinFreeBytes || free*2 < fi.Size() {
+		unlock()
+		return false, nil
+	}
+
+	writes := atomic.LoadUint64(&s.writes)
+	tmpPath := s.path + ".compact"
+	err = compactTo(tmpPath, s.db)
+	unlock()
+	if err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+
+	if !block {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if atomic.LoadUint64(&s.writes) != writes {
+			os.Remove(tmpPath)
+			return true, nil
+		}
+	}
+
+	// Old database is kept unless compacted one replaces it.
+	db, err := openDB(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+	if err = os.Rename(tmpPath, s.path); err != nil {
+		db.Close()
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("replace db file: %w", err)
+	}
+	old := s.db
+	s.db = db
+	if err = old.Close(); err != nil {
+		return false, fmt.Errorf("close old db: %w", err)
+	}
+	return false, nil
+}
+
+// compactTo copies src to a new file at path without free pages.
+func compactTo(path string, src *bolt.DB) error {
+	dst, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return fmt.Errorf("open compacted db: %w", err)
+	}
+	err = bolt.Compact(dst, src, compactTxMaxSize)
+	if cErr := dst.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return fmt.Errorf("compact db: %w", err)
+	}
+	return nil
+}
+
+func (s *Storage) view(fn func(tx *bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.View(fn)
+}
+
+func (s *Storage) update(fn func(tx *bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if err := s.db.Update(fn); err != nil {
+		return err
+	}
+	atomic.AddUint64(&s.writes, 1)
+	return nil
+}
+
+func getJSON(b *bolt.Bucket, key string, v interface{}) (bool, error) {
+	data := b.Get([]byte(key))
+	if data == nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("json unmarshal: %w", err)
+	}
+	return true, nil
+}
+
+func putJSON(b *bolt.Bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("json marshal: %w", err)
+	}
+	return b.Put([]byte(key), data)
+}
+
+// aliveToken returns token record if it exists and not expired.
+func aliveToken(tx *bolt.Tx, now time.Time, token string) (tokenRecord, bool, error) {
+	var t tokenRecord
+	exists, err := getJSON(tx.Bucket(tokensBucket), token, &t)
+	if err != nil {
+		return tokenRecord{}, false, fmt.Errorf("get token: %w", err)
+	}
+	if !exists || expired(now, t.ExpiresAt) {
+		return tokenRecord{}, false, nil
+	}
+	return t, true, nil
+}
+
+// aliveAccount returns account record if it exists and not expired.
+func aliveAccount(tx *bolt.Tx, now time.Time, username string) (accountRecord, bool, error) {
+	var a accountRecord
+	exists, err := getJSON(tx.Bucket(accountsBucket), username, &a)
+	if err != nil {
+		return accountRecord{}, false, fmt.Errorf("get account: %w", err)
+	}
+	if !exists || expired(now, a.ExpiresAt) {
+		return accountRecord{}, false, nil
+	}
+	return a, true, nil
+}
+
+// tokenUsername returns username of alive account of alive token.
+func tokenUsername(tx *bolt.Tx, now time.Time, token string) (string, error) {
+	t, exists, err := aliveToken(tx, now, token)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", entity.ErrAccountDoesntExists
+	}
+	_, exists, err = aliveAccount(tx, now, t.Username)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", entity.ErrAccountDoesntExists
+	}
+	return t.Username, nil
+}
+
+// tokenEmails returns emails bucket of alive account of alive token. Bucket
+// is nil if account has no emails yet.
+func tokenEmails(tx *bolt.Tx, now time.Time, token string) (*bolt.Bucket, error) {
+	username, err := tokenUsername(tx, now, token)
+	if err != nil {
+		return nil, err
+	}
+	return tx.Bucket(emailsBucket).Bucket([]byte(username)), nil
+}
+
+func getEmail(emails *bolt.Bucket, id string) (entity.Email, error) {
+	if emails == nil {
+		return entity.Email{}, entity.ErrEmailDoesntExists
+	}
+	emailJSON := emails.Get([]byte(id))
+	if emailJSON == nil {
+		return entity.Email{}, entity.ErrEmailDoesntExists
+	}
+	var email entity.Email
+	if err := json.Unmarshal(emailJSON, &email); err != nil {
+		return entity.Email{}, fmt.Errorf("json unmarshal email json: %w", err)
+	}
+	return email, nil
+}
+
+// getFile returns copy of file data which is valid after transaction end.
+func getFile(tx *bolt.Tx, username string, key []byte) ([]byte, error) {
+	files := tx.Bucket(filesBucket).Bucket([]byte(username))
+	if files == nil {
+		return nil, entity.ErrFileDoesntExists
+	}
+	data := files.Get(key)
+	if data == nil {
+		return nil, entity.ErrFileDoesntExists
+	}
+	return append([]byte{}, data...), nil
+}
+
+func deleteAccount(tx *bolt.Tx, username string) error {
+	if err := tx.Bucket(accountsBucket).Delete([]byte(username)); err != nil {
+		return fmt.Errorf("delete account: %w", err)
+	}
+	err := tx.Bucket(emailsBucket).DeleteBucket([]byte(username))
+	if err != nil && err != bolt.ErrBucketNotFound {
+		return fmt.Errorf("delete account emails: %w", err)
+	}
+	err = tx.Bucket(filesBucket).DeleteBucket([]byte(username))
+	if err != nil && err != bolt.ErrBucketNotFound {
+		return fmt.Errorf("delete account files: %w", err)
+	}
+	return nil
+}
+
+func (s *Storage) CreateAccount(token, username string, ttl time.Duration) error {
+	return s.update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		_, exists, err := aliveToken(tx, now, token)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return entity.ErrTokenAlreadyExists
+		}
+		_, exists, err = aliveAccount(tx, now, username)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return entity.ErrAccountAlreadyExists
+		}
+		// Leftovers of expired but not yet swept account.
+		if err = deleteAccount(tx, username); err != nil {
+			return err
+		}
+		err = putJSON(tx.Bucket(tokensBucket), token, tokenRecord{
+			Username:  username,
+			ExpiresAt: expiresAt(now, ttl),
+		})
+		if err != nil {
+			return fmt.Errorf("put token: %w", err)
+		}
+		err = putJSON(tx.Bucket(accountsBucket), username, accountRecord{
+			Token:     token,
+			ExpiresAt: expiresAt(now, ttl),
+		})
+		if err != nil {
+			return fmt.Errorf("put account: %w", err)
+		}
+		return nil
+	})
+}
+
+func (s *Storage) ProlongAccount(token string, ttl time.Duration) error {
+	return s.update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		t, exists, err := aliveToken(tx, now, token)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return entity.ErrAccountDoesntExists
+		}
+		t.ExpiresAt = expiresAt(now, ttl)
+		if err = putJSON(tx.Bucket(tokensBucket), token, t); err != nil {
+			return fmt.Errorf("put token: %w", err)
+		}
+		a, exists, err := aliveAccount(tx, now, t.Username)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return nil
+		}
+		a.ExpiresAt = expiresAt(now, ttl)
+		if err = putJSON(tx.Bucket(accountsBucket), t.Username, a); err != nil {
+			return fmt.Errorf("put account: %w", err)
+		}
+		return nil
+	})
+}
+
+func (s *Storage) Account(token string) (entity.Account, error) {
+	var account entity.Account
+	err := s.view(func(tx *bolt.Tx) error {
+		now := time.Now()
+		t, exists, err := aliveToken(tx, now, token)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return entity.ErrAccountDoesntExists
+		}
+		_, exists, err = aliveAccount(tx, now, t.Username)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return entity.ErrAccountDoesntExists
+		}
+		account.Address = t.Username
+		account.TTL = -1
+		if !t.ExpiresAt.IsZero() {
+			account.TTL = t.ExpiresAt.Sub(now).Milliseconds()
+		}
+		emails := tx.Bucket(emailsBucket).Bucket([]byte(t.Username))
+		if emails == nil {
+			return nil
+		}
+		c := emails.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var email entity.Email
+			if err := json.Unmarshal(v, &email); err != nil {
+				return fmt.Errorf("json unmarshal email json: %w", err)
+			}
+			account.Emails = append(account.Emails, email)
+		}
+		return nil
+	})
+	if err != nil {
+		return entity.Account{}, err
+	}
+	return account, nil
+}
+
+func (s *Storage) Emails(token string) ([]entity.EmailSummary, error) {
+	summaries := []entity.EmailSummary{}
+	err := s.view(func(tx *bolt.Tx) error {
+		emails, err := tokenEmails(tx, time.Now(), token)
+		if err != nil || emails == nil {
+			return err
+		}
+		c := emails.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var email entity.Email
+			if err := json.Unmarshal(v, &email); err != nil {
+				return fmt.Errorf("json unmarshal email json: %w", err)
+			}
+			summaries = append(summaries, email.Summary())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return summaries, nil
+}
+
+func (s *Storage) Email(token, id string) (entity.Email, error) {
+	var email entity.Email
+	err := s.view(func(tx *bolt.Tx) error {
+		emails, err := tokenEmails(tx, time.Now(), token)
+		if err != nil {
+			return err
+		}
+		email, err = getEmail(emails, id)
+		return err
+	})
+	if err != nil {
+		return entity.Email{}, err
+	}
+	return email, nil
+}
+
+func (s *Storage) Attachment(token, emailID string, n int) (entity.Attachment, error) {
+	var a entity.Attachment
+	err := s.view(func(tx *bolt.Tx) error {
+		username, err := tokenUsername(tx, time.Now(), token)
+		if err != nil {
+			return err
+		}
+		email, err := getEmail(tx.Bucket(emailsBucket).Bucket([]byte(username)), emailID)
+		if err != nil {
+			return err
+		}
+		if n < 0 || n >= len(email.Attachments) {
+			return entity.ErrFileDoesntExists
+		}
+		a = email.Attachments[n]
+		a.Data, err = getFile(tx, username, fileKey(emailID, attachmentKind, n))
+		return err
+	})
+	if err != nil {
+		return entity.Attachment{}, err
+	}
+	return a, nil
+}
+
+func (s *Storage) EmbeddedFile(token, emailID string, n int) (entity.EmbeddedFile, error) {
+	var ef entity.EmbeddedFile
+	err := s.view(func(tx *bolt.Tx) error {
+		username, err := tokenUsername(tx, time.Now(), token)
+		if err != nil {
+			return err
+		}
+		email, err := getEmail(tx.Bucket(emailsBucket).Bucket([]byte(username)), emailID)
+		if err != nil {
+			return err
+		}
+		if n < 0 || n >= len(email.EmbeddedFiles) {
+			return entity.ErrFileDoesntExists
+		}
+		ef = email.EmbeddedFiles[n]
+		ef.Data, err = getFile(tx, username, fileKey(emailID, embeddedFileKind, n))
+		return err
+	})
+	if err != nil {
+		return entity.EmbeddedFile{}, err
+	}
+	return ef, nil
+}
+
+func (s *Storage) RawEmail(token, id string) ([]byte, error) {
+	var raw []byte
+	err := s.view(func(tx *bolt.Tx) error {
+		username, err := tokenUsername(tx, time.Now(), token)
+		if err != nil {
+			return err
+		}
+		_, err = getEmail(tx.Bucket(emailsBucket).Bucket([]byte(username)), id)
+		if err != nil {
+			return err
+		}
+		raw, err = getFile(tx, username, fileKey(id, rawEmailKind, 0))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+func (s *Storage) RemoveEmail(token, id string) error {
+	var username string
+	err := s.update(func(tx *bolt.Tx) error {
+		var err error
+		username, err = tokenUsername(tx, time.Now(), token)
+		if err != nil {
+			return err
+		}
+		email, err := getEmail(tx.Bucket(emailsBucket).Bucket([]byte(username)), id)
+		if err != nil {
+			return err
+		}
+		return removeEmail(tx, username, email)
+	})
+	if err != nil {
+		return err
+	}
+	s.events.Publish(username, entity.Event{
+		Type:    entity.EventEmailRemoved,
+		EmailID: id,
+	})
+	return nil
+}
+
+func (s *Storage) RemoveAccount(token string) error {
+	var username string
+	err := s.update(func(tx *bolt.Tx) error {
+		t, exists, err := aliveToken(tx, time.Now(), token)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return entity.ErrAccountDoesntExists
+		}
+		if err = deleteAccount(tx, t.Username); err != nil {
+			return err
+		}
+		if err = tx.Bucket(tokensBucket).Delete([]byte(token)); err != nil {
+			return fmt.Errorf("delete token: %w", err)
+		}
+		username = t.Username
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.events.Publish(username, entity.Event{Type: entity.EventAccountRemoved})
+	return nil
+}
+
+func (s *Storage) AccountExists(username string) (bool, error) {
+	var exists bool
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		_, exists, err = aliveAccount(tx, time.Now(), username)
+		return err
+	})
+	return exists, err
+}
+
+// MailboxSize returns total RawSize of account emails, it is zero for
+// nonexistent accounts.
+func (s *Storage) MailboxSize(username string) (int, error) {
+	var size int
+	err := s.view(func(tx *bolt.Tx) error {
+		a, _, err := aliveAccount(tx, time.Now(), username)
+		size = a.Size
+		return err
+	})
+	return size, err
+}
+
+func (s *Storage) AddEmail(username string, email entity.Email, quota int) error {
+	emailJSON, err := json.Marshal(email)
+	if err != nil {
+		return fmt.Errorf("json marshal email: %w", err)
+	}
+	err = s.update(func(tx *bolt.Tx) error {
+		a, exists, err := aliveAccount(tx, time.Now(), username)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return entity.ErrAccountDoesntExists
+		}
+		if quota > 0 && a.Size+email.RawSize > quota {
+			return entity.ErrMailboxFull
+		}
+		a.Size += email.RawSize
+		if err = putJSON(tx.Bucket(accountsBucket), username, a); err != nil {
+			return fmt.Errorf("put account: %w", err)
+		}
+		emails, err := tx.Bucket(emailsBucket).CreateBucketIfNotExists([]byte(username))
+		if err != nil {
+			return fmt.Errorf("create account emails bucket: %w", err)
+		}
+		if err = emails.Put([]byte(email.ID), emailJSON); err != nil {
+			return fmt.Errorf("put email: %w", err)
+		}
+		if len(email.Attachments) == 0 && len(email.EmbeddedFiles) == 0 && email.Raw == nil {
+			return nil
+		}
+		files, err := tx.Bucket(filesBucket).CreateBucketIfNotExists([]byte(username))
+		if err != nil {
+			return fmt.Errorf("create account files bucket: %w", err)
+		}
+		for n, a := range email.Attachments {
+			if err = files.Put(fileKey(email.ID, attachmentKind, n), a.Data); err != nil {
+				return fmt.Errorf("put attachment: %w", err)
+			}
+		}
+		for n, ef := range email.EmbeddedFiles {
+			if err = files.Put(fileKey(email.ID, embeddedFileKind, n), ef.Data); err != nil {
+				return fmt.Errorf("put embedded file: %w", err)
+			}
+		}
+		if email.Raw != nil {
+			if err = files.Put(fileKey(email.ID, rawEmailKind, 0), email.Raw); err != nil {
+				return fmt.Errorf("put raw email: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	summary := email.Summary()
+	s.events.Publish(username, entity.Event{
+		Type:  entity.EventEmailAdded,
+		Email: &summary,
+	})
+	return nil
+}
+
+func accountInfo(tx *bolt.Tx, now time.Time, username string, a accountRecord) entity.AccountInfo {
+	info := entity.AccountInfo{
+		Address: username,
+		TTL:     -1,
+		Size:    a.Size,
+	}
+	if !a.ExpiresAt.IsZero() {
+		info.TTL = a.ExpiresAt.Sub(now).Milliseconds()
+	}
+	if emails := tx.Bucket(emailsBucket).Bucket([]byte(username)); emails != nil {
+		info.Emails = emails.Stats().KeyN
+	}
+	return info
+}
+
+// Accounts returns all alive accounts.
+func (s *Storage) Accounts() ([]entity.AccountInfo, error) {
+	var infos []entity.AccountInfo
+	err := s.view(func(tx *bolt.Tx) error {
+		now := time.Now()
+		return tx.Bucket(accountsBucket).ForEach(func(k, v []byte) error {
+			var a accountRecord
+			if err := json.Unmarshal(v, &a); err != nil {
+				return fmt.Errorf("json unmarshal account: %w", err)
+			}
+			if !expired(now, a.ExpiresAt) {
+				infos = append(infos, accountInfo(tx, now, string(k), a))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+func (s *Storage) AccountInfo(username string) (entity.AccountInfo, error) {
+	var info entity.AccountInfo
+	err := s.view(func(tx *bolt.Tx) error {
+		now := time.Now()
+		a, exists, err := aliveAccount(tx, now, username)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return entity.ErrAccountDoesntExists
+		}
+		info = accountInfo(tx, now, username, a)
+		return nil
+	})
+	if err != nil {
+		return entity.AccountInfo{}, err
+	}
+	return info, nil
+}
+
+// SetAccountTTL sets TTL of account and its token by address.
+func (s *Storage) SetAccountTTL(username string, ttl time.Duration) error {
+	return s.update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		a, exists, err := aliveAccount(tx, now, username)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return entity.ErrAccountDoesntExists
+		}
+		a.ExpiresAt = expiresAt(now, ttl)
+		if err = putJSON(tx.Bucket(accountsBucket), username, a); err != nil {
+			return fmt.Errorf("put account: %w", err)
+		}
+		if a.Token == "" {
+			return nil
+		}
+		t, exists, err := aliveToken(tx, now, a.Token)
+		if err != nil {
+			return err
+		}
+		if !exists || t.Username != username {
+			return nil
+		}
+		t.ExpiresAt = a.ExpiresAt
+		if err = putJSON(tx.Bucket(tokensBucket), a.Token, t); err != nil {
+			return fmt.Errorf("put token: %w", err)
+		}
+		return nil
+	})
+}
+
+// ExpireAccount removes account immediately as if its TTL ran out.
+func (s *Storage) ExpireAccount(username string) error {
+	err := s.update(func(tx *bolt.Tx) error {
+		a, exists, err := aliveAccount(tx, time.Now(), username)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return entity.ErrAccountDoesntExists
+		}
+		if err = deleteAccount(tx, username); err != nil {
+			return err
+		}
+		// Token left by older versions is removed by sweeper.
+		if a.Token == "" {
+			return nil
+		}
+		if err = tx.Bucket(tokensBucket).Delete([]byte(a.Token)); err != nil {
+			return fmt.Errorf("delete token: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.events.Publish(username, entity.Event{Type: entity.EventAccountExpired})
+	return nil
+}
+
+// removeEmail removes email with its files and decreases account size. Must
+// be called for alive account.
+func removeEmail(tx *bolt.Tx, username string, email entity.Email) error {
+	emails := tx.Bucket(emailsBucket).Bucket([]byte(username))
+	if err := emails.Delete([]byte(email.ID)); err != nil {
+		return fmt.Errorf("delete email: %w", err)
+	}
+	a, _, err := aliveAccount(tx, time.Now(), username)
+	if err != nil {
+		return err
+	}
+	a.Size -= email.RawSize
+	if err = putJSON(tx.Bucket(accountsBucket), username, a); err != nil {
+		return fmt.Errorf("put account: %w", err)
+	}
+	files := tx.Bucket(filesBucket).Bucket([]byte(username))
+	if files == nil {
+		return nil
+	}
+	for n := range email.Attachments {
+		if err = files.Delete(fileKey(email.ID, attachmentKind, n)); err != nil {
+			return fmt.Errorf("delete attachment: %w", err)
+		}
+	}
+	for n := range email.EmbeddedFiles {
+		if err = files.Delete(fileKey(email.ID, embeddedFileKind, n)); err != nil {
+			return fmt.Errorf("delete embedded file: %w", err)
+		}
+	}
+	if err = files.Delete(fileKey(email.ID, rawEmailKind, 0)); err != nil {
+		return fmt.Errorf("delete raw email: %w", err)
+	}
+	return nil
+}
+
+// RemoveEmailsBySender removes emails sent by sender from all accounts and
+// returns their number.
+func (s *Storage) RemoveEmailsBySender(sender string) (int, error) {
+	removed := map[string][]string{}
+	n := 0
+	err := s.update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		var usernames []string
+		err := tx.Bucket(accountsBucket).ForEach(func(k, v []byte) error {
+			var a accountRecord
+			if err := json.Unmarshal(v, &a); err != nil {
+				return fmt.Errorf("json unmarshal account: %w", err)
+			}
+			if !expired(now, a.ExpiresAt) {
+				usernames = append(usernames, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, username := range usernames {
+			emails := tx.Bucket(emailsBucket).Bucket([]byte(username))
+			if emails == nil {
+				continue
+			}
+			var matched []entity.Email
+			err := emails.ForEach(func(_, v []byte) error {
+				var email entity.Email
+				if err := json.Unmarshal(v, &email); err != nil {
+					return fmt.Errorf("json unmarshal email json: %w", err)
+				}
+				if email.SentBy(sender) {
+					matched = append(matched, email)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, email := range matched {
+				if err := removeEmail(tx, username, email); err != nil {
+					return err
+				}
+				removed[username] = append(removed[username], email.ID)
+				n++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for username, ids := range removed {
+		for _, id := range ids {
+			s.events.Publish(username, entity.Event{
+				Type:    entity.EventEmailRemoved,
+				EmailID: id,
+			})
+		}
+	}
+	return n, nil
+}
+
+// IncrCounter increments counter of key and returns its value. Counter expires
+// in ttl after the first increment.
+func (s *Storage) IncrCounter(key string, ttl time.Duration) (int, error) {
+	var n int
+	err := s.update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		counters := tx.Bucket(countersBucket)
+		var c counterRecord
+		exists, err := getJSON(counters, key, &c)
+		if err != nil {
+			return fmt.Errorf("get counter: %w", err)
+		}
+		if !exists || expired(now, c.ExpiresAt) {
+			c = counterRecord{ExpiresAt: expiresAt(now, ttl)}
+		}
+		c.N++
+		n = c.N
+		if err = putJSON(counters, key, c); err != nil {
+			return fmt.Errorf("put counter: %w", err)
+		}
+		return nil
+	})
+	return n, err
+}
+
+// DecrCounter decrements counter of key unless it is expired or zero.
+func (s *Storage) DecrCounter(key string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		counters := tx.Bucket(countersBucket)
+		var c counterRecord
+		exists, err := getJSON(counters, key, &c)
+		if err != nil {
+			return fmt.Errorf("get counter: %w", err)
+		}
+		if !exists || expired(time.Now(), c.ExpiresAt) || c.N == 0 {
+			return nil
+		}
+		c.N--
+		if err = putJSON(counters, key, c); err != nil {
+			return fmt.Errorf("put counter: %w", err)
+		}
+		return nil
+	})
+}
+
+func (s *Storage) CreateAPIKey(k entity.APIKey) error {
+	return s.update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(apiKeysBucket)
+		if keys.Get([]byte(k.ID)) != nil {
+			return entity.ErrAPIKeyAlreadyExists
+		}
+		if err := putJSON(keys, k.ID, k); err != nil {
+			return fmt.Errorf("put api key: %w", err)
+		}
+		return nil
+	})
+}
+
+func (s *Storage) APIKey(id string) (entity.APIKey, error) {
+	var k entity.APIKey
+	err := s.view(func(tx *bolt.Tx) error {
+		exists, err := getJSON(tx.Bucket(apiKeysBucket), id, &k)
+		if err != nil {
+			return fmt.Errorf("get api key: %w", err)
+		}
+		if !exists {
+			return entity.ErrAPIKeyDoesntExists
+		}
+		return nil
+	})
+	if err != nil {
+		return entity.APIKey{}, err
+	}
+	return k, nil
+}
+
+func (s *Storage) APIKeys() ([]entity.APIKey, error) {
+	keys := []entity.APIKey{}
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(apiKeysBucket).ForEach(func(_, v []byte) error {
+			var k entity.APIKey
+			if err := json.Unmarshal(v, &k); err != nil {
+				return fmt.Errorf("json unmarshal api key: %w", err)
+			}
+			keys = append(keys, k)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *Storage) RemoveAPIKey(id string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(apiKeysBucket)
+		if keys.Get([]byte(id)) == nil {
+			return entity.ErrAPIKeyDoesntExists
+		}
+		if err := keys.Delete([]byte(id)); err != nil {
+			return fmt.Errorf("delete api key: %w", err)
+		}
+		return nil
+	})
+}
+
+func (s *Storage) TouchAPIKey(id string, lastUsedAt time.Time) error {
+	return s.update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(apiKeysBucket)
+		var k entity.APIKey
+		exists, err := getJSON(keys, id, &k)
+		if err != nil {
+			return fmt.Errorf("get api key: %w", err)
+		}
+		if !exists {
+			return entity.ErrAPIKeyDoesntExists
+		}
+		k.LastUsedAt = lastUsedAt
+		if err = putJSON(keys, id, k); err != nil {
+			return fmt.Errorf("put api key: %w", err)
+		}
+		return nil
+	})
+}
+
+func (s *Storage) Subscribe(ctx context.Context, token string) (<-chan entity.Event, error) {
+	var username string
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		username, err = tokenUsername(tx, time.Now(), token)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.events.Subscribe(ctx, username), nil
+}
@@ -0,0 +1,83 @@
+package bolt
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"tmpmail/entity"
+	"tmpmail/storagetest"
+)
+
+func TestStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		s, err := NewStorage(zap.NewNop(), filepath.Join(t.TempDir(), "tmpmail.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestCompactIfNeeded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tmpmail.db")
+	s, err := NewStorage(zap.NewNop(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, a := range []string{"alice@tmp-mail.ru", "bob@tmp-mail.ru"} {
+		if err = s.CreateAccount(a, a, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := bytes.Repeat([]byte("x"), 1<<20)
+	for i := 0; i < 2*compactMinFreeBytes>>20; i++ {
+		email := entity.Email{
+			ID:          fmt.Sprintf("%04d", i),
+			Attachments: []entity.Attachment{{Filename: "a.bin", Data: data}},
+		}
+		if err = s.AddEmail("alice@tmp-mail.ru", email, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.RemoveAccount("alice@tmp-mail.ru"); err != nil {
+		t.Fatal(err)
+	}
+	// Pages of removed account are freed once later transaction commits.
+	if err = s.AddEmail("bob@tmp-mail.ru", entity.Email{ID: "0001", Subject: "kept"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raced, err := s.compactIfNeeded(false)
+	if err != nil || raced {
+		t.Fatalf("compactIfNeeded() = %v, %v, want false, nil", raced, err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size()*2 > before.Size() {
+		t.Errorf("db size after compaction = %d, want less than half of %d", after.Size(), before.Size())
+	}
+
+	// Storage keeps working with compacted file.
+	e, err := s.Email("bob@tmp-mail.ru", "0001")
+	if err != nil || e.Subject != "kept" {
+		t.Errorf("Email() after compaction = %q, %v, want %q", e.Subject, err, "kept")
+	}
+	if err = s.AddEmail("bob@tmp-mail.ru", entity.Email{ID: "0002"}, 0); err != nil {
+		t.Errorf("AddEmail() after compaction error = %v", err)
+	}
+}
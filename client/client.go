@@ -0,0 +1,442 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"tmpmail/entity"
+	"tmpmail/pow"
+)
+
+const (
+	authHeader  = "Authorization"
+	tokenHeader = "X-TOKEN"
+)
+
+var (
+	ErrUnauthorized    = errors.New("unauthorized")
+	ErrTooManyRequests = errors.New("too many requests")
+	// ErrNoEmail is returned when no matching email arrived while waiting or
+	// when account has no email with verification code or link.
+	ErrNoEmail = errors.New("no email")
+	// ErrCaptchaRequired is returned by CreateAccount if server requires
+	// captcha to create account anonymously.
+	ErrCaptchaRequired = errors.New("captcha required")
+
+	errNoChallenge = errors.New("no challenge")
+)
+
+// StatusError is returned for unexpected HTTP responses.
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.Code, e.Body)
+}
+
+// Client of tmpmail HTTP API. Idempotent requests failed by network errors
+// or 5xx responses are retried.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	retries    int
+	retryDelay time.Duration
+}
+
+// New creates client of API at baseURL like https://tmp-mail.ru. Nil
+// httpClient means http.DefaultClient.
+func New(baseURL string, httpClient *http.Client, retries int, retryDelay time.Duration) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: httpClient,
+		retries:    retries,
+		retryDelay: retryDelay,
+	}
+}
+
+type request struct {
+	method   string
+	path     string
+	query    url.Values
+	form     url.Values
+	header   http.Header
+	notFound error
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func (c *Client) newHTTPRequest(ctx context.Context, r request) (*http.Request, error) {
+	u := c.baseURL + r.path
+	if len(r.query) > 0 {
+		u += "?" + r.query.Encode()
+	}
+	var body io.Reader
+	if r.form != nil {
+		body = strings.NewReader(r.form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, r.method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range r.header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if r.form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return req, nil
+}
+
+// do sends request and returns body of 2xx response. Response status is
+// returned too, so callers may handle 204.
+func (c *Client) do(ctx context.Context, r request) (int, []byte, error) {
+	attempts := 1
+	if isIdempotent(r.method) {
+		attempts += c.retries
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			t := time.NewTimer(c.retryDelay * time.Duration(i))
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return 0, nil, ctx.Err()
+			case <-t.C:
+			}
+		}
+
+		var (
+			status int
+			body   []byte
+			retry  bool
+		)
+		status, body, retry, err = c.doOnce(ctx, r)
+		if err == nil || !retry {
+			return status, body, err
+		}
+	}
+	return 0, nil, err
+}
+
+func (c *Client) doOnce(ctx context.Context, r request) (status int, body []byte, retry bool, err error) {
+	req, err := c.newHTTPRequest(ctx, r)
+	if err != nil {
+		return 0, nil, false, fmt.Errorf("new request: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, nil, ctx.Err() == nil, fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, ctx.Err() == nil, fmt.Errorf("read response: %w", err)
+	}
+
+	switch {
+	case resp.StatusCode < 300:
+		return resp.StatusCode, body, false, nil
+	case resp.StatusCode == http.StatusNotFound && r.notFound != nil:
+		return resp.StatusCode, nil, false, notFoundError(body, r.notFound)
+	case resp.StatusCode == http.StatusConflict:
+		return resp.StatusCode, nil, false, fmt.Errorf("%w: %s", entity.ErrAccountAlreadyExists, strings.TrimSpace(string(body)))
+	case resp.StatusCode == http.StatusUnauthorized:
+		return resp.StatusCode, nil, false, ErrUnauthorized
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return resp.StatusCode, nil, false, ErrTooManyRequests
+	}
+	return resp.StatusCode, nil, resp.StatusCode >= 500, &StatusError{
+		Code: resp.StatusCode,
+		Body: strings.TrimSpace(string(body)),
+	}
+}
+
+// notFoundError returns entity error named by 404 response body, so
+// missing account is told apart from missing email. Otherwise def is
+// returned.
+func notFoundError(body []byte, def error) error {
+	name := strings.TrimSpace(string(body))
+	for _, err := range []error{entity.ErrAccountDoesntExists, entity.ErrEmailDoesntExists, entity.ErrFileDoesntExists} {
+		if name == err.Error() {
+			return err
+		}
+	}
+	return def
+}
+
+func (c *Client) doJSON(ctx context.Context, r request, v interface{}) (int, error) {
+	status, body, err := c.do(ctx, r)
+	if err != nil {
+		return status, err
+	}
+	if status == http.StatusNoContent || v == nil {
+		return status, nil
+	}
+	if err = json.Unmarshal(body, v); err != nil {
+		return status, fmt.Errorf("json unmarshal response: %w", err)
+	}
+	return status, nil
+}
+
+func tokenRequest(method, path, token string, notFound error) request {
+	return request{
+		method:   method,
+		path:     path,
+		header:   http.Header{tokenHeader: {token}},
+		notFound: notFound,
+	}
+}
+
+// Domains returns domains of server accounts, the first one is default.
+func (c *Client) Domains(ctx context.Context) ([]string, error) {
+	var domains []string
+	_, err := c.doJSON(ctx, request{method: http.MethodGet, path: "/api/domains"}, &domains)
+	if err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
+
+// AccountChallenge returns challenge which must be passed to create account
+// anonymously or nil if server doesn't require verification.
+func (c *Client) AccountChallenge(ctx context.Context) (*entity.AccountChallenge, error) {
+	var ch entity.AccountChallenge
+	status, err := c.doJSON(ctx, request{
+		method:   http.MethodGet,
+		path:     "/api/account/challenge",
+		notFound: errNoChallenge,
+	}, &ch)
+	if err != nil {
+		// Servers without verification support have no challenges.
+		if errors.Is(err, errNoChallenge) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if status == http.StatusNoContent {
+		return nil, nil
+	}
+	return &ch, nil
+}
+
+// CreateAccount creates account with username in domain and returns its
+// token. Empty username means random one, empty domain means server default.
+// entity.ErrAccountAlreadyExists is returned if username is taken. Proof of
+// work required by server is solved, ErrCaptchaRequired is returned if server
+// requires captcha.
+func (c *Client) CreateAccount(ctx context.Context, username, domain string) (string, error) {
+	r := request{method: http.MethodPost, path: "/api/account", form: url.Values{}}
+	if username != "" {
+		r.form.Set("username", username)
+	}
+	if domain != "" {
+		r.form.Set("domain", domain)
+	}
+	ch, err := c.AccountChallenge(ctx)
+	if err != nil {
+		return "", fmt.Errorf("get account challenge: %w", err)
+	}
+	if ch != nil {
+		if ch.Type != entity.AccountChallengePoW {
+			return "", ErrCaptchaRequired
+		}
+		nonce, err := pow.Solve(ctx, ch.Challenge, ch.Difficulty)
+		if err != nil {
+			return "", fmt.Errorf("solve proof of work: %w", err)
+		}
+		r.form.Set("verification", ch.Challenge+":"+nonce)
+	}
+	var token string
+	_, err = c.doJSON(ctx, r, &token)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// CreateAccounts creates accounts with given addresses using admin auth token
+// or API key with bulk-create scope and returns their tokens in the same
+// order. Addresses without domain are
+// created in server default domain. Zero ttl means server default.
+func (c *Client) CreateAccounts(ctx context.Context, authToken string, addresses []string, ttl time.Duration) ([]string, error) {
+	form := url.Values{"emails": {strings.Join(addresses, ",")}}
+	if ttl > 0 {
+		form.Set("ttl", ttl.String())
+	}
+	var tokens []string
+	_, err := c.doJSON(ctx, request{
+		method: http.MethodPut,
+		path:   "/api/account",
+		form:   form,
+		header: http.Header{
+			authHeader: {authToken},
+			"Accept":   {"application/json"},
+		},
+	}, &tokens)
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (c *Client) Account(ctx context.Context, token string) (entity.Account, error) {
+	var a entity.Account
+	_, err := c.doJSON(ctx, tokenRequest(http.MethodGet, "/api/account", token, entity.ErrAccountDoesntExists), &a)
+	if err != nil {
+		return entity.Account{}, err
+	}
+	return a, nil
+}
+
+// ProlongAccount resets account TTL to server default.
+func (c *Client) ProlongAccount(ctx context.Context, token string) error {
+	_, _, err := c.do(ctx, tokenRequest(http.MethodPatch, "/api/account", token, entity.ErrAccountDoesntExists))
+	return err
+}
+
+func (c *Client) RemoveAccount(ctx context.Context, token string) error {
+	_, _, err := c.do(ctx, tokenRequest(http.MethodDelete, "/api/account", token, entity.ErrAccountDoesntExists))
+	return err
+}
+
+func tagQuery(tag string) url.Values {
+	if tag == "" {
+		return nil
+	}
+	return url.Values{"tag": {tag}}
+}
+
+// Emails returns account emails summaries from newest to oldest. Only emails
+// sent to user+tag subaddress are returned if tag isn't empty.
+func (c *Client) Emails(ctx context.Context, token, tag string) ([]entity.EmailSummary, error) {
+	r := tokenRequest(http.MethodGet, "/api/account/emails", token, entity.ErrAccountDoesntExists)
+	r.query = tagQuery(tag)
+	var emails []entity.EmailSummary
+	_, err := c.doJSON(ctx, r, &emails)
+	if err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+func emailPath(id string) string {
+	return "/api/account/emails/" + url.PathEscape(id)
+}
+
+// Email returns account email. ErrEmailDoesntExists is returned if there is
+// no such email and ErrAccountDoesntExists if account is gone.
+func (c *Client) Email(ctx context.Context, token, id string) (entity.Email, error) {
+	var e entity.Email
+	_, err := c.doJSON(ctx, tokenRequest(http.MethodGet, emailPath(id), token, entity.ErrEmailDoesntExists), &e)
+	if err != nil {
+		return entity.Email{}, err
+	}
+	return e, nil
+}
+
+func (c *Client) RemoveEmail(ctx context.Context, token, id string) error {
+	_, _, err := c.do(ctx, tokenRequest(http.MethodDelete, emailPath(id), token, entity.ErrEmailDoesntExists))
+	return err
+}
+
+// Attachment returns data of n-th email attachment.
+func (c *Client) Attachment(ctx context.Context, token, emailID string, n int) ([]byte, error) {
+	path := emailPath(emailID) + "/attachments/" + strconv.Itoa(n)
+	_, data, err := c.do(ctx, tokenRequest(http.MethodGet, path, token, entity.ErrFileDoesntExists))
+	return data, err
+}
+
+// RawEmail returns original message in RFC 5322 format.
+func (c *Client) RawEmail(ctx context.Context, token, id string) ([]byte, error) {
+	_, data, err := c.do(ctx, tokenRequest(http.MethodGet, emailPath(id)+"/raw", token, entity.ErrFileDoesntExists))
+	return data, err
+}
+
+// Verification returns the latest one-time code and action link found in
+// account emails sent to tag subaddress or any emails if tag is empty.
+// ErrNoEmail is returned if there are none.
+func (c *Client) Verification(ctx context.Context, token, tag string) (entity.Verification, error) {
+	r := tokenRequest(http.MethodGet, "/api/account/verification", token, entity.ErrAccountDoesntExists)
+	r.query = tagQuery(tag)
+	var v entity.Verification
+	status, err := c.doJSON(ctx, r, &v)
+	if err != nil {
+		return entity.Verification{}, err
+	}
+	if status == http.StatusNoContent {
+		return entity.Verification{}, ErrNoEmail
+	}
+	return v, nil
+}
+
+// WaitQuery selects email to wait for. Tag matches emails sent to user+tag
+// subaddress. Subject, From and Body match by case-insensitive substring or by
+// regular expression enclosed in slashes. Since is ID of the last seen email,
+// only newer emails match.
+type WaitQuery struct {
+	Since   string
+	Tag     string
+	Subject string
+	From    string
+	Body    string
+	Timeout time.Duration
+}
+
+func (q WaitQuery) values() url.Values {
+	v := url.Values{}
+	for k, s := range map[string]string{
+		"since":   q.Since,
+		"tag":     q.Tag,
+		"subject": q.Subject,
+		"from":    q.From,
+		"body":    q.Body,
+	} {
+		if s != "" {
+			v.Set(k, s)
+		}
+	}
+	if q.Timeout > 0 {
+		v.Set("timeout", q.Timeout.String())
+	}
+	return v
+}
+
+// WaitEmail waits until matching email arrives to account. ErrNoEmail is
+// returned if none arrived within timeout.
+func (c *Client) WaitEmail(ctx context.Context, token string, q WaitQuery) (entity.Email, error) {
+	r := tokenRequest(http.MethodGet, "/api/account/wait", token, entity.ErrAccountDoesntExists)
+	r.query = q.values()
+	var e entity.Email
+	status, err := c.doJSON(ctx, r, &e)
+	if err != nil {
+		return entity.Email{}, err
+	}
+	if status == http.StatusNoContent {
+		return entity.Email{}, ErrNoEmail
+	}
+	return e, nil
+}
@@ -0,0 +1,256 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"tmpmail"
+	"tmpmail/client"
+	"tmpmail/entity"
+	"tmpmail/memory"
+)
+
+const (
+	testDomain    = "tmpmail.test"
+	testAuthToken = "test-auth-token"
+)
+
+// newTestClient returns client making retries of HTTPServer with memory
+// storage. Handler h wraps server handler if it isn't nil.
+func newTestClient(t *testing.T, h func(http.Handler) http.Handler, retries int) (*client.Client, *memory.Storage) {
+	t.Helper()
+	st := memory.NewStorage()
+	srv := tmpmail.NewHTTPServer(zap.NewNop(), st, "", nil, []string{testDomain}, nil,
+		testAuthToken, time.Hour, nil, nil, tmpmail.AccountCreationLimit{}, nil, nil)
+	handler := srv.Handler()
+	if h != nil {
+		handler = h(handler)
+	}
+	ts := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		ts.Close()
+		st.Close()
+	})
+	return client.New(ts.URL, ts.Client(), retries, time.Millisecond), st
+}
+
+func TestAccountLifecycle(t *testing.T) {
+	c, _ := newTestClient(t, nil, 0)
+	ctx := context.Background()
+
+	token, err := c.CreateAccount(ctx, "alice", "")
+	if err != nil {
+		t.Fatalf("CreateAccount() error = %v", err)
+	}
+	if _, err = c.CreateAccount(ctx, "alice", ""); !errors.Is(err, entity.ErrAccountAlreadyExists) {
+		t.Errorf("CreateAccount() of taken username error = %v, want %v", err, entity.ErrAccountAlreadyExists)
+	}
+
+	a, err := c.Account(ctx, token)
+	if err != nil {
+		t.Fatalf("Account() error = %v", err)
+	}
+	if want := "alice@" + testDomain; a.Address != want {
+		t.Errorf("Account() address = %q, want %q", a.Address, want)
+	}
+	if err = c.ProlongAccount(ctx, token); err != nil {
+		t.Errorf("ProlongAccount() error = %v", err)
+	}
+	if err = c.RemoveAccount(ctx, token); err != nil {
+		t.Errorf("RemoveAccount() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{name: "Account", call: func() error { _, err := c.Account(ctx, token); return err }},
+		{name: "ProlongAccount", call: func() error { return c.ProlongAccount(ctx, token) }},
+		{name: "RemoveAccount", call: func() error { return c.RemoveAccount(ctx, token) }},
+		{name: "Emails", call: func() error { _, err := c.Emails(ctx, token, ""); return err }},
+		{name: "Email", call: func() error { _, err := c.Email(ctx, token, "1"); return err }},
+		{name: "RemoveEmail", call: func() error { return c.RemoveEmail(ctx, token, "1") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" removed", func(t *testing.T) {
+			if err := tt.call(); !errors.Is(err, entity.ErrAccountDoesntExists) {
+				t.Errorf("%s() error = %v, want %v", tt.name, err, entity.ErrAccountDoesntExists)
+			}
+		})
+	}
+}
+
+func TestCreateAccounts(t *testing.T) {
+	c, _ := newTestClient(t, nil, 0)
+	ctx := context.Background()
+
+	addresses := []string{"bob", "carol@" + testDomain}
+	tokens, err := c.CreateAccounts(ctx, testAuthToken, addresses, time.Minute)
+	if err != nil {
+		t.Fatalf("CreateAccounts() error = %v", err)
+	}
+	if len(tokens) != len(addresses) {
+		t.Fatalf("CreateAccounts() returned %d tokens, want %d", len(tokens), len(addresses))
+	}
+	for i, want := range []string{"bob@" + testDomain, "carol@" + testDomain} {
+		a, err := c.Account(ctx, tokens[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Address != want {
+			t.Errorf("account %d address = %q, want %q", i, a.Address, want)
+		}
+	}
+
+	if _, err = c.CreateAccounts(ctx, "wrong", []string{"dave"}, 0); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("CreateAccounts() with wrong token error = %v, want %v", err, client.ErrUnauthorized)
+	}
+}
+
+func TestEmails(t *testing.T) {
+	c, st := newTestClient(t, nil, 0)
+	ctx := context.Background()
+
+	token, err := c.CreateAccount(ctx, "alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := entity.Email{
+		ID:          "1",
+		Subject:     "Welcome",
+		TextBody:    "hello",
+		Attachments: []entity.Attachment{{Filename: "a.txt", ContentType: "text/plain", Data: []byte("data")}},
+	}
+	if err = st.AddEmail("alice@"+testDomain, email, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	summaries, err := c.Emails(ctx, token, "")
+	if err != nil {
+		t.Fatalf("Emails() error = %v", err)
+	}
+	if len(summaries) != 1 || summaries[0].ID != "1" || summaries[0].Attachments != 1 {
+		t.Errorf("Emails() = %+v, want summary of email 1", summaries)
+	}
+	e, err := c.Email(ctx, token, "1")
+	if err != nil {
+		t.Fatalf("Email() error = %v", err)
+	}
+	if e.Subject != email.Subject || e.TextBody != email.TextBody {
+		t.Errorf("Email() = %+v, want %+v", e, email)
+	}
+	data, err := c.Attachment(ctx, token, "1", 0)
+	if err != nil {
+		t.Fatalf("Attachment() error = %v", err)
+	}
+	if string(data) != "data" {
+		t.Errorf("Attachment() = %q, want %q", data, "data")
+	}
+
+	if err = c.RemoveEmail(ctx, token, "1"); err != nil {
+		t.Fatalf("RemoveEmail() error = %v", err)
+	}
+	if _, err = c.Email(ctx, token, "1"); !errors.Is(err, entity.ErrEmailDoesntExists) {
+		t.Errorf("Email() of removed email error = %v, want %v", err, entity.ErrEmailDoesntExists)
+	}
+}
+
+func TestWaitEmail(t *testing.T) {
+	c, st := newTestClient(t, nil, 0)
+	ctx := context.Background()
+
+	token, err := c.CreateAccount(ctx, "alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.WaitEmail(ctx, token, client.WaitQuery{Timeout: 10 * time.Millisecond}); !errors.Is(err, client.ErrNoEmail) {
+		t.Errorf("WaitEmail() without emails error = %v, want %v", err, client.ErrNoEmail)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		st.AddEmail("alice@"+testDomain, entity.Email{ID: "1", Subject: "Your code"}, 0)
+	}()
+	e, err := c.WaitEmail(ctx, token, client.WaitQuery{Subject: "code", Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("WaitEmail() error = %v", err)
+	}
+	if e.ID != "1" {
+		t.Errorf("WaitEmail() ID = %q, want %q", e.ID, "1")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = c.WaitEmail(ctx, token, client.WaitQuery{Since: "1", Timeout: 5 * time.Second})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("WaitEmail() with canceled context error = %v, want %v", err, context.Canceled)
+	}
+}
+
+// failFirst fails the first n requests with method with status 503, empty
+// method matches all requests. Matching requests are counted in requests.
+func failFirst(method string, n int32, requests *int32) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if method != "" && r.Method != method {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if atomic.AddInt32(requests, 1) <= n {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var requests int32
+	c, _ := newTestClient(t, failFirst("", 2, &requests), 2)
+	ctx := context.Background()
+
+	// Idempotent request is retried.
+	domains, err := c.Domains(ctx)
+	if err != nil {
+		t.Fatalf("Domains() error = %v", err)
+	}
+	if len(domains) != 1 || domains[0] != testDomain {
+		t.Errorf("Domains() = %q, want %q", domains, []string{testDomain})
+	}
+	if atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("Domains() sent %d requests, want 3", requests)
+	}
+
+	// Not found isn't retried.
+	atomic.StoreInt32(&requests, 2)
+	if err = c.ProlongAccount(ctx, "unknown"); !errors.Is(err, entity.ErrAccountDoesntExists) {
+		t.Errorf("ProlongAccount() error = %v, want %v", err, entity.ErrAccountDoesntExists)
+	}
+	if atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("ProlongAccount() sent %d requests, want 1", requests-2)
+	}
+
+}
+
+func TestRetriesNotIdempotent(t *testing.T) {
+	var requests int32
+	c, _ := newTestClient(t, failFirst(http.MethodPost, 1, &requests), 2)
+
+	_, err := c.CreateAccount(context.Background(), "alice", "")
+	var statusErr *client.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusServiceUnavailable {
+		t.Errorf("CreateAccount() error = %v, want status %d", err, http.StatusServiceUnavailable)
+	}
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("CreateAccount() sent %d POST requests, want 1", requests)
+	}
+}
@@ -0,0 +1,51 @@
+package tmpmail
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const forwardedForHeader = "X-Forwarded-For"
+
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns IP of HTTP client. X-Forwarded-For is used only for
+// requests from trusted proxies: the rightmost address which doesn't belong to
+// trusted proxies is the client one, addresses left of it may be forged.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if !isTrusted(ip, trusted) {
+		return ip.String()
+	}
+
+	var forwarded []string
+	for _, h := range r.Header.Values(forwardedForHeader) {
+		forwarded = append(forwarded, strings.Split(h, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		fip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if fip == nil {
+			break
+		}
+		ip = fip
+		if !isTrusted(ip, trusted) {
+			break
+		}
+	}
+	return ip.String()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"tmpmail"
+	"tmpmail/bolt"
+	"tmpmail/entity"
+)
+
+// openStorage opens storage of config file, environment variables or flags.
+// Memory storage is refused since keys of the command process are lost when
+// it exits. Bolt storage can't be opened while server is running.
+func openStorage(cmd *cobra.Command) (storage, error) {
+	v, err := newViper(cmd.Flags())
+	if err != nil {
+		return nil, err
+	}
+	storageURL := v.GetString("storage")
+	if u, err := url.Parse(storageURL); err == nil && u.Scheme == "memory" {
+		return nil, errors.New("memory storage isn't shared with server, API keys need redis or bolt storage")
+	}
+	s, err := newStorage(zap.NewNop(), storageURL)
+	if errors.Is(err, bolt.ErrLocked) {
+		return nil, errors.New("bolt db is locked by running server, stop it to manage API keys")
+	}
+	return s, err
+}
+
+func apiKeyIssue(cmd *cobra.Command, _ []string) error {
+	name, _ := cmd.Flags().GetString("name")
+	scopes, _ := cmd.Flags().GetStringSlice("scopes")
+	ttl, _ := cmd.Flags().GetDuration("ttl")
+	if name == "" {
+		return errors.New("empty name")
+	}
+	if len(scopes) == 0 {
+		return errors.New("empty scopes")
+	}
+	if ttl < 0 {
+		return fmt.Errorf("invalid TTL: %s", ttl)
+	}
+
+	s, err := openStorage(cmd)
+	if err != nil {
+		return fmt.Errorf("init storage: %w", err)
+	}
+	defer s.Close()
+
+	key, k, err := tmpmail.IssueAPIKey(s, name, scopes, ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.ErrOrStderr(), "API key %s is shown only once, keep it secret.\n", k.ID)
+	fmt.Fprintln(cmd.OutOrStdout(), key)
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func apiKeyList(cmd *cobra.Command, _ []string) error {
+	s, err := openStorage(cmd)
+	if err != nil {
+		return fmt.Errorf("init storage: %w", err)
+	}
+	defer s.Close()
+
+	keys, err := s.APIKeys()
+	if err != nil {
+		return fmt.Errorf("list api keys: %w", err)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tSCOPES\tCREATED\tEXPIRES\tLAST USED")
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.Name, strings.Join(k.Scopes, ","),
+			formatTime(k.CreatedAt), formatTime(k.ExpiresAt), formatTime(k.LastUsedAt))
+	}
+	return w.Flush()
+}
+
+func apiKeyRevoke(cmd *cobra.Command, args []string) error {
+	s, err := openStorage(cmd)
+	if err != nil {
+		return fmt.Errorf("init storage: %w", err)
+	}
+	defer s.Close()
+
+	for _, id := range args {
+		if err = s.RemoveAPIKey(id); err != nil {
+			return fmt.Errorf("revoke api key %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func apiKeyCommand() *cobra.Command {
+	apiKeyCmd := &cobra.Command{
+		Use:   "apikey",
+		Short: "Manage API keys of admin API",
+	}
+	addStorageFlags(apiKeyCmd.PersistentFlags())
+
+	issueCmd := &cobra.Command{
+		Use:   "issue",
+		Short: "Issue API key and print it",
+		Args:  cobra.NoArgs,
+		RunE:  apiKeyIssue,
+	}
+	issueCmd.Flags().String("name", "", "key name, e.g. CI pipeline")
+	issueCmd.Flags().StringSlice("scopes", nil,
+		"key scopes: "+strings.Join(entity.Scopes, ", "))
+	issueCmd.Flags().Duration("ttl", 0, "key TTL, 0 means key doesn't expire")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List API keys",
+		Args:  cobra.NoArgs,
+		RunE:  apiKeyList,
+	}
+
+	revokeCmd := &cobra.Command{
+		Use:   "revoke ID...",
+		Short: "Revoke API keys",
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  apiKeyRevoke,
+	}
+
+	// main prints errors, usage is printed only by --help.
+	for _, c := range []*cobra.Command{issueCmd, listCmd, revokeCmd} {
+		c.SilenceErrors = true
+		c.SilenceUsage = true
+	}
+
+	apiKeyCmd.AddCommand(issueCmd, listCmd, revokeCmd)
+	return apiKeyCmd
+}
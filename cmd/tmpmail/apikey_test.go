@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"tmpmail/bolt"
+)
+
+// runAPIKey runs apikey command with args and returns its standard output.
+func runAPIKey(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	cmd := apiKeyCommand()
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetErr(io.Discard)
+	cmd.SetArgs(args)
+	err := cmd.Execute()
+	return out.String(), err
+}
+
+func TestAPIKeyCommand(t *testing.T) {
+	storage := "--storage=bolt://" + filepath.Join(t.TempDir(), "tmpmail.db")
+
+	key, err := runAPIKey(t, "issue", storage, "--name=ci", "--scopes=admin-read,bulk-create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key = strings.TrimSpace(key)
+	if !strings.HasPrefix(key, "tmk_") {
+		t.Fatalf("issued key = %q, want tmk_ prefix", key)
+	}
+	id := strings.SplitN(strings.TrimPrefix(key, "tmk_"), "_", 2)[0]
+
+	if _, err = runAPIKey(t, "issue", storage, "--name=ci", "--scopes=root"); err == nil {
+		t.Error("issue with unknown scope succeeded")
+	}
+
+	list, err := runAPIKey(t, "list", storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(list, id) || !strings.Contains(list, "admin-read,bulk-create") {
+		t.Errorf("list = %q, want key %s with its scopes", list, id)
+	}
+
+	if _, err = runAPIKey(t, "revoke", storage, id); err != nil {
+		t.Fatal(err)
+	}
+	if list, err = runAPIKey(t, "list", storage); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(list, id) {
+		t.Errorf("list after revoke = %q, want no key %s", list, id)
+	}
+}
+
+func TestAPIKeyCommandStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tmpmail.db")
+	// Server holds bolt file.
+	s, err := bolt.NewStorage(zap.NewNop(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for storage, wantErr := range map[string]string{
+		"memory://":      "memory storage isn't shared with server",
+		"bolt://" + path: "locked by running server",
+	} {
+		_, err = runAPIKey(t, "list", "--storage="+storage)
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("list with %s storage error = %v, want %q", storage, err, wantErr)
+		}
+	}
+}
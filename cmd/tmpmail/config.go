@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"tmpmail"
+	"tmpmail/mailauth"
+	"tmpmail/pow"
+)
+
+// envPrefix is a prefix of environment variables, e.g. flag --mail-domain is
+// set by TMPMAIL_MAIL_DOMAIN.
+const envPrefix = "TMPMAIL"
+
+// config of server command. Values are taken from flags, environment
+// variables and config file in order of precedence.
+type config struct {
+	Domains             []string      `mapstructure:"domains"`
+	MailDomain          string        `mapstructure:"mail-domain"`
+	SMTPAddr            string        `mapstructure:"smtp-addr"`
+	HTTPAddr            string        `mapstructure:"http-addr"`
+	Storage             string        `mapstructure:"storage"`
+	AuthToken           string        `mapstructure:"auth-token"`
+	EmailTTL            time.Duration `mapstructure:"email-ttl"`
+	CORSOrigins         []string      `mapstructure:"cors-origins"`
+	UsernameDenylist    []string      `mapstructure:"username-denylist"`
+	MaxMessageSize      int           `mapstructure:"max-message-size"`
+	MaxAttachmentSize   int           `mapstructure:"max-attachment-size"`
+	MailboxQuota        int           `mapstructure:"mailbox-quota"`
+	MaxRawEmailSize     int           `mapstructure:"max-raw-email-size"`
+	MailAuth            bool          `mapstructure:"mail-auth"`
+	SMTPIPInterval      time.Duration `mapstructure:"smtp-ip-interval"`
+	SMTPIPBurst         int           `mapstructure:"smtp-ip-burst"`
+	SMTPSenderInterval  time.Duration `mapstructure:"smtp-sender-interval"`
+	SMTPSenderBurst     int           `mapstructure:"smtp-sender-burst"`
+	SMTPMailboxInterval time.Duration `mapstructure:"smtp-mailbox-interval"`
+	SMTPMailboxBurst    int           `mapstructure:"smtp-mailbox-burst"`
+	TrustedProxies      []string      `mapstructure:"trusted-proxies"`
+	AccountLimit        int           `mapstructure:"account-limit"`
+	AccountLimitWindow  time.Duration `mapstructure:"account-limit-window"`
+	AccountVerification string        `mapstructure:"account-verification"`
+	PoWDifficulty       int           `mapstructure:"pow-difficulty"`
+	PoWSecret           string        `mapstructure:"pow-secret"`
+	CaptchaVerifyURL    string        `mapstructure:"captcha-verify-url"`
+	CaptchaSiteKey      string        `mapstructure:"captcha-site-key"`
+	CaptchaSecret       string        `mapstructure:"captcha-secret"`
+	TLSMode             string        `mapstructure:"tls-mode"`
+	TLSCert             string        `mapstructure:"tls-cert"`
+	TLSKey              string        `mapstructure:"tls-key"`
+	CertsCache          string        `mapstructure:"certs-cache"`
+}
+
+var configFile string
+
+// addStorageFlags adds flags needed to open storage.
+func addStorageFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&configFile, "config", "", "config file in YAML or TOML format")
+	fs.String("storage", "redis://127.0.0.1:6379",
+		"storage url: redis://host:port, memory:// or bolt:///path/to/file.db")
+}
+
+func addConfigFlags(fs *pflag.FlagSet) {
+	addStorageFlags(fs)
+	fs.StringSlice("domains", []string{"tmp-mail.ru"},
+		"domains of temporary emails, the first one is default and serves web interface")
+	fs.String("mail-domain", "smtp.tmp-mail.ru", "domain of SMTP server")
+	fs.String("smtp-addr", "0.0.0.0:25", "")
+	fs.String("http-addr", "0.0.0.0:443", "")
+	fs.String("auth-token", "",
+		"admin auth token with all scopes, at least 40 characters, empty means only API keys are accepted")
+	fs.Duration("email-ttl", 10*time.Minute, "default account TTL")
+	fs.StringSlice("cors-origins", []string{"https://tmp-mail.ru", "http://localhost:3000"},
+		"origins allowed to use API from browser")
+	fs.StringSlice("username-denylist", nil, "words not allowed in usernames chosen by users")
+	fs.Int("max-message-size", 25<<20, "max size of received message in bytes, 0 means unlimited")
+	fs.Int("max-attachment-size", 10<<20,
+		"max size of decoded attachment or embedded file in bytes, 0 means unlimited")
+	fs.Int("mailbox-quota", 50<<20, "max total size of account emails in bytes, 0 means unlimited")
+	fs.Int("max-raw-email-size", 10<<20,
+		"max size of original message kept for download in bytes, 0 means unlimited")
+	fs.Bool("mail-auth", true, "check SPF, DKIM and DMARC of received messages")
+	fs.Duration("smtp-ip-interval", time.Second,
+		"interval of messages from one IP after burst is spent, 0 means unlimited")
+	fs.Int("smtp-ip-burst", 60, "max burst of messages from one IP")
+	fs.Duration("smtp-sender-interval", time.Second,
+		"interval of recipients from one MAIL FROM domain after burst is spent, 0 means unlimited")
+	fs.Int("smtp-sender-burst", 60, "max burst of recipients from one MAIL FROM domain")
+	fs.Duration("smtp-mailbox-interval", 6*time.Second,
+		"interval of messages to one mailbox after burst is spent, 0 means unlimited")
+	fs.Int("smtp-mailbox-burst", 30, "max burst of messages to one mailbox")
+	fs.StringSlice("trusted-proxies", nil,
+		"IPs or CIDRs of reverse proxies whose X-Forwarded-For header is trusted")
+	fs.Int("account-limit", 20, "max anonymous account creations per client IP in window, 0 means unlimited")
+	fs.Duration("account-limit-window", time.Hour, "window of account creations limit")
+	fs.String("account-verification", accountVerificationNone,
+		"verification of anonymous account creation: none, pow or captcha")
+	fs.Int("pow-difficulty", 16, "leading zero bits of proof of work hash")
+	fs.String("pow-secret", "", "key signing proof of work challenges, at least 32 characters")
+	fs.String("captcha-verify-url", "https://hcaptcha.com/siteverify",
+		"siteverify API URL of hCaptcha, reCAPTCHA or Turnstile")
+	fs.String("captcha-site-key", "", "captcha site key")
+	fs.String("captcha-secret", "", "captcha secret key")
+	fs.String("tls-mode", tlsModeACME, "TLS mode: acme, files, self-signed or none")
+	fs.String("tls-cert", "", "certificate file for files TLS mode")
+	fs.String("tls-key", "", "key file for files TLS mode")
+	fs.String("certs-cache", "/var/lib/tmpmail/certs", "directory of certificates for acme TLS mode")
+}
+
+// newViper reads settings from flags, environment variables and config file.
+func newViper(fs *pflag.FlagSet) (*viper.Viper, error) {
+	v := viper.New()
+
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
+
+	err := v.BindPFlags(fs)
+	if err != nil {
+		return nil, fmt.Errorf("bind flags: %w", err)
+	}
+
+	if configFile != "" {
+		v.SetConfigFile(configFile)
+		err = v.ReadInConfig()
+		if err != nil {
+			return nil, fmt.Errorf("read config file: %w", err)
+		}
+	}
+	return v, nil
+}
+
+func loadConfig(fs *pflag.FlagSet) (config, error) {
+	v, err := newViper(fs)
+	if err != nil {
+		return config{}, err
+	}
+
+	var c config
+	err = v.Unmarshal(&c)
+	if err != nil {
+		return config{}, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	for i, d := range c.Domains {
+		c.Domains[i] = strings.ToLower(d)
+	}
+	c.MailDomain = strings.ToLower(c.MailDomain)
+
+	return c, c.validate()
+}
+
+var domainRE = regexp.MustCompile(`^(?i)[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`)
+
+func (c config) validate() error {
+	if len(c.Domains) == 0 {
+		return errors.New("empty domains")
+	}
+	for _, d := range c.Domains {
+		if !domainRE.MatchString(d) {
+			return fmt.Errorf("invalid domain: %q", d)
+		}
+	}
+	if !domainRE.MatchString(c.MailDomain) {
+		return fmt.Errorf("invalid mail domain: %q", c.MailDomain)
+	}
+	if c.SMTPAddr == "" {
+		return errors.New("empty SMTP address")
+	}
+	if c.HTTPAddr == "" {
+		return errors.New("empty HTTP address")
+	}
+	if c.AuthToken != "" && len(c.AuthToken) < 40 {
+		return errors.New("too simple auth token")
+	}
+	if c.EmailTTL <= 0 {
+		return fmt.Errorf("invalid email TTL: %s", c.EmailTTL)
+	}
+	if c.MaxMessageSize < 0 {
+		return fmt.Errorf("invalid max message size: %d", c.MaxMessageSize)
+	}
+	if c.MaxAttachmentSize < 0 {
+		return fmt.Errorf("invalid max attachment size: %d", c.MaxAttachmentSize)
+	}
+	if c.MailboxQuota < 0 {
+		return fmt.Errorf("invalid mailbox quota: %d", c.MailboxQuota)
+	}
+	if c.MaxRawEmailSize < 0 {
+		return fmt.Errorf("invalid max raw email size: %d", c.MaxRawEmailSize)
+	}
+	rl := c.smtpRateLimits()
+	for name, l := range map[string]tmpmail.SMTPRateLimit{
+		"IP":      rl.IP,
+		"sender":  rl.Sender,
+		"mailbox": rl.Mailbox,
+	} {
+		if l.Interval < 0 || (l.Interval > 0 && l.Burst < 1) {
+			return fmt.Errorf("invalid SMTP %s rate limit: %s, burst %d", name, l.Interval, l.Burst)
+		}
+	}
+	if _, err := parseCIDRs(c.TrustedProxies); err != nil {
+		return err
+	}
+	if c.AccountLimit < 0 || (c.AccountLimit > 0 && c.AccountLimitWindow <= 0) {
+		return fmt.Errorf("invalid account limit: %d per %s", c.AccountLimit, c.AccountLimitWindow)
+	}
+	switch c.AccountVerification {
+	case accountVerificationNone:
+	case accountVerificationPoW:
+		if c.PoWDifficulty < 1 || c.PoWDifficulty > pow.MaxDifficulty {
+			return fmt.Errorf("invalid proof of work difficulty: %d", c.PoWDifficulty)
+		}
+		if len(c.PoWSecret) < 32 {
+			return errors.New("empty or too simple proof of work secret")
+		}
+	case accountVerificationCaptcha:
+		if c.CaptchaVerifyURL == "" || c.CaptchaSiteKey == "" || c.CaptchaSecret == "" {
+			return errors.New("captcha verify URL, site key and secret are required for captcha verification")
+		}
+	default:
+		return fmt.Errorf("unknown account verification: %s", c.AccountVerification)
+	}
+	if len(c.CORSOrigins) == 0 {
+		return errors.New("empty CORS origins")
+	}
+	for _, o := range c.CORSOrigins {
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid CORS origin: %q", o)
+		}
+	}
+	switch c.TLSMode {
+	case tlsModeACME:
+		if c.CertsCache == "" {
+			return errors.New("empty certs cache")
+		}
+	case tlsModeFiles:
+		if c.TLSCert == "" || c.TLSKey == "" {
+			return errors.New("cert and key files are required for files TLS mode")
+		}
+	case tlsModeSelfSigned, tlsModeNone:
+	default:
+		return fmt.Errorf("unknown TLS mode: %s", c.TLSMode)
+	}
+	return nil
+}
+
+// fields returns config as log fields with secrets masked.
+func (c config) fields() []zap.Field {
+	return []zap.Field{
+		zap.Strings("domains", c.Domains),
+		zap.String("mail-domain", c.MailDomain),
+		zap.String("smtp-addr", c.SMTPAddr),
+		zap.String("http-addr", c.HTTPAddr),
+		zap.String("storage", redactURL(c.Storage)),
+		zap.String("auth-token", "***"),
+		zap.Duration("email-ttl", c.EmailTTL),
+		zap.Strings("cors-origins", c.CORSOrigins),
+		zap.Int("username-denylist", len(c.UsernameDenylist)),
+		zap.Int("max-message-size", c.MaxMessageSize),
+		zap.Int("max-attachment-size", c.MaxAttachmentSize),
+		zap.Int("mailbox-quota", c.MailboxQuota),
+		zap.Int("max-raw-email-size", c.MaxRawEmailSize),
+		zap.Bool("mail-auth", c.MailAuth),
+		zap.Duration("smtp-ip-interval", c.SMTPIPInterval),
+		zap.Int("smtp-ip-burst", c.SMTPIPBurst),
+		zap.Duration("smtp-sender-interval", c.SMTPSenderInterval),
+		zap.Int("smtp-sender-burst", c.SMTPSenderBurst),
+		zap.Duration("smtp-mailbox-interval", c.SMTPMailboxInterval),
+		zap.Int("smtp-mailbox-burst", c.SMTPMailboxBurst),
+		zap.Strings("trusted-proxies", c.TrustedProxies),
+		zap.Int("account-limit", c.AccountLimit),
+		zap.Duration("account-limit-window", c.AccountLimitWindow),
+		zap.String("account-verification", c.AccountVerification),
+		zap.Int("pow-difficulty", c.PoWDifficulty),
+		zap.String("pow-secret", "***"),
+		zap.String("captcha-verify-url", c.CaptchaVerifyURL),
+		zap.String("captcha-site-key", c.CaptchaSiteKey),
+		zap.String("captcha-secret", "***"),
+		zap.String("tls-mode", c.TLSMode),
+		zap.String("tls-cert", c.TLSCert),
+		zap.String("tls-key", c.TLSKey),
+		zap.String("certs-cache", c.CertsCache),
+	}
+}
+
+// mailAuthResolver returns DNS resolver of sender authentication checks, nil
+// disables them.
+func (c config) mailAuthResolver() mailauth.Resolver {
+	if !c.MailAuth {
+		return nil
+	}
+	return net.DefaultResolver
+}
+
+func (c config) smtpRateLimits() tmpmail.SMTPRateLimits {
+	return tmpmail.SMTPRateLimits{
+		IP:      tmpmail.SMTPRateLimit{Interval: c.SMTPIPInterval, Burst: c.SMTPIPBurst},
+		Sender:  tmpmail.SMTPRateLimit{Interval: c.SMTPSenderInterval, Burst: c.SMTPSenderBurst},
+		Mailbox: tmpmail.SMTPRateLimit{Interval: c.SMTPMailboxInterval, Burst: c.SMTPMailboxBurst},
+	}
+}
+
+const (
+	accountVerificationNone    = "none"
+	accountVerificationPoW     = "pow"
+	accountVerificationCaptcha = "captcha"
+)
+
+// parseCIDRs parses CIDRs and single IPs.
+func parseCIDRs(ss []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range ss {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP: %q", s)
+			}
+			bits := net.IPv6len * 8
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, net.IPv4len*8
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// trustedProxies must be called on validated config.
+func (c config) trustedProxies() []*net.IPNet {
+	nets, _ := parseCIDRs(c.TrustedProxies)
+	return nets
+}
+
+func (c config) accountCreationLimit() tmpmail.AccountCreationLimit {
+	return tmpmail.AccountCreationLimit{Count: c.AccountLimit, Window: c.AccountLimitWindow}
+}
+
+// accountVerifier returns nil if verification is disabled. Proof of work
+// challenges are signed with pow secret, so instances sharing storage and
+// pow secret accept challenges of each other.
+func (c config) accountVerifier(counter tmpmail.Counter) tmpmail.AccountVerifier {
+	switch c.AccountVerification {
+	case accountVerificationPoW:
+		return tmpmail.NewPoWVerifier(counter, []byte(c.PoWSecret), c.PoWDifficulty)
+	case accountVerificationCaptcha:
+		return tmpmail.NewCaptchaVerifier(c.CaptchaVerifyURL, c.CaptchaSiteKey, c.CaptchaSecret, nil)
+	}
+	return nil
+}
+
+// redactURL hides password of URL.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	return u.Redacted()
+}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"syscall"
@@ -13,91 +13,138 @@ import (
 
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
-	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/time/rate"
 
 	"tmpmail"
+	"tmpmail/bolt"
+	"tmpmail/memory"
 	"tmpmail/redis"
 )
 
-const (
-	domain     = "tmp-mail.ru"
-	mailDomain = "smtp.tmp-mail.ru"
-	certsCache = "/var/lib/tmpmail/certs"
-	emailTTL   = 10 * time.Minute
-)
+type storage interface {
+	tmpmail.SMTPServerStorage
+	tmpmail.HTTPServerStorage
+	Close() error
+}
 
-var (
-	smtpAddr, httpAddr string
-	redisAddr          string
-	authToken          string
-)
+// domainMigrator is a storage which may keep accounts without domain.
+type domainMigrator interface {
+	MigrateAccountDomains(domain string) (int, error)
+}
+
+// newStorage creates storage by URL: redis://host:port, memory:// or
+// bolt:///path/to/file.db.
+func newStorage(l *zap.Logger, storageURL string) (storage, error) {
+	u, err := url.Parse(storageURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse storage url: %w", err)
+	}
+	switch u.Scheme {
+	case "redis":
+		return redis.NewStorage(u.Host), nil
+	case "memory":
+		return memory.NewStorage(), nil
+	case "bolt":
+		return bolt.NewStorage(l, u.Path)
+	default:
+		return nil, fmt.Errorf("unknown storage scheme: %s", u.Scheme)
+	}
+}
 
-func server(_ *cobra.Command, _ []string) {
+// rateLimiterFactory returns factory of limiters shared by instances through
+// Redis storage. Other storages belong to a single instance, so nil is
+// returned for them to keep limiters in memory.
+func rateLimiterFactory(s storage) tmpmail.RateLimiterFactory {
+	rs, ok := s.(*redis.Storage)
+	if !ok {
+		return nil
+	}
+	return func(name string, r rate.Limit, b int) tmpmail.RateLimiter {
+		return rs.NewRateLimiter(name, r, b)
+	}
+}
+
+func server(cmd *cobra.Command, _ []string) {
 	logger, err := zap.NewDevelopment()
 	if err != nil {
 		zap.L().Fatal("init logger", zap.Error(err))
 	}
 
-	if len(authToken) < 40 {
-		logger.Error("empty or too simple auth token")
+	cfg, err := loadConfig(cmd.Flags())
+	if err != nil {
+		logger.Error("load config", zap.Error(err))
 		return
 	}
 
+	logger.Info("config", cfg.fields()...)
+
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	rs := redis.NewStorage(redisAddr)
+	rs, err := newStorage(logger, cfg.Storage)
+	if err != nil {
+		logger.Error("init storage", zap.Error(err))
+		return
+	}
 	defer func() {
 		err = rs.Close()
 		if err != nil {
-			logger.Error("redis storage close", zap.Error(err))
+			logger.Error("storage close", zap.Error(err))
 			return
 		}
-		logger.Info("redis storage closed", zap.Error(err))
+		logger.Info("storage closed")
 	}()
 
-	cm := autocert.Manager{
-		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(domain, mailDomain),
-		Cache:      autocert.DirCache(certsCache),
-	}
-
-	cmHTTPSrv := &http.Server{
-		Addr:    "0.0.0.0:80",
-		Handler: cm.HTTPHandler(nil),
+	// Redis accounts of the first version are lists.
+	if rs, ok := rs.(*redis.Storage); ok {
+		n, err := rs.MigrateLegacyAccounts()
+		if err != nil {
+			logger.Error("migrate legacy accounts", zap.Error(err))
+			return
+		}
+		if n > 0 {
+			logger.Info("legacy accounts migrated", zap.Int("accounts", n))
+		}
 	}
-
-	go func() {
-		err := cmHTTPSrv.ListenAndServe()
+	// Accounts of versions before multiple domains have no domain.
+	if rs, ok := rs.(domainMigrator); ok {
+		n, err := rs.MigrateAccountDomains(cfg.Domains[0])
 		if err != nil {
-			if errors.Is(err, http.ErrServerClosed) {
-				return
-			}
-			logger.Error("cert manager http server start", zap.Error(err))
+			logger.Error("migrate account domains", zap.Error(err))
+			return
 		}
-	}()
-
-	defer func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
+		if n > 0 {
+			logger.Info("accounts moved to domain", zap.Int("accounts", n),
+				zap.String("domain", cfg.Domains[0]))
+		}
+	}
 
-		err = cmHTTPSrv.Shutdown(ctx)
+	// Admin API needs auth token or API keys issued by apikey command.
+	if cfg.AuthToken == "" {
+		keys, err := rs.APIKeys()
 		if err != nil {
-			logger.Error("cert manager http server stop", zap.Error(err))
+			logger.Error("list api keys", zap.Error(err))
 			return
 		}
-		logger.Info("cert manager http server shutdown")
-	}()
+		if len(keys) == 0 {
+			logger.Error("auth token or API key is required, issue API key by apikey issue command")
+			return
+		}
+	}
 
-	tlsCfg := cm.TLSConfig()
-	origGetCertificate := tlsCfg.GetCertificate
-	tlsCfg.GetCertificate = func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
-		info.ServerName = mailDomain
-		return origGetCertificate(info)
+	smtpTLSCfg, httpTLSCfg, stopTLS, err := tlsConfigs(logger, cfg)
+	if err != nil {
+		logger.Error("init TLS", zap.Error(err))
+		return
 	}
-	tlsCfg.ServerName = mailDomain
+	defer stopTLS()
 
-	smtpSrv := tmpmail.NewSMTPServer(logger, rs, tlsCfg, smtpAddr, domain, mailDomain)
+	rlf := rateLimiterFactory(rs)
+
+	smtpSrv := tmpmail.NewSMTPServer(logger, rs, smtpTLSCfg, cfg.SMTPAddr,
+		cfg.Domains, cfg.MailDomain, cfg.mailAuthResolver(),
+		cfg.MaxMessageSize, cfg.MaxAttachmentSize, cfg.MailboxQuota, cfg.MaxRawEmailSize,
+		cfg.smtpRateLimits(), rlf)
 
 	go func() {
 		defer cancel()
@@ -122,10 +169,10 @@ func server(_ *cobra.Command, _ []string) {
 		logger.Info("smtp server shutdown")
 	}()
 
-	tlsCfg = cm.TLSConfig()
-	tlsCfg.ServerName = domain
-
-	httpSrv := tmpmail.NewHTTPServer(logger, rs, httpAddr, tlsCfg, authToken, emailTTL)
+	httpSrv := tmpmail.NewHTTPServer(logger, rs, cfg.HTTPAddr, httpTLSCfg, cfg.Domains,
+		cfg.UsernameDenylist, cfg.AuthToken,
+		cfg.EmailTTL, cfg.CORSOrigins, cfg.trustedProxies(), cfg.accountCreationLimit(),
+		cfg.accountVerifier(rs), rlf)
 
 	go func() {
 		defer cancel()
@@ -163,12 +210,9 @@ func main() {
 		Run: server,
 	}
 
-	serverCmd.Flags().StringVar(&smtpAddr, "smtp-addr", "0.0.0.0:25", "")
-	serverCmd.Flags().StringVar(&httpAddr, "http-addr", "0.0.0.0:443", "")
-	serverCmd.Flags().StringVar(&redisAddr, "redis-addr", "127.0.0.1:6379", "")
-	serverCmd.Flags().StringVar(&authToken, "auth-token", "", "")
+	addConfigFlags(serverCmd.Flags())
 
-	rootCmd.AddCommand(serverCmd)
+	rootCmd.AddCommand(serverCmd, apiKeyCommand())
 
 	err := rootCmd.Execute()
 	if err != nil {
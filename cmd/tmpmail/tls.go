@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	tlsModeACME       = "acme"
+	tlsModeFiles      = "files"
+	tlsModeSelfSigned = "self-signed"
+	tlsModeNone       = "none"
+)
+
+// tlsConfigs returns TLS configs of SMTP and HTTP servers for c.TLSMode. Nil
+// configs mean plaintext. Returned stop func must be called on shutdown.
+func tlsConfigs(logger *zap.Logger, c config) (smtpCfg, httpCfg *tls.Config, stop func(), err error) {
+	stop = func() {}
+
+	switch c.TLSMode {
+	case tlsModeACME:
+		smtpCfg, httpCfg, stop = acmeTLSConfigs(logger, c)
+		return smtpCfg, httpCfg, stop, nil
+
+	case tlsModeFiles:
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return nil, nil, stop, fmt.Errorf("load key pair: %w", err)
+		}
+		httpCfg = &tls.Config{Certificates: []tls.Certificate{cert}}
+		return httpCfg.Clone(), httpCfg, stop, nil
+
+	case tlsModeSelfSigned:
+		cert, err := selfSignedCertificate(append([]string{c.MailDomain}, c.Domains...)...)
+		if err != nil {
+			return nil, nil, stop, fmt.Errorf("generate self-signed certificate: %w", err)
+		}
+		logger.Warn("using self-signed certificate")
+		httpCfg = &tls.Config{Certificates: []tls.Certificate{cert}}
+		return httpCfg.Clone(), httpCfg, stop, nil
+
+	case tlsModeNone:
+		logger.Warn("TLS is disabled")
+		return nil, nil, stop, nil
+	}
+
+	return nil, nil, stop, fmt.Errorf("unknown TLS mode: %s", c.TLSMode)
+}
+
+// acmeTLSConfigs returns TLS configs with certificates obtained from Let's
+// Encrypt. It starts HTTP server on :80 for ACME challenges.
+func acmeTLSConfigs(logger *zap.Logger, c config) (smtpCfg, httpCfg *tls.Config, stop func()) {
+	cm := autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(append([]string{c.MailDomain}, c.Domains...)...),
+		Cache:      autocert.DirCache(c.CertsCache),
+	}
+
+	cmHTTPSrv := &http.Server{
+		Addr:    "0.0.0.0:80",
+		Handler: cm.HTTPHandler(nil),
+	}
+
+	go func() {
+		err := cmHTTPSrv.ListenAndServe()
+		if err != nil {
+			if errors.Is(err, http.ErrServerClosed) {
+				return
+			}
+			logger.Error("cert manager http server start", zap.Error(err))
+		}
+	}()
+
+	stop = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		err := cmHTTPSrv.Shutdown(ctx)
+		if err != nil {
+			logger.Error("cert manager http server stop", zap.Error(err))
+			return
+		}
+		logger.Info("cert manager http server shutdown")
+	}
+
+	smtpCfg = cm.TLSConfig()
+	origGetCertificate := smtpCfg.GetCertificate
+	smtpCfg.GetCertificate = func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		info.ServerName = c.MailDomain
+		return origGetCertificate(info)
+	}
+	smtpCfg.ServerName = c.MailDomain
+
+	httpCfg = cm.TLSConfig()
+	httpCfg.ServerName = c.Domains[0]
+
+	return smtpCfg, httpCfg, stop
+}
+
+// selfSignedCertificate generates certificate for hosts valid for a year.
+func selfSignedCertificate(hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		DNSNames:              hosts,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("create certificate: %w", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
@@ -0,0 +1,154 @@
+package email
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+var (
+	// codeKeywordRE matches whole words found by wordRE, since \b knows only
+	// ASCII words. Russian keywords are listed with case endings, so that
+	// e.g. "кодировка" isn't a keyword.
+	codeKeywordRE = regexp.MustCompile(`(?i)^(codes?|otp|pin|passcodes?|passwords?|verification|verify|` +
+		`код(а|у|ом|е|ы|ов)?|пин|парол(ь|я|ю|ем|е|и|ей)|подтвержд\p{L}*|одноразов\p{L}*)$`)
+	wordRE       = regexp.MustCompile(`[\p{L}\p{N}]+`)
+	codeRE       = regexp.MustCompile(`\b(\d{3}[- ]\d{3}|\d{4,8}|[A-Z0-9]{6,8})\b`)
+	digitRE      = regexp.MustCompile(`\d`)
+	linkRE       = regexp.MustCompile(`https?://[^\s<>"'()]+`)
+	actionLinkRE = regexp.MustCompile(`(?i)(confirm|verif|activat|validat|magic|login|log-in|sign-?in|signup|sign-up|reset|token|auth|подтверд|активир|войти|вход)`)
+	skipLinkRE   = regexp.MustCompile(`(?i)(unsubscribe|отпис)`)
+)
+
+// codeKeywordDistance is a max number of characters between keyword like
+// "code" and the code. It is counted in runes, so non-ASCII text like Russian
+// gets the same window.
+const codeKeywordDistance = 100
+
+// ExtractCodes finds likely one-time codes in email subject and bodies. A
+// code is the first short number or uppercase alphanumeric token following a
+// keyword like "code" or "пароль".
+func ExtractCodes(subject, textBody, htmlBody string) []string {
+	texts := []string{subject, textBody}
+	if textBody == "" && htmlBody != "" {
+		texts = append(texts, htmlText(htmlBody))
+	}
+
+	var codes []string
+	seen := map[string]bool{}
+	for _, t := range texts {
+		for _, kw := range wordRE.FindAllStringIndex(t, -1) {
+			if !codeKeywordRE.MatchString(t[kw[0]:kw[1]]) {
+				continue
+			}
+			to := kw[1]
+			for i := 0; i < codeKeywordDistance && to < len(t); i++ {
+				_, size := utf8.DecodeRuneInString(t[to:])
+				to += size
+			}
+			for _, loc := range codeRE.FindAllStringIndex(t[kw[1]:to], -1) {
+				code := t[kw[1]+loc[0] : kw[1]+loc[1]]
+				if !digitRE.MatchString(code) {
+					continue
+				}
+				if !seen[code] {
+					seen[code] = true
+					codes = append(codes, code)
+				}
+				break
+			}
+		}
+	}
+	return codes
+}
+
+// ExtractLinks finds likely action links like email confirmation, magic login
+// or password reset in email bodies. Links are matched by URL or, for HTML,
+// by anchor text.
+func ExtractLinks(textBody, htmlBody string) []string {
+	var links []string
+	seen := map[string]bool{}
+	add := func(link, text string) {
+		if seen[link] || skipLinkRE.MatchString(link) {
+			return
+		}
+		if !actionLinkRE.MatchString(link) && !actionLinkRE.MatchString(text) {
+			return
+		}
+		seen[link] = true
+		links = append(links, link)
+	}
+
+	for _, a := range htmlAnchors(htmlBody) {
+		add(a.href, a.text)
+	}
+	for _, link := range linkRE.FindAllString(textBody, -1) {
+		add(strings.TrimRight(link, ".,;:!?"), "")
+	}
+	return links
+}
+
+type anchor struct {
+	href string
+	text string
+}
+
+// htmlAnchors returns http links of HTML document with their texts.
+func htmlAnchors(s string) []anchor {
+	if s == "" {
+		return nil
+	}
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		return nil
+	}
+	var anchors []anchor
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "a" {
+			for _, attr := range n.Attr {
+				if attr.Key == "href" && linkRE.MatchString(attr.Val) {
+					anchors = append(anchors, anchor{
+						href: attr.Val,
+						text: nodeText(n),
+					})
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return anchors
+}
+
+// htmlText returns visible text of HTML document.
+func htmlText(s string) string {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		return ""
+	}
+	return nodeText(doc)
+}
+
+func nodeText(n *html.Node) string {
+	var b strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			b.WriteString(n.Data)
+			b.WriteByte(' ')
+		case n.Type == html.ElementNode && (n.Data == "script" || n.Data == "style"):
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return b.String()
+}
@@ -0,0 +1,120 @@
+package email
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtractCodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		subject  string
+		textBody string
+		htmlBody string
+		want     []string
+	}{
+		{
+			name:     "device verification",
+			subject:  "[GitHub] Please verify your device",
+			textBody: "Hey alice!\r\n\r\nA sign in attempt requires further verification.\r\n\r\nVerification code: 482913\r\n\r\nIf you did not attempt to sign in, change your password.",
+			want:     []string{"482913"},
+		},
+		{
+			name:     "code in subject",
+			subject:  "Your Slack confirmation code: 719-264",
+			textBody: "Confirm your email address by entering the code above.",
+			want:     []string{"719-264"},
+		},
+		{
+			name:     "russian code",
+			subject:  "Код подтверждения",
+			textBody: "Ваш код подтверждения: 5821. Никому не сообщайте его.",
+			want:     []string{"5821"},
+		},
+		{
+			name:     "russian one-time password",
+			textBody: "Для входа используйте одноразовый пароль\n\n  90 34 17\n\nили пароль 903417",
+			want:     []string{"903417"},
+		},
+		{
+			name:     "russian code far from keyword",
+			textBody: "Ваш код для входа в личный кабинет интернет-магазина указан ниже: 4821",
+			want:     []string{"4821"},
+		},
+		{
+			name:     "pin code",
+			textBody: "ПИН-код для получения посылки 7788, срок хранения 5 дней",
+			want:     []string{"7788"},
+		},
+		{
+			name:     "html only",
+			subject:  "Sign in to Example",
+			htmlBody: `<html><body><p>Your one-time password is</p><p style="font-size:24px"><b>K7Q2MX</b></p></body></html>`,
+			want:     []string{"K7Q2MX"},
+		},
+		{
+			name:     "keywords inside words",
+			subject:  "Your shopping cart is waiting",
+			textBody: "Order 123456 was encoded and shipped. Track it with number 20240915.",
+		},
+		{
+			name:     "russian keyword prefix",
+			textBody: "Кодировка письма изменена, номер заказа 1234567",
+		},
+		{
+			name:     "keyword without code",
+			subject:  "Password changed",
+			textBody: "Your password was changed. If it wasn't you, reset your password right away.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ExtractCodes(tt.subject, tt.textBody, tt.htmlBody)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ExtractCodes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	tests := []struct {
+		name     string
+		textBody string
+		htmlBody string
+		want     []string
+	}{
+		{
+			name: "confirmation link in text",
+			textBody: "Thanks for signing up!\n\nConfirm your email: https://example.com/confirm?token=3f9a1c.\n\n" +
+				"Blog: https://example.com/blog\nUnsubscribe: https://example.com/unsubscribe?token=3f9a1c",
+			want: []string{"https://example.com/confirm?token=3f9a1c"},
+		},
+		{
+			name: "anchor text",
+			htmlBody: `<p>Нажмите кнопку, чтобы <a href="https://example.com/l/Xk29">войти в аккаунт</a>.</p>` +
+				`<p><a href="https://example.com/news">Новости</a> · <a href="https://example.com/auth/unsubscribe">Отписаться</a></p>`,
+			want: []string{"https://example.com/l/Xk29"},
+		},
+		{
+			name:     "html and text alternatives",
+			textBody: "Reset your password: https://example.com/reset/7d1e",
+			htmlBody: `<a href="https://example.com/reset/7d1e">Reset password</a>`,
+			want:     []string{"https://example.com/reset/7d1e"},
+		},
+		{
+			name:     "newsletter",
+			textBody: "Read more at https://example.com/posts/42 or visit http://example.org.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ExtractLinks(tt.textBody, tt.htmlBody)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ExtractLinks() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,16 +1,18 @@
 package email
 
 import (
-	"bytes"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime"
 	"mime/multipart"
+	"mime/quotedprintable"
 	"net/mail"
 	"strings"
 	"time"
+
+	"golang.org/x/net/html/charset"
 )
 
 const contentTypeMultipartMixed = "multipart/mixed"
@@ -45,11 +47,9 @@ func Parse(r io.Reader) (email Email, err error) {
 	case contentTypeMultipartRelated:
 		email.TextBody, email.HTMLBody, email.EmbeddedFiles, err = parseMultipartRelated(msg.Body, params["boundary"])
 	case contentTypeTextPlain:
-		message, _ := ioutil.ReadAll(msg.Body)
-		email.TextBody = strings.TrimSuffix(string(message[:]), "\n")
+		email.TextBody, err = decodeText(msg.Body, msg.Header.Get("Content-Transfer-Encoding"), params["charset"])
 	case contentTypeTextHtml:
-		message, _ := ioutil.ReadAll(msg.Body)
-		email.HTMLBody = strings.TrimSuffix(string(message[:]), "\n")
+		email.HTMLBody, err = decodeText(msg.Body, msg.Header.Get("Content-Transfer-Encoding"), params["charset"])
 	default:
 		email.Content, err = decodeContent(msg.Body, msg.Header.Get("Content-Transfer-Encoding"))
 	}
@@ -121,19 +121,19 @@ func parseMultipartRelated(msg io.Reader, boundary string) (textBody, htmlBody s
 
 		switch contentType {
 		case contentTypeTextPlain:
-			ppContent, err := ioutil.ReadAll(part)
+			text, err := decodePartText(part, params)
 			if err != nil {
 				return textBody, htmlBody, embeddedFiles, err
 			}
 
-			textBody += strings.TrimSuffix(string(ppContent[:]), "\n")
+			textBody += text
 		case contentTypeTextHtml:
-			ppContent, err := ioutil.ReadAll(part)
+			html, err := decodePartText(part, params)
 			if err != nil {
 				return textBody, htmlBody, embeddedFiles, err
 			}
 
-			htmlBody += strings.TrimSuffix(string(ppContent[:]), "\n")
+			htmlBody += html
 		case contentTypeMultipartAlternative:
 			tb, hb, ef, err := parseMultipartAlternative(part, params["boundary"])
 			if err != nil {
@@ -178,19 +178,19 @@ func parseMultipartAlternative(msg io.Reader, boundary string) (textBody, htmlBo
 
 		switch contentType {
 		case contentTypeTextPlain:
-			ppContent, err := ioutil.ReadAll(part)
+			text, err := decodePartText(part, params)
 			if err != nil {
 				return textBody, htmlBody, embeddedFiles, err
 			}
 
-			textBody += strings.TrimSuffix(string(ppContent[:]), "\n")
+			textBody += text
 		case contentTypeTextHtml:
-			ppContent, err := ioutil.ReadAll(part)
+			html, err := decodePartText(part, params)
 			if err != nil {
 				return textBody, htmlBody, embeddedFiles, err
 			}
 
-			htmlBody += strings.TrimSuffix(string(ppContent[:]), "\n")
+			htmlBody += html
 		case contentTypeMultipartRelated:
 			tb, hb, ef, err := parseMultipartRelated(part, params["boundary"])
 			if err != nil {
@@ -243,19 +243,19 @@ func parseMultipartMixed(msg io.Reader, boundary string) (textBody, htmlBody str
 				return textBody, htmlBody, attachments, embeddedFiles, err
 			}
 		} else if contentType == contentTypeTextPlain {
-			ppContent, err := ioutil.ReadAll(part)
+			text, err := decodePartText(part, params)
 			if err != nil {
 				return textBody, htmlBody, attachments, embeddedFiles, err
 			}
 
-			textBody += strings.TrimSuffix(string(ppContent[:]), "\n")
+			textBody += text
 		} else if contentType == contentTypeTextHtml {
-			ppContent, err := ioutil.ReadAll(part)
+			html, err := decodePartText(part, params)
 			if err != nil {
 				return textBody, htmlBody, attachments, embeddedFiles, err
 			}
 
-			htmlBody += strings.TrimSuffix(string(ppContent[:]), "\n")
+			htmlBody += html
 		} else if isAttachment(part) {
 			at, err := decodeAttachment(part)
 			if err != nil {
@@ -271,25 +271,15 @@ func parseMultipartMixed(msg io.Reader, boundary string) (textBody, htmlBody str
 	return textBody, htmlBody, attachments, embeddedFiles, err
 }
 
-func decodeMimeSentence(s string) string {
-	result := []string{}
-	ss := strings.Split(s, " ")
-
-	for _, word := range ss {
-		dec := new(mime.WordDecoder)
-		w, err := dec.Decode(word)
-		if err != nil {
-			if len(result) == 0 {
-				w = word
-			} else {
-				w = " " + word
-			}
-		}
+var wordDecoder = &mime.WordDecoder{CharsetReader: charset.NewReaderLabel}
 
-		result = append(result, w)
+func decodeMimeSentence(s string) string {
+	decoded, err := wordDecoder.DecodeHeader(s)
+	if err != nil {
+		return s
 	}
 
-	return strings.Join(result, "")
+	return decoded
 }
 
 func decodeHeaderMime(header mail.Header) (mail.Header, error) {
@@ -319,67 +309,113 @@ func decodeEmbeddedFile(part *multipart.Part) (ef EmbeddedFile, err error) {
 		return
 	}
 
+	data, err := ioutil.ReadAll(decoded)
+	if err != nil {
+		return
+	}
+
 	ef.CID = strings.Trim(cid, "<>")
-	ef.Data = decoded
+	ef.Data = data
 	ef.ContentType = part.Header.Get("Content-Type")
 
 	return
 }
 
 func isAttachment(part *multipart.Part) bool {
-	return part.FileName() != ""
+	if part.FileName() != "" {
+		return true
+	}
+
+	// Some clients only name the file in the Content-Type header.
+	_, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	return params["name"] != ""
 }
 
 func decodeAttachment(part *multipart.Part) (at Attachment, err error) {
-	filename := decodeMimeSentence(part.FileName())
+	filename := part.FileName()
+	if filename == "" {
+		_, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		filename = params["name"]
+	}
+	filename = decodeMimeSentence(filename)
 	decoded, err := decodeContent(part, part.Header.Get("Content-Transfer-Encoding"))
 	if err != nil {
 		return
 	}
 
+	data, err := ioutil.ReadAll(decoded)
+	if err != nil {
+		return
+	}
+
 	at.Filename = filename
-	at.Data = decoded
+	at.Data = data
 	at.ContentType = strings.Split(part.Header.Get("Content-Type"), ";")[0]
 
 	return
 }
 
+// decodeContent returns reader decoding content by its transfer encoding.
+// Content is decoded while being read, so it isn't copied in memory.
 func decodeContent(content io.Reader, encoding string) (io.Reader, error) {
-	switch encoding {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
 	case "base64":
-		decoded := base64.NewDecoder(base64.StdEncoding, content)
-		b, err := ioutil.ReadAll(decoded)
-		if err != nil {
-			return nil, err
-		}
-
-		return bytes.NewReader(b), nil
-	case "7bit", "8bit":
-		dd, err := ioutil.ReadAll(content)
-		if err != nil {
-			return nil, err
-		}
-
-		return bytes.NewReader(dd), nil
-	case "":
+		return base64.NewDecoder(base64.StdEncoding, content), nil
+	case "quoted-printable":
+		return quotedprintable.NewReader(content), nil
+	case "7bit", "8bit", "binary", "":
 		return content, nil
 	default:
 		return nil, fmt.Errorf("unknown encoding: %s", encoding)
 	}
 }
 
+// decodeText decodes content by its transfer encoding and converts it from
+// the declared charset to UTF-8.
+func decodeText(content io.Reader, encoding, cs string) (string, error) {
+	decoded, err := decodeContent(content, encoding)
+	if err != nil {
+		return "", err
+	}
+
+	if cs != "" {
+		// Unknown charsets are left as is rather than failing the whole message.
+		if r, err := charset.NewReaderLabel(cs, decoded); err == nil {
+			decoded = r
+		}
+	}
+
+	b, err := ioutil.ReadAll(decoded)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// decodePartText decodes text part of multipart message. Quoted-printable
+// parts are already decoded by multipart.Reader which also drops their
+// Content-Transfer-Encoding header.
+func decodePartText(part *multipart.Part, params map[string]string) (string, error) {
+	return decodeText(part, part.Header.Get("Content-Transfer-Encoding"), params["charset"])
+}
+
 type headerParser struct {
 	header *mail.Header
 	err    error
 }
 
+// addressParser decodes display names in any charset, not only UTF-8 and
+// ISO-8859-1 which mail.ParseAddress supports.
+var addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
+
 func (hp headerParser) parseAddress(s string) (ma *mail.Address) {
 	if hp.err != nil {
 		return nil
 	}
 
 	if strings.Trim(s, " \n") != "" {
-		ma, hp.err = mail.ParseAddress(s)
+		ma, hp.err = addressParser.Parse(s)
 
 		return ma
 	}
@@ -393,7 +429,7 @@ func (hp headerParser) parseAddressList(s string) (ma []*mail.Address) {
 	}
 
 	if strings.Trim(s, " \n") != "" {
-		ma, hp.err = mail.ParseAddressList(s)
+		ma, hp.err = addressParser.ParseList(s)
 		return
 	}
 
@@ -444,18 +480,18 @@ func (hp headerParser) parseMessageIdList(s string) (result []string) {
 	return
 }
 
-// Attachment with filename, content type and data (as a io.Reader)
+// Attachment with filename, content type and decoded data
 type Attachment struct {
 	Filename    string
 	ContentType string
-	Data        io.Reader
+	Data        []byte
 }
 
-// EmbeddedFile with content id, content type and data (as a io.Reader)
+// EmbeddedFile with content id, content type and decoded data
 type EmbeddedFile struct {
 	CID         string
 	ContentType string
-	Data        io.Reader
+	Data        []byte
 }
 
 // Email with fields for all the headers defined in RFC5322 with it's attachments and
@@ -0,0 +1,233 @@
+package email
+
+import (
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testFile struct {
+	name        string
+	contentType string
+	data        string
+}
+
+// formatAddress formats a without quoting and encoding of its name.
+func formatAddress(a *mail.Address) string {
+	if a.Name == "" {
+		return a.Address
+	}
+	return a.Name + " <" + a.Address + ">"
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		file        string
+		subject     string
+		from        []string
+		to          []string
+		date        time.Time
+		messageID   string
+		text        string
+		html        string
+		attachments []testFile
+		embedded    []testFile
+	}{
+		{
+			file:      "plain_koi8r_qp.eml",
+			subject:   "Код подтверждения",
+			from:      []string{"Госуслуги <noreply@gosuslugi.example>"},
+			to:        []string{"user@tmp-mail.ru"},
+			date:      time.Date(2022, 10, 3, 9, 4, 5, 0, time.UTC),
+			messageID: "20221003090405.1234@gosuslugi.example",
+			text:      "Ваш код подтверждения: 482913\r\nНикому его не сообщайте.",
+		},
+		{
+			file:      "alternative_utf8.eml",
+			subject:   "Подтвердите email",
+			from:      []string{"Shop <hello@shop.example>"},
+			to:        []string{"User <user@tmp-mail.ru>"},
+			date:      time.Date(2022, 10, 4, 8, 0, 0, 0, time.UTC),
+			messageID: "alt-1@shop.example",
+			text:      "Привет! Подтвердите адрес: https://shop.example/confirm?token=abc123&u=42",
+			html: `<html><body><p>Привет! Подтвердите адрес: ` +
+				`<a href="https://shop.example/confirm?token=abc123&amp;u=42">подтвердить</a></p></body></html>`,
+		},
+		{
+			file:    "mixed_attachments.eml",
+			subject: "Invoice",
+			from:    []string{"billing@bank.example"},
+			to:      []string{"user@tmp-mail.ru"},
+			date:    time.Date(2022, 10, 5, 7, 30, 0, 0, time.UTC),
+			text:    "Счёт во вложении.",
+			attachments: []testFile{
+				{
+					name:        "invoice.pdf",
+					contentType: "application/pdf",
+					data:        "%PDF-1.4\n%\xe2\xe3\xcf\xd3\n1 0 obj\n<<>>\nendobj\n",
+				},
+				{
+					// Named only in Content-Type, the name is RFC 2047 encoded.
+					name:        "выписка.csv",
+					contentType: "text/csv",
+					data:        "дата;сумма\n2022-10-01;100\n",
+				},
+			},
+		},
+		{
+			file:    "related_inline_image.eml",
+			subject: "Newsletter",
+			from:    []string{"news@brand.example"},
+			to:      []string{"user@tmp-mail.ru"},
+			date:    time.Date(2022, 10, 6, 18, 0, 0, 0, time.UTC),
+			html:    `<p>Hello <img src="cid:logo@brand"></p>`,
+			embedded: []testFile{
+				{
+					name:        "logo@brand",
+					contentType: "image/png",
+					data:        "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR",
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			e, err := Parse(f)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			if e.Subject != tt.subject {
+				t.Errorf("Subject = %q, want %q", e.Subject, tt.subject)
+			}
+			var from, to []string
+			for _, a := range e.From {
+				from = append(from, formatAddress(a))
+			}
+			for _, a := range e.To {
+				to = append(to, formatAddress(a))
+			}
+			if !reflect.DeepEqual(from, tt.from) {
+				t.Errorf("From = %q, want %q", from, tt.from)
+			}
+			if !reflect.DeepEqual(to, tt.to) {
+				t.Errorf("To = %q, want %q", to, tt.to)
+			}
+			if !e.Date.Equal(tt.date) {
+				t.Errorf("Date = %s, want %s", e.Date, tt.date)
+			}
+			if e.MessageID != tt.messageID {
+				t.Errorf("MessageID = %q, want %q", e.MessageID, tt.messageID)
+			}
+			if e.TextBody != tt.text {
+				t.Errorf("TextBody = %q, want %q", e.TextBody, tt.text)
+			}
+			if e.HTMLBody != tt.html {
+				t.Errorf("HTMLBody = %q, want %q", e.HTMLBody, tt.html)
+			}
+
+			var attachments, embedded []testFile
+			for _, a := range e.Attachments {
+				attachments = append(attachments, testFile{a.Filename, a.ContentType, string(a.Data)})
+			}
+			for _, ef := range e.EmbeddedFiles {
+				embedded = append(embedded, testFile{ef.CID, ef.ContentType, string(ef.Data)})
+			}
+			if !reflect.DeepEqual(attachments, tt.attachments) {
+				t.Errorf("Attachments = %q, want %q", attachments, tt.attachments)
+			}
+			if !reflect.DeepEqual(embedded, tt.embedded) {
+				t.Errorf("EmbeddedFiles = %q, want %q", embedded, tt.embedded)
+			}
+		})
+	}
+}
+
+func TestDecodeContent(t *testing.T) {
+	tests := []struct {
+		encoding string
+		content  string
+		want     string
+		wantErr  bool
+	}{
+		{encoding: "base64", content: "0J/RgNC40LLQtdGC", want: "Привет"},
+		{encoding: " Quoted-Printable ", content: "caf=C3=A9 =\r\nau lait", want: "café au lait"},
+		{encoding: "8bit", content: "как есть", want: "как есть"},
+		{encoding: "", content: "plain", want: "plain"},
+		{encoding: "x-uuencode", content: "begin 644", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			r, err := decodeContent(strings.NewReader(tt.content), tt.encoding)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeContent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, err := decodeText(r, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("decoded = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		charset string
+		want    string
+	}{
+		{name: "koi8-r", content: "\xf0\xd2\xc9\xd7\xc5\xd4", charset: "koi8-r", want: "Привет"},
+		{name: "windows-1251", content: "\xcf\xf0\xe8\xe2\xe5\xf2", charset: "windows-1251", want: "Привет"},
+		{name: "label case", content: "\xcf\xf0\xe8\xe2\xe5\xf2", charset: "CP1251", want: "Привет"},
+		{name: "unknown charset", content: "abc", charset: "x-unknown", want: "abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeText(strings.NewReader(tt.content), "", tt.charset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("decodeText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeMimeSentence(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "=?UTF-8?B?0J/RgNC40LLQtdGC?=", want: "Привет"},
+		{in: "=?koi8-r?Q?=F0=D2=C9=D7=C5=D4?= world", want: "Привет world"},
+		{in: "=?windows-1251?B?z/Do4uXy?=", want: "Привет"},
+		{in: "plain subject", want: "plain subject"},
+	}
+
+	for _, tt := range tests {
+		if got := decodeMimeSentence(tt.in); got != tt.want {
+			t.Errorf("decodeMimeSentence(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package tmpmail
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"tmpmail/entity"
+)
+
+// textMatcher matches text by case-insensitive substring or by regular
+// expression if pattern is enclosed in slashes like /code: \d+/.
+type textMatcher struct {
+	substr string
+	re     *regexp.Regexp
+}
+
+func newTextMatcher(pattern string) (*textMatcher, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, err
+		}
+		return &textMatcher{re: re}, nil
+	}
+	return &textMatcher{substr: strings.ToLower(pattern)}, nil
+}
+
+func (m *textMatcher) match(texts ...string) bool {
+	if m == nil {
+		return true
+	}
+	for _, t := range texts {
+		if m.re != nil {
+			if m.re.MatchString(t) {
+				return true
+			}
+			continue
+		}
+		if strings.Contains(strings.ToLower(t), m.substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTag reports whether email tag matches tag. Tags are case-insensitive.
+func matchTag(tag, emailTag string) bool {
+	return tag == "" || strings.EqualFold(tag, emailTag)
+}
+
+// emailFilter selects emails arrived after since email ID with matching
+// tag, subject, sender and body. Empty fields match any email.
+type emailFilter struct {
+	since   string
+	tag     string
+	subject *textMatcher
+	from    *textMatcher
+	body    *textMatcher
+}
+
+func newEmailFilter(since, tag, subject, from, body string) (emailFilter, error) {
+	f := emailFilter{since: since, tag: tag}
+	var err error
+	if f.subject, err = newTextMatcher(subject); err != nil {
+		return emailFilter{}, fmt.Errorf("subject: %w", err)
+	}
+	if f.from, err = newTextMatcher(from); err != nil {
+		return emailFilter{}, fmt.Errorf("from: %w", err)
+	}
+	if f.body, err = newTextMatcher(body); err != nil {
+		return emailFilter{}, fmt.Errorf("body: %w", err)
+	}
+	return f, nil
+}
+
+// after reports whether email with id arrived after since email. Email IDs
+// are time ordered.
+func (f emailFilter) after(id string) bool {
+	return id > f.since
+}
+
+// matchSummary reports whether email summary matches all but body, so only
+// candidate emails are loaded in full.
+func (f emailFilter) matchSummary(e entity.EmailSummary) bool {
+	return f.after(e.ID) &&
+		matchTag(f.tag, e.Tag) &&
+		f.subject.match(e.Subject) &&
+		f.from.match(append([]string{e.Sender}, e.From...)...)
+}
+
+func (f emailFilter) match(e entity.Email) bool {
+	return f.matchSummary(e.Summary()) && f.body.match(e.TextBody, e.HTMLBody)
+}
@@ -1,20 +1,34 @@
 package entity
 
-import "time"
+import (
+	"net/mail"
+	"strings"
+	"time"
+)
 
+// Attachment data is stored separately from email and isn't serialized with
+// it.
 type Attachment struct {
 	Filename    string `json:"filename,omitempty"`
 	ContentType string `json:"contentType,omitempty"`
-	Data        []byte `json:"data,omitempty"`
+	Size        int    `json:"size"`
+	SHA256      string `json:"sha256,omitempty"`
+	Data        []byte `json:"-"`
 }
 
+// EmbeddedFile data is stored separately from email and isn't serialized
+// with it.
 type EmbeddedFile struct {
 	CID         string `json:"cid,omitempty"`
 	ContentType string `json:"contentType,omitempty"`
-	Data        []byte `json:"data,omitempty"`
+	Size        int    `json:"size"`
+	SHA256      string `json:"sha256,omitempty"`
+	Data        []byte `json:"-"`
 }
 
 type Email struct {
+	ID         string    `json:"id"`
+	Tag        string    `json:"tag,omitempty"`
 	Subject    string    `json:"subject,omitempty"`
 	Sender     string    `json:"sender,omitempty"`
 	From       []string  `json:"from,omitempty"`
@@ -40,12 +54,214 @@ type Email struct {
 	HTMLBody string `json:"htmlBody,omitempty"`
 	TextBody string `json:"textBody,omitempty"`
 
+	// Codes and Links are likely one-time codes and action links like email
+	// confirmation found in email.
+	Codes []string `json:"codes,omitempty"`
+	Links []string `json:"links,omitempty"`
+
 	Attachments   []Attachment   `json:"attachments,omitempty"`
 	EmbeddedFiles []EmbeddedFile `json:"embeddedFiles,omitempty"`
+
+	// Authentication is empty if sender authentication wasn't checked.
+	Authentication *Authentication `json:"authentication,omitempty"`
+
+	// RawSize is a size of original message. Raw is gzip compressed original
+	// message, it is stored separately from email and is empty if message
+	// was too big to keep.
+	RawSize int    `json:"rawSize,omitempty"`
+	Raw     []byte `json:"-"`
+}
+
+// Summary returns email fields shown in mailbox list.
+func (e Email) Summary() EmailSummary {
+	return EmailSummary{
+		ID:          e.ID,
+		Tag:         e.Tag,
+		Subject:     e.Subject,
+		Sender:      e.Sender,
+		From:        e.From,
+		To:          e.To,
+		Date:        e.Date,
+		Attachments: len(e.Attachments),
+		Codes:       e.Codes,
+		Links:       e.Links,
+	}
+}
+
+// SentBy reports whether From or Sender header address of email is sender.
+// Sender without "@" matches all addresses of the domain. Comparison is case
+// insensitive.
+func (e Email) SentBy(sender string) bool {
+	addresses := append([]string{e.Sender}, e.From...)
+	for _, a := range addresses {
+		if a == "" {
+			continue
+		}
+		if parsed, err := mail.ParseAddress(a); err == nil {
+			a = parsed.Address
+		}
+		if !strings.Contains(sender, "@") {
+			_, a = SplitAddress(a)
+		}
+		if strings.EqualFold(a, sender) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authentication is a result of email sender authentication. Results are
+// "pass", "fail", "softfail", "neutral", "none", "temperror" or "permerror" as
+// in Authentication-Results header of RFC 8601.
+type Authentication struct {
+	SPF   SPFResult    `json:"spf"`
+	DKIM  []DKIMResult `json:"dkim"`
+	DMARC DMARCResult  `json:"dmarc"`
+}
+
+// SPFResult is a result of SPF check of MAIL FROM domain or HELO domain if
+// MAIL FROM is empty.
+type SPFResult struct {
+	Result   string `json:"result"`
+	MailFrom string `json:"mailFrom,omitempty"`
+	HELO     string `json:"helo,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// DKIMResult is a result of a DKIM signature check.
+type DKIMResult struct {
+	Result     string `json:"result"`
+	Domain     string `json:"domain,omitempty"`
+	Identifier string `json:"identifier,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// DMARCResult is a result of DMARC alignment check of From header domain.
+type DMARCResult struct {
+	Result string `json:"result"`
+	From   string `json:"from,omitempty"`
+	Policy string `json:"policy,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type EmailSummary struct {
+	ID          string    `json:"id"`
+	Tag         string    `json:"tag,omitempty"`
+	Subject     string    `json:"subject,omitempty"`
+	Sender      string    `json:"sender,omitempty"`
+	From        []string  `json:"from,omitempty"`
+	To          []string  `json:"to,omitempty"`
+	Date        time.Time `json:"date,omitempty"`
+	Attachments int       `json:"attachments,omitempty"`
+	Codes       []string  `json:"codes,omitempty"`
+	Links       []string  `json:"links,omitempty"`
+}
+
+// Verification is the latest one-time code and action link found in account
+// emails.
+type Verification struct {
+	EmailID string `json:"emailID"`
+	Code    string `json:"code,omitempty"`
+	Link    string `json:"link,omitempty"`
 }
 
+const (
+	AccountChallengePoW     = "pow"
+	AccountChallengeCaptcha = "captcha"
+)
+
+// AccountChallenge must be passed to create account anonymously if server
+// requires verification. Proof of work response is "challenge:nonce" where
+// nonce is found by pow.Solve with Difficulty. Captcha response is a token of
+// Provider widget with SiteKey, provider is hcaptcha, recaptcha or turnstile.
+type AccountChallenge struct {
+	Type       string `json:"type"`
+	Challenge  string `json:"challenge,omitempty"`
+	Difficulty int    `json:"difficulty,omitempty"`
+	Provider   string `json:"provider,omitempty"`
+	SiteKey    string `json:"siteKey,omitempty"`
+}
+
+// Account is a mailbox. Accounts are identified by full address, so
+// alice@a and alice@b are different accounts.
 type Account struct {
+	Address  string  `json:"address"`
 	Username string  `json:"username"`
+	Domain   string  `json:"domain"`
 	TTL      int64   `json:"ttl"`
 	Emails   []Email `json:"emails"`
 }
+
+// AccountInfo is an account summary shown to admin. TTL is in milliseconds,
+// -1 means account doesn't expire. Size is a total RawSize of Emails.
+type AccountInfo struct {
+	Address string `json:"address"`
+	TTL     int64  `json:"ttl"`
+	Emails  int    `json:"emails"`
+	Size    int    `json:"size"`
+}
+
+// Stats of all active accounts.
+type Stats struct {
+	Accounts int            `json:"accounts"`
+	Emails   int            `json:"emails"`
+	Size     int            `json:"size"`
+	Domains  map[string]int `json:"domains"`
+}
+
+// API key scopes.
+const (
+	ScopeBulkCreate = "bulk-create"
+	ScopeAdminRead  = "admin-read"
+	ScopeAdminWrite = "admin-write"
+)
+
+// Scopes are all API key scopes.
+var Scopes = []string{ScopeBulkCreate, ScopeAdminRead, ScopeAdminWrite}
+
+// APIKey is a named credential of admin API. Only SHA-256 Hash of the key is
+// stored. Zero ExpiresAt means key doesn't expire, zero LastUsedAt means key
+// wasn't used.
+type APIKey struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Hash       string    `json:"hash"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// HasScope reports whether key has scope.
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitAddress splits email address to username and domain.
+func SplitAddress(address string) (username, domain string) {
+	i := strings.LastIndexByte(address, '@')
+	if i < 0 {
+		return address, ""
+	}
+	return address[:i], address[i+1:]
+}
+
+const (
+	EventEmailAdded     = "email.added"
+	EventEmailRemoved   = "email.removed"
+	EventAccountRemoved = "account.removed"
+	EventAccountExpired = "account.expired"
+)
+
+// Event notifies account subscribers about mailbox changes. Email is set for
+// EventEmailAdded, EmailID for EventEmailRemoved.
+type Event struct {
+	Type    string        `json:"type"`
+	Email   *EmailSummary `json:"email,omitempty"`
+	EmailID string        `json:"emailID,omitempty"`
+}
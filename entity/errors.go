@@ -3,5 +3,12 @@ package entity
 import "fmt"
 
 var (
-	ErrAccountDoesntExists = fmt.Errorf("account doesn't exists")
+	ErrAccountDoesntExists  = fmt.Errorf("account doesn't exists")
+	ErrAccountAlreadyExists = fmt.Errorf("account already exists")
+	ErrTokenAlreadyExists   = fmt.Errorf("token already exists")
+	ErrEmailDoesntExists    = fmt.Errorf("email doesn't exists")
+	ErrFileDoesntExists     = fmt.Errorf("file doesn't exists")
+	ErrMailboxFull          = fmt.Errorf("mailbox is full")
+	ErrAPIKeyDoesntExists   = fmt.Errorf("api key doesn't exists")
+	ErrAPIKeyAlreadyExists  = fmt.Errorf("api key already exists")
 )
@@ -0,0 +1,77 @@
+package events
+
+import (
+	"context"
+	"sync"
+
+	"tmpmail/entity"
+)
+
+// subscriberBuffer is a number of events kept for slow subscriber. When
+// buffer is full, subscriber is closed instead of silently missing events, so
+// it subscribes again and rereads account.
+const subscriberBuffer = 16
+
+// Hub delivers account events to subscribers within a single process. It is
+// used by storages which can't share events between instances.
+type Hub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan entity.Event]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subs: map[string]map[chan entity.Event]struct{}{},
+	}
+}
+
+// Subscribe returns channel of username account events. Channel is closed
+// when ctx is done or subscriber falls behind by subscriberBuffer events.
+func (h *Hub) Subscribe(ctx context.Context, username string) <-chan entity.Event {
+	ch := make(chan entity.Event, subscriberBuffer)
+
+	h.mu.Lock()
+	subs, exists := h.subs[username]
+	if !exists {
+		subs = map[chan entity.Event]struct{}{}
+		h.subs[username] = subs
+	}
+	subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.unsubscribe(username, ch)
+	}()
+
+	return ch
+}
+
+// unsubscribe closes ch unless it is closed already.
+func (h *Hub) unsubscribe(username string, ch chan entity.Event) {
+	subs := h.subs[username]
+	if _, exists := subs[ch]; !exists {
+		return
+	}
+	delete(subs, ch)
+	if len(subs) == 0 {
+		delete(h.subs, username)
+	}
+	close(ch)
+}
+
+func (h *Hub) Publish(username string, e entity.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs[username] {
+		select {
+		case ch <- e:
+		default:
+			h.unsubscribe(username, ch)
+		}
+	}
+}
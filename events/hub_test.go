@@ -0,0 +1,41 @@
+package events
+
+import (
+	"context"
+	"testing"
+
+	"tmpmail/entity"
+)
+
+func TestHubClosesSlowSubscriber(t *testing.T) {
+	h := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	slow := h.Subscribe(ctx, "alice@tmp-mail.ru")
+	other := h.Subscribe(ctx, "bob@tmp-mail.ru")
+
+	for i := 0; i <= subscriberBuffer; i++ {
+		h.Publish("alice@tmp-mail.ru", entity.Event{Type: entity.EventEmailAdded})
+	}
+
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Errorf("slow subscriber got %d events before close, want %d", n, subscriberBuffer)
+	}
+
+	// Other accounts are unaffected.
+	h.Publish("bob@tmp-mail.ru", entity.Event{Type: entity.EventAccountRemoved})
+	if e := <-other; e.Type != entity.EventAccountRemoved {
+		t.Errorf("other subscriber got %q, want %q", e.Type, entity.EventAccountRemoved)
+	}
+
+	// Closed subscriber isn't closed again when ctx is done.
+	cancel()
+	if _, ok := <-other; ok {
+		t.Error("subscriber isn't closed when ctx is done")
+	}
+}
@@ -0,0 +1,292 @@
+package tmpmail
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+
+	"tmpmail/entity"
+)
+
+// AdminStorage is used by admin API. Accounts are identified by full address
+// like alice@tmp-mail.ru.
+type AdminStorage interface {
+	Accounts() ([]entity.AccountInfo, error)
+	AccountInfo(address string) (entity.AccountInfo, error)
+	SetAccountTTL(address string, ttl time.Duration) error
+	ExpireAccount(address string) error
+	RemoveEmailsBySender(sender string) (int, error)
+}
+
+const (
+	offsetParam = "offset"
+	limitParam  = "limit"
+	ttlParam    = "ttl"
+	senderParam = "sender"
+	addressPath = "address"
+)
+
+// authorize checks that request has admin token or API key with scope and
+// replies with error otherwise. Failed attempts are rate limited by client IP.
+func (s *HTTPServer) authorize(w http.ResponseWriter, r *http.Request, scope string) bool {
+	// Every attempt takes a token, so concurrent guesses can't overrun the
+	// limit, authenticated ones give it back.
+	key := ipKey(clientIP(r, s.trustedProxies))
+	if ok, err := s.authRateLimiter.AllowN(key, 1); err != nil {
+		s.logger.Error("take auth rate limit", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	} else if !ok {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return false
+	}
+
+	k, ok, err := s.authenticate(r.Header.Get(authHeader))
+	if err != nil {
+		s.logger.Error("check api key", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	if err = s.authRateLimiter.ReturnN(key, 1); err != nil {
+		s.logger.Warn("return auth rate limit", zap.Error(err))
+	}
+	if k == nil {
+		return true
+	}
+
+	if !k.HasScope(scope) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "api key has no %s scope\n", scope)
+		return false
+	}
+	now := time.Now()
+	if now.Sub(k.LastUsedAt) >= apiKeyTouchInterval {
+		if err = s.storage.TouchAPIKey(k.ID, now.UTC()); err != nil {
+			s.logger.Warn("touch api key", zap.String("id", k.ID), zap.Error(err))
+		}
+	}
+	return true
+}
+
+// authenticate checks auth header value. Admin token is authenticated with
+// nil key.
+func (s *HTTPServer) authenticate(auth string) (*entity.APIKey, bool, error) {
+	// Empty admin token disables it.
+	if s.authToken != "" && subtle.ConstantTimeCompare([]byte(auth), []byte(s.authToken)) == 1 {
+		return nil, true, nil
+	}
+	k, ok, err := checkAPIKey(s.storage, auth, time.Now())
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return &k, true, nil
+}
+
+// adminAddress returns account address from request path with lower case
+// username and configured domain spelling.
+func (s *HTTPServer) adminAddress(w http.ResponseWriter, p httprouter.Params) (string, bool) {
+	addr := p.ByName(addressPath)
+	username, domain := entity.SplitAddress(strings.ToLower(addr))
+	if username == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s: invalid address\n", addr)
+		return "", false
+	}
+	for _, d := range s.domains {
+		if strings.EqualFold(domain, d) {
+			return username + "@" + d, true
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, "%s: unknown domain\n", addr)
+	return "", false
+}
+
+func intParam(r *http.Request, name string, def int) (int, bool) {
+	v := r.FormValue(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// getAPIAdminAccounts lists accounts ordered by address. Parameter domain
+// filters accounts by domain, offset and limit select a page.
+func (s *HTTPServer) getAPIAdminAccounts(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !s.authorize(w, r, entity.ScopeAdminRead) {
+		return
+	}
+	offset, ok := intParam(r, offsetParam, 0)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	limit, ok := intParam(r, limitParam, 0)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	domain := r.FormValue(domainParam)
+
+	accounts, err := s.storage.Accounts()
+	if err != nil {
+		s.logger.Error("list accounts in storage", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	filtered := make([]entity.AccountInfo, 0, len(accounts))
+	for _, a := range accounts {
+		if _, d := entity.SplitAddress(a.Address); domain == "" || strings.EqualFold(d, domain) {
+			filtered = append(filtered, a)
+		}
+	}
+	sort.Slice(filtered, func(i, j int) bool {
+		return filtered[i].Address < filtered[j].Address
+	})
+
+	if offset > len(filtered) {
+		offset = len(filtered)
+	}
+	filtered = filtered[offset:]
+	if limit > 0 && limit < len(filtered) {
+		filtered = filtered[:limit]
+	}
+	json.NewEncoder(w).Encode(filtered)
+}
+
+func (s *HTTPServer) getAPIAdminAccount(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !s.authorize(w, r, entity.ScopeAdminRead) {
+		return
+	}
+	address, ok := s.adminAddress(w, p)
+	if !ok {
+		return
+	}
+	a, err := s.storage.AccountInfo(address)
+	if err != nil {
+		if errors.Is(err, entity.ErrAccountDoesntExists) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.logger.Error("get account info from storage", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(a)
+}
+
+// patchAPIAdminAccount sets account TTL to ttl parameter counting from now.
+func (s *HTTPServer) patchAPIAdminAccount(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !s.authorize(w, r, entity.ScopeAdminWrite) {
+		return
+	}
+	address, ok := s.adminAddress(w, p)
+	if !ok {
+		return
+	}
+	ttl, err := time.ParseDuration(r.FormValue(ttlParam))
+	if err != nil || ttl <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "ttl must be a positive duration")
+		return
+	}
+	if err = s.storage.SetAccountTTL(address, ttl); err != nil {
+		if errors.Is(err, entity.ErrAccountDoesntExists) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.logger.Error("set account ttl in storage", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info("admin set account ttl", zap.String("address", address),
+		zap.Duration("ttl", ttl))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteAPIAdminAccount expires account immediately, its subscribers get
+// account expiry event.
+func (s *HTTPServer) deleteAPIAdminAccount(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !s.authorize(w, r, entity.ScopeAdminWrite) {
+		return
+	}
+	address, ok := s.adminAddress(w, p)
+	if !ok {
+		return
+	}
+	if err := s.storage.ExpireAccount(address); err != nil {
+		if errors.Is(err, entity.ErrAccountDoesntExists) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.logger.Error("expire account in storage", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info("admin expired account", zap.String("address", address))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteAPIAdminEmails removes emails of sender address or domain from all
+// accounts and returns their number.
+func (s *HTTPServer) deleteAPIAdminEmails(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !s.authorize(w, r, entity.ScopeAdminWrite) {
+		return
+	}
+	sender := strings.TrimSpace(r.FormValue(senderParam))
+	if sender == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "sender is required")
+		return
+	}
+	n, err := s.storage.RemoveEmailsBySender(sender)
+	if err != nil {
+		s.logger.Error("remove emails by sender in storage", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info("admin removed emails by sender", zap.String("sender", sender),
+		zap.Int("emails", n))
+	json.NewEncoder(w).Encode(n)
+}
+
+func (s *HTTPServer) getAPIAdminStats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !s.authorize(w, r, entity.ScopeAdminRead) {
+		return
+	}
+	accounts, err := s.storage.Accounts()
+	if err != nil {
+		s.logger.Error("list accounts in storage", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	stats := entity.Stats{Domains: map[string]int{}}
+	for _, d := range s.domains {
+		stats.Domains[d] = 0
+	}
+	for _, a := range accounts {
+		_, d := entity.SplitAddress(a.Address)
+		stats.Accounts++
+		stats.Emails += a.Emails
+		stats.Size += a.Size
+		stats.Domains[d]++
+	}
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,103 @@
+package tmpmail
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"tmpmail/entity"
+)
+
+// getStats requests admin stats from 192.0.2.1 and returns response status.
+func getStats(h http.Handler, auth string) int {
+	r := httptest.NewRequest(http.MethodGet, "/api/admin/stats", nil)
+	r.Header.Set(authHeader, auth)
+	r.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestAuthorize(t *testing.T) {
+	srv, st := newTestHTTPServer(t, AccountCreationLimit{})
+	h := srv.Handler()
+
+	readKey, readK, err := IssueAPIKey(st, "read", []string{entity.ScopeAdminRead}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKey, writeK, err := IssueAPIKey(st, "write", []string{entity.ScopeAdminWrite}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		auth string
+		want int
+	}{
+		{name: "admin token", auth: testAuthToken, want: http.StatusOK},
+		{name: "api key", auth: readKey, want: http.StatusOK},
+		{name: "api key without scope", auth: writeKey, want: http.StatusForbidden},
+		{name: "wrong token", auth: testAuthToken + "x", want: http.StatusUnauthorized},
+		{name: "no token", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := getStats(h, tt.auth); code != tt.want {
+				t.Errorf("GET status = %d, want %d", code, tt.want)
+			}
+		})
+	}
+
+	for _, tt := range []struct {
+		id          string
+		wantTouched bool
+	}{{readK.ID, true}, {writeK.ID, false}} {
+		k, err := st.APIKey(tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if touched := !k.LastUsedAt.IsZero(); touched != tt.wantTouched {
+			t.Errorf("key %s touched = %v, want %v", tt.id, touched, tt.wantTouched)
+		}
+	}
+}
+
+func TestAuthorizeRateLimit(t *testing.T) {
+	srv, _ := newTestHTTPServer(t, AccountCreationLimit{})
+	h := srv.Handler()
+
+	// Authenticated requests don't count.
+	for i := 0; i < 10; i++ {
+		if code := getStats(h, testAuthToken); code != http.StatusOK {
+			t.Fatalf("GET status = %d, want %d", code, http.StatusOK)
+		}
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		codes = map[int]int{}
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code := getStats(h, "guess")
+			mu.Lock()
+			codes[code]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// Limit of failed attempts is 5 per hour.
+	if codes[http.StatusUnauthorized] != 5 || codes[http.StatusTooManyRequests] != 15 {
+		t.Errorf("GET statuses = %v, want 5 unauthorized and the rest refused", codes)
+	}
+	if code := getStats(h, testAuthToken); code != http.StatusTooManyRequests {
+		t.Errorf("GET with admin token after limit status = %d, want %d", code, http.StatusTooManyRequests)
+	}
+}
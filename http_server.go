@@ -1,20 +1,24 @@
 package tmpmail
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"embed"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"io/fs"
 	"mime"
+	"net"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
@@ -29,47 +33,105 @@ import (
 //go:embed all:ui/dist/*
 var uiFS embed.FS
 
+// HTTPServerStorage accounts are identified by full address like
+// alice@tmp-mail.ru.
 type HTTPServerStorage interface {
-	CreateAccount(token, username string, ttl time.Duration) error
+	CreateAccount(token, address string, ttl time.Duration) error
 	ProlongAccount(token string, ttl time.Duration) error
 	Account(token string) (entity.Account, error)
 	RemoveAccount(token string) error
+	Emails(token string) ([]entity.EmailSummary, error)
+	Email(token, id string) (entity.Email, error)
+	RemoveEmail(token, id string) error
+	Attachment(token, emailID string, n int) (entity.Attachment, error)
+	EmbeddedFile(token, emailID string, n int) (entity.EmbeddedFile, error)
+	RawEmail(token, id string) ([]byte, error)
+	Subscribe(ctx context.Context, token string) (<-chan entity.Event, error)
+	Counter
+	AdminStorage
+	APIKeyStorage
+}
+
+// AccountCreationLimit limits anonymous account creations per client IP to
+// Count per Window. Zero Count means unlimited.
+type AccountCreationLimit struct {
+	Count  int
+	Window time.Duration
 }
 
 type HTTPServer struct {
 	server            *http.Server
 	storage           HTTPServerStorage
+	domains           []string
+	usernameDenylist  []string
 	authToken         string
-	authRateLimiter   *ipRateLimiter
+	authRateLimiter   RateLimiter
 	defaultAccountTTL time.Duration
+	trustedProxies    []*net.IPNet
+	accountLimit      AccountCreationLimit
+	accountVerifier   AccountVerifier
 	ui                fs.FS
 	api               http.Handler
 	logger            *zap.Logger
 }
 
+// NewHTTPServer creates HTTP server. It serves plain HTTP if tc is nil.
+// Accounts are created in domains, the first one is default. Usernames chosen
+// by users must not contain usernameDenylist words. corsOrigins are origins
+// allowed to use API from browser.
+//
+// Anonymous account creation is limited by al per client IP, X-Forwarded-For
+// is trusted only from trustedProxies. Requests must pass av verification
+// unless it is nil. Failed admin authentications are limited by limiter
+// created by rlf, nil rlf means limiter in process memory.
 func NewHTTPServer(l *zap.Logger, s HTTPServerStorage, addr string, tc *tls.Config,
-	authToken string, defaultAccountTTL time.Duration) *HTTPServer {
+	domains, usernameDenylist []string, authToken string, defaultAccountTTL time.Duration,
+	corsOrigins []string, trustedProxies []*net.IPNet, al AccountCreationLimit,
+	av AccountVerifier, rlf RateLimiterFactory) *HTTPServer {
 
 	ui, _ := fs.Sub(uiFS, "ui/dist")
 
 	srv := &HTTPServer{
 		storage:           s,
+		domains:           domains,
+		usernameDenylist:  usernameDenylist,
 		authToken:         authToken,
-		authRateLimiter:   newIPRateLimiter(rate.Every(time.Hour), 5),
+		authRateLimiter:   newRateLimiter(rlf, "http-auth", rate.Every(time.Hour), 5),
 		defaultAccountTTL: defaultAccountTTL,
+		trustedProxies:    trustedProxies,
+		accountLimit:      al,
+		accountVerifier:   av,
 		ui:                ui,
 		logger:            l,
 	}
 
 	api := httprouter.New()
+	api.GET("/api/domains", srv.getAPIDomains)
+	api.GET("/api/metrics", srv.getAPIMetrics)
 	api.GET("/api/account", srv.getAPIAccount)
 	api.POST("/api/account", srv.postAPIAccount)
+	api.GET("/api/account/challenge", srv.getAPIAccountChallenge)
 	api.PUT("/api/account", srv.putAPIAccount)
 	api.PATCH("/api/account", srv.patchAPIAccount)
 	api.DELETE("/api/account", srv.deleteAPIAccount)
+	api.GET("/api/account/events", srv.getAPIAccountEvents)
+	api.GET("/api/account/verification", srv.getAPIAccountVerification)
+	api.GET("/api/account/wait", srv.getAPIAccountWait)
+	api.GET("/api/account/emails", srv.getAPIAccountEmails)
+	api.GET("/api/account/emails/:id", srv.getAPIAccountEmail)
+	api.DELETE("/api/account/emails/:id", srv.deleteAPIAccountEmail)
+	api.GET("/api/account/emails/:id/attachments/:n", srv.getAPIAccountEmailAttachment)
+	api.GET("/api/account/emails/:id/embedded-files/:n", srv.getAPIAccountEmailEmbeddedFile)
+	api.GET("/api/account/emails/:id/raw", srv.getAPIAccountEmailRaw)
+	api.GET("/api/admin/accounts", srv.getAPIAdminAccounts)
+	api.GET("/api/admin/accounts/:address", srv.getAPIAdminAccount)
+	api.PATCH("/api/admin/accounts/:address", srv.patchAPIAdminAccount)
+	api.DELETE("/api/admin/accounts/:address", srv.deleteAPIAdminAccount)
+	api.DELETE("/api/admin/emails", srv.deleteAPIAdminEmails)
+	api.GET("/api/admin/stats", srv.getAPIAdminStats)
 
 	corsHandler := cors.New(cors.Options{
-		AllowedOrigins: []string{"https://tmp-mail.ru", "http://localhost:3000"},
+		AllowedOrigins: corsOrigins,
 		AllowedMethods: []string{
 			http.MethodHead,
 			http.MethodGet,
@@ -100,24 +162,55 @@ func NewHTTPServer(l *zap.Logger, s HTTPServerStorage, addr string, tc *tls.Conf
 	return srv
 }
 
+// Handler returns handler of API and UI, e.g. to serve them by httptest.
+func (s *HTTPServer) Handler() http.Handler {
+	return s.server.Handler
+}
+
 func (s *HTTPServer) ListenAndServe() error {
-	err := s.server.ListenAndServeTLS("", "")
+	var err error
+	if s.server.TLSConfig != nil {
+		err = s.server.ListenAndServeTLS("", "")
+	} else {
+		err = s.server.ListenAndServe()
+	}
 	if err != nil {
 		return fmt.Errorf("listen and server: %w", err)
 	}
 	return nil
 }
 
+// Serve accepts HTTP connections on l, it is useful when listener is already
+// bound, e.g. on random port.
+func (s *HTTPServer) Serve(l net.Listener) error {
+	var err error
+	if s.server.TLSConfig != nil {
+		err = s.server.ServeTLS(l, "", "")
+	} else {
+		err = s.server.Serve(l)
+	}
+	if err != nil {
+		return fmt.Errorf("serve: %w", err)
+	}
+	return nil
+}
+
 func (s *HTTPServer) Shutdown(ctx context.Context) error {
 	return s.server.Shutdown(ctx)
 }
 
 const (
-	authHeader   = "Authorization"
-	acceptHeader = "Accept"
-	tokenHeader  = "X-TOKEN"
-	tokenLength  = 128
-	emailsParam  = "emails"
+	authHeader    = "Authorization"
+	acceptHeader  = "Accept"
+	tokenHeader   = "X-TOKEN"
+	tokenParam    = "token"
+	tokenLength   = 128
+	emailsParam   = "emails"
+	domainParam   = "domain"
+	usernameParam = "username"
+	tagParam      = "tag"
+
+	verificationParam = "verification"
 )
 
 func generateRandomString(length int) string {
@@ -141,6 +234,33 @@ func generateEmail() string {
 	return b.String()
 }
 
+// accountDomain returns configured domain matching d or the default domain if
+// d is empty.
+func (s *HTTPServer) accountDomain(d string) (string, bool) {
+	if d == "" {
+		return s.domains[0], true
+	}
+	for _, domain := range s.domains {
+		if strings.EqualFold(d, domain) {
+			return domain, true
+		}
+	}
+	return "", false
+}
+
+func (s *HTTPServer) getAPIDomains(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	json.NewEncoder(w).Encode(s.domains)
+}
+
+// getAPIMetrics serves expvar variables including SMTP rate limit counters to
+// admin.
+func (s *HTTPServer) getAPIMetrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !s.authorize(w, r, entity.ScopeAdminRead) {
+		return
+	}
+	expvar.Handler().ServeHTTP(w, r)
+}
+
 func (s *HTTPServer) getAPIAccount(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	token := r.Header.Get(tokenHeader)
 
@@ -155,37 +275,116 @@ func (s *HTTPServer) getAPIAccount(w http.ResponseWriter, r *http.Request, _ htt
 		return
 	}
 
+	a.Username, a.Domain = entity.SplitAddress(a.Address)
+
 	json.NewEncoder(w).Encode(a)
 }
 
-func (s *HTTPServer) postAPIAccount(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	email := generateEmail()
-	token := generateRandomString(tokenLength)
-	err := s.storage.CreateAccount(token, email, s.defaultAccountTTL)
+// getAPIAccountChallenge returns challenge to pass for account creation or
+// no content if verification isn't required.
+func (s *HTTPServer) getAPIAccountChallenge(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.accountVerifier == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	c, err := s.accountVerifier.Challenge()
 	if err != nil {
-		s.logger.Warn("create email in storage", zap.Error(err))
+		s.logger.Error("create account challenge", zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	json.NewEncoder(w).Encode(token)
+	json.NewEncoder(w).Encode(c)
 }
 
-func (s *HTTPServer) putAPIAccount(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	limiter := s.authRateLimiter.GetLimiter(r.RemoteAddr)
+// accountCreationKey is a counter key of account creations by client IP.
+func accountCreationKey(ip string) string {
+	return "acct/" + ipKey(ip)
+}
 
-	reserve := limiter.Reserve()
-	if !reserve.OK() {
-		w.WriteHeader(http.StatusTooManyRequests)
+// postAPIAccount creates account anonymously. A creation of client IP is
+// counted before any checks, so concurrent requests can't exceed the limit,
+// and is released if account isn't created.
+func (s *HTTPServer) postAPIAccount(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ip := clientIP(r, s.trustedProxies)
+
+	if s.accountLimit.Count <= 0 {
+		s.createAnonymousAccount(w, r, ip)
 		return
 	}
 
-	authToken := r.Header.Get(authHeader)
-	if s.authToken != authToken {
-		w.WriteHeader(http.StatusUnauthorized)
+	key := accountCreationKey(ip)
+	n, err := s.storage.IncrCounter(key, s.accountLimit.Window)
+	if err != nil {
+		s.logger.Error("count account creation", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	created := false
+	if n > s.accountLimit.Count {
+		w.WriteHeader(http.StatusTooManyRequests)
+	} else {
+		created = s.createAnonymousAccount(w, r, ip)
+	}
+	if !created {
+		if err = s.storage.DecrCounter(key); err != nil {
+			s.logger.Error("release account creation", zap.Error(err))
+		}
+	}
+}
+
+// createAnonymousAccount replies with token of created account or with error
+// and reports whether account was created.
+func (s *HTTPServer) createAnonymousAccount(w http.ResponseWriter, r *http.Request, ip string) bool {
+	domain, ok := s.accountDomain(r.FormValue(domainParam))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
 
-	reserve.Cancel()
+	username := strings.ToLower(r.FormValue(usernameParam))
+	if username == "" {
+		username = generateEmail()
+	} else if err := validateUsername(username, s.usernameDenylist); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return false
+	}
+
+	if s.accountVerifier != nil {
+		ok, err := s.accountVerifier.Verify(r.Context(), r.FormValue(verificationParam), ip)
+		if err != nil {
+			s.logger.Error("verify account creation", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return false
+		}
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, "verification failed")
+			return false
+		}
+	}
+
+	email := username + "@" + domain
+	token := generateRandomString(tokenLength)
+	err := s.storage.CreateAccount(token, email, s.defaultAccountTTL)
+	if err != nil {
+		if errors.Is(err, entity.ErrAccountAlreadyExists) {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "%s: %s\n", email, err)
+			return false
+		}
+		s.logger.Warn("create email in storage", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	json.NewEncoder(w).Encode(token)
+	return true
+}
+
+func (s *HTTPServer) putAPIAccount(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !s.authorize(w, r, entity.ScopeBulkCreate) {
+		return
+	}
 
 	emails := strings.Split(r.FormValue(emailsParam), ",")
 	if len(emails) == 0 {
@@ -193,11 +392,27 @@ func (s *HTTPServer) putAPIAccount(w http.ResponseWriter, r *http.Request, p htt
 		return
 	}
 
-	for _, email := range emails {
-		if len(email) == 0 {
+	// Emails without domain are created in the default domain. Usernames
+	// are checked as in postAPIAccount, so subaddress separator, reserved and
+	// denied usernames are refused.
+	for i, email := range emails {
+		username, _ := entity.SplitAddress(strings.ToLower(email))
+		if err := validateUsername(username, s.usernameDenylist); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s: %s\n", email, err)
 			return
 		}
+		if !strings.Contains(email, "@") {
+			emails[i] = username + "@" + s.domains[0]
+			continue
+		}
+		address, _, ok := accountAddress(email, s.domains)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s: unknown domain\n", email)
+			return
+		}
+		emails[i] = address
 	}
 
 	var (
@@ -219,6 +434,11 @@ func (s *HTTPServer) putAPIAccount(w http.ResponseWriter, r *http.Request, p htt
 		token := generateRandomString(tokenLength)
 		err = s.storage.CreateAccount(token, email, ttl)
 		if err != nil {
+			if errors.Is(err, entity.ErrAccountAlreadyExists) {
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprintf(w, "%s: %s\n", email, err)
+				return
+			}
 			s.logger.Warn("create email in storage", zap.Error(err))
 			w.WriteHeader(http.StatusInternalServerError)
 			return
@@ -245,6 +465,10 @@ func (s *HTTPServer) patchAPIAccount(w http.ResponseWriter, r *http.Request, _ h
 	token := r.Header.Get(tokenHeader)
 	err := s.storage.ProlongAccount(token, s.defaultAccountTTL)
 	if err != nil {
+		if errors.Is(err, entity.ErrAccountDoesntExists) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 		s.logger.Error("prolong account in storage", zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -252,78 +476,428 @@ func (s *HTTPServer) patchAPIAccount(w http.ResponseWriter, r *http.Request, _ h
 }
 
 func (s *HTTPServer) deleteAPIAccount(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	s.storage.RemoveAccount(r.Header.Get(tokenHeader))
+	err := s.storage.RemoveAccount(r.Header.Get(tokenHeader))
+	if err != nil {
+		if errors.Is(err, entity.ErrAccountDoesntExists) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.logger.Error("remove account from storage", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 }
 
-const indexHTMLFile = "index.html"
+// taggedEmails returns emails sent to tag subaddress. All emails are returned
+// if tag is empty.
+func taggedEmails(emails []entity.EmailSummary, tag string) []entity.EmailSummary {
+	if tag == "" {
+		return emails
+	}
+	tagged := []entity.EmailSummary{}
+	for _, e := range emails {
+		if matchTag(tag, e.Tag) {
+			tagged = append(tagged, e)
+		}
+	}
+	return tagged
+}
 
-func (s *HTTPServer) serveFile(path string, w http.ResponseWriter) {
-	file, err := s.ui.Open(path)
+func (s *HTTPServer) getAPIAccountEmails(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	emails, err := s.storage.Emails(r.Header.Get(tokenHeader))
 	if err != nil {
-		file, _ = s.ui.Open(indexHTMLFile)
+		if errors.Is(err, entity.ErrAccountDoesntExists) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.logger.Error("get account emails from storage", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
-	defer file.Close()
 
-	w.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(path)))
-	io.Copy(w, file)
+	json.NewEncoder(w).Encode(taggedEmails(emails, r.URL.Query().Get(tagParam)))
 }
 
-func (s *HTTPServer) handler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	if strings.HasPrefix(r.URL.Path, "/api") {
-		s.api.ServeHTTP(w, r)
+func (s *HTTPServer) getAPIAccountEmail(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	email, err := s.storage.Email(r.Header.Get(tokenHeader), p.ByName("id"))
+	if err != nil {
+		if isNotFound(err) {
+			replyNotFound(w, err)
+			return
+		}
+		s.logger.Error("get account email from storage", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("Method Not Allowed"))
+
+	json.NewEncoder(w).Encode(email)
+}
+
+func (s *HTTPServer) deleteAPIAccountEmail(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	err := s.storage.RemoveEmail(r.Header.Get(tokenHeader), p.ByName("id"))
+	if err != nil {
+		if isNotFound(err) {
+			replyNotFound(w, err)
+			return
+		}
+		s.logger.Error("remove account email from storage", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if r.URL.Path == "/" {
-		s.serveFile(indexHTMLFile, w)
+}
+
+// notFoundErrors are named in 404 responses, so clients can tell expired
+// account from missing email.
+var notFoundErrors = []error{
+	entity.ErrAccountDoesntExists,
+	entity.ErrEmailDoesntExists,
+	entity.ErrFileDoesntExists,
+}
+
+func isNotFound(err error) bool {
+	for _, e := range notFoundErrors {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func replyNotFound(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusNotFound)
+	for _, e := range notFoundErrors {
+		if errors.Is(err, e) {
+			fmt.Fprintln(w, e)
+			return
+		}
+	}
+}
+
+// serveData serves file data with range requests support.
+func serveData(w http.ResponseWriter, r *http.Request, disposition, filename, contentType, sha256 string, data []byte) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if filename != "" {
+		disposition = mime.FormatMediaType(disposition, map[string]string{"filename": filename})
+	}
+	w.Header().Set("Content-Disposition", disposition)
+	if sha256 != "" {
+		w.Header().Set("ETag", `"`+sha256+`"`)
+	}
+	http.ServeContent(w, r, filename, time.Time{}, bytes.NewReader(data))
+}
+
+func (s *HTTPServer) getAPIAccountEmailAttachment(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	n, err := strconv.Atoi(p.ByName("n"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	s.serveFile(strings.TrimPrefix(r.URL.Path, "/"), w)
+
+	a, err := s.storage.Attachment(r.Header.Get(tokenHeader), p.ByName("id"), n)
+	if err != nil {
+		if isNotFound(err) {
+			replyNotFound(w, err)
+			return
+		}
+		s.logger.Error("get attachment from storage", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	serveData(w, r, "attachment", a.Filename, a.ContentType, a.SHA256, a.Data)
 }
 
-type ipRateLimiter struct {
-	ips map[string]*rate.Limiter
-	mu  *sync.RWMutex
-	r   rate.Limit
-	b   int
+func (s *HTTPServer) getAPIAccountEmailEmbeddedFile(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	n, err := strconv.Atoi(p.ByName("n"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ef, err := s.storage.EmbeddedFile(r.Header.Get(tokenHeader), p.ByName("id"), n)
+	if err != nil {
+		if isNotFound(err) {
+			replyNotFound(w, err)
+			return
+		}
+		s.logger.Error("get embedded file from storage", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	serveData(w, r, "inline", "", ef.ContentType, ef.SHA256, ef.Data)
 }
 
-func newIPRateLimiter(r rate.Limit, b int) *ipRateLimiter {
-	i := &ipRateLimiter{
-		ips: make(map[string]*rate.Limiter),
-		mu:  &sync.RWMutex{},
-		r:   r,
-		b:   b,
+func (s *HTTPServer) getAPIAccountEmailRaw(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id := p.ByName("id")
+
+	raw, err := s.storage.RawEmail(r.Header.Get(tokenHeader), id)
+	if err != nil {
+		if isNotFound(err) {
+			replyNotFound(w, err)
+			return
+		}
+		s.logger.Error("get raw email from storage", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		s.logger.Error("open raw email", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		s.logger.Error("decompress raw email", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	return i
+	serveData(w, r, "attachment", id+".eml", "message/rfc822", "", data)
 }
 
-func (i *ipRateLimiter) AddIP(ip string) *rate.Limiter {
-	i.mu.Lock()
-	defer i.mu.Unlock()
+// getAPIAccountVerification responds with the first code and link of the
+// newest email having any of them, or with 204 if there is no such email.
+func (s *HTTPServer) getAPIAccountVerification(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	emails, err := s.storage.Emails(r.Header.Get(tokenHeader))
+	if err != nil {
+		if errors.Is(err, entity.ErrAccountDoesntExists) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.logger.Error("get account emails from storage", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for _, e := range taggedEmails(emails, r.URL.Query().Get(tagParam)) {
+		if len(e.Codes) == 0 && len(e.Links) == 0 {
+			continue
+		}
+		v := entity.Verification{EmailID: e.ID}
+		if len(e.Codes) > 0 {
+			v.Code = e.Codes[0]
+		}
+		if len(e.Links) > 0 {
+			v.Link = e.Links[0]
+		}
+		json.NewEncoder(w).Encode(v)
+		return
+	}
 
-	limiter := rate.NewLimiter(i.r, i.b)
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	i.ips[ip] = limiter
+const (
+	defaultWaitTimeout = 30 * time.Second
+	maxWaitTimeout     = 5 * time.Minute
+)
 
-	return limiter
+// findEmail returns the oldest matching email of account. Only emails with
+// matching summaries are loaded.
+func (s *HTTPServer) findEmail(token string, f emailFilter) (entity.Email, bool, error) {
+	summaries, err := s.storage.Emails(token)
+	if err != nil {
+		return entity.Email{}, false, err
+	}
+	for i := len(summaries) - 1; i >= 0; i-- {
+		if !f.matchSummary(summaries[i]) {
+			continue
+		}
+		email, err := s.storage.Email(token, summaries[i].ID)
+		if err != nil {
+			if errors.Is(err, entity.ErrEmailDoesntExists) {
+				continue
+			}
+			return entity.Email{}, false, err
+		}
+		if f.match(email) {
+			return email, true, nil
+		}
+	}
+	return entity.Email{}, false, nil
 }
 
-func (i *ipRateLimiter) GetLimiter(ip string) *rate.Limiter {
-	i.mu.Lock()
-	limiter, exists := i.ips[ip]
+// awaitEmail waits for the oldest email matching f until ctx is done. Slow
+// subscribers are closed by storage, emails are looked through again then.
+func (s *HTTPServer) awaitEmail(ctx context.Context, token string, f emailFilter) (entity.Email, bool, error) {
+	for {
+		// Subscribe before looking through existing emails to not miss new
+		// ones. Emails are looked through once even if ctx is done.
+		events, err := s.storage.Subscribe(ctx, token)
+		if err != nil && ctx.Err() == nil {
+			return entity.Email{}, false, err
+		}
+		email, found, err := s.findEmail(token, f)
+		if found || err != nil || events == nil {
+			return email, found, err
+		}
+		for e := range events {
+			switch e.Type {
+			case entity.EventAccountRemoved, entity.EventAccountExpired:
+				return entity.Email{}, false, entity.ErrAccountDoesntExists
+			case entity.EventEmailAdded:
+				if e.Email == nil || !f.matchSummary(*e.Email) {
+					continue
+				}
+				email, err = s.storage.Email(token, e.Email.ID)
+				if errors.Is(err, entity.ErrEmailDoesntExists) {
+					continue
+				}
+				if err != nil {
+					return entity.Email{}, false, err
+				}
+				if f.match(email) {
+					return email, true, nil
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			return entity.Email{}, false, nil
+		}
+	}
+}
+
+// getAPIAccountWait responds with the oldest email arrived after since
+// email ID and matching tag, subject, from and body filters. It waits for such
+// email up to timeout and responds with 204 if none arrived.
+func (s *HTTPServer) getAPIAccountWait(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	token := r.Header.Get(tokenHeader)
+	q := r.URL.Query()
 
-	if !exists {
-		i.mu.Unlock()
-		return i.AddIP(ip)
+	timeout := defaultWaitTimeout
+	if t := q.Get("timeout"); t != "" {
+		var err error
+		timeout, err = time.ParseDuration(t)
+		if err != nil || timeout < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if timeout > maxWaitTimeout {
+			timeout = maxWaitTimeout
+		}
+	}
+
+	f, err := newEmailFilter(q.Get("since"), q.Get(tagParam), q.Get("subject"), q.Get("from"), q.Get("body"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	email, found, err := s.awaitEmail(ctx, token, f)
+	if err != nil {
+		if isNotFound(err) {
+			replyNotFound(w, err)
+			return
+		}
+		s.logger.Error("wait for email", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	json.NewEncoder(w).Encode(email)
+}
+
+// eventsPingInterval keeps idle event streams alive through proxies.
+const eventsPingInterval = 30 * time.Second
+
+// getAPIAccountEvents streams account events as Server-Sent Events. Token
+// may be passed in query since EventSource can't set headers.
+func (s *HTTPServer) getAPIAccountEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	token := r.Header.Get(tokenHeader)
+	if token == "" {
+		token = r.URL.Query().Get(tokenParam)
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	events, err := s.storage.Subscribe(r.Context(), token)
+	if err != nil {
+		if errors.Is(err, entity.ErrAccountDoesntExists) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.logger.Error("subscribe account events", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	i.mu.Unlock()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
 
-	return limiter
+	ping := time.NewTicker(eventsPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			io.WriteString(w, ": ping\n\n")
+			flusher.Flush()
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			eventJSON, err := json.Marshal(e)
+			if err != nil {
+				s.logger.Error("json marshal event", zap.Error(err))
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, eventJSON)
+			flusher.Flush()
+			if e.Type == entity.EventAccountRemoved || e.Type == entity.EventAccountExpired {
+				return
+			}
+		}
+	}
+}
+
+const indexHTMLFile = "index.html"
+
+func (s *HTTPServer) serveFile(path string, w http.ResponseWriter) {
+	file, err := s.ui.Open(path)
+	if err != nil {
+		file, _ = s.ui.Open(indexHTMLFile)
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(path)))
+	io.Copy(w, file)
+}
+
+func (s *HTTPServer) handler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if strings.HasPrefix(r.URL.Path, "/api") {
+		s.api.ServeHTTP(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method Not Allowed"))
+		return
+	}
+	if r.URL.Path == "/" {
+		s.serveFile(indexHTMLFile, w)
+		return
+	}
+	s.serveFile(strings.TrimPrefix(r.URL.Path, "/"), w)
 }
@@ -0,0 +1,170 @@
+package tmpmail
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"tmpmail/entity"
+	"tmpmail/memory"
+)
+
+const testAuthToken = "test-auth-token-which-is-long-enough-to-pass"
+
+// newTestHTTPServer creates HTTP server of domain tmpmail.test with memory
+// storage and username denylist of "casino".
+func newTestHTTPServer(t *testing.T, al AccountCreationLimit) (*HTTPServer, *memory.Storage) {
+	t.Helper()
+	st := memory.NewStorage()
+	t.Cleanup(func() { st.Close() })
+	srv := NewHTTPServer(zap.NewNop(), st, "", nil, []string{"tmpmail.test"}, []string{"casino"},
+		testAuthToken, time.Hour, nil, nil, al, nil, nil)
+	return srv, st
+}
+
+// postAccount creates account from 192.0.2.1 and returns response status.
+func postAccount(h http.Handler, username string) int {
+	form := url.Values{usernameParam: {username}}
+	r := httptest.NewRequest(http.MethodPost, "/api/account", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestAccountCreationLimit(t *testing.T) {
+	srv, _ := newTestHTTPServer(t, AccountCreationLimit{Count: 1, Window: time.Hour})
+	h := srv.Handler()
+
+	// Failed attempts don't count towards the limit.
+	for i := 0; i < 3; i++ {
+		if code := postAccount(h, "postmaster"); code != http.StatusBadRequest {
+			t.Fatalf("POST reserved username status = %d, want %d", code, http.StatusBadRequest)
+		}
+	}
+	if code := postAccount(h, "alice"); code != http.StatusOK {
+		t.Fatalf("POST status = %d, want %d", code, http.StatusOK)
+	}
+	if code := postAccount(h, "bob"); code != http.StatusTooManyRequests {
+		t.Errorf("POST over limit status = %d, want %d", code, http.StatusTooManyRequests)
+	}
+}
+
+func TestAccountCreationLimitConcurrent(t *testing.T) {
+	const limit = 5
+	srv, _ := newTestHTTPServer(t, AccountCreationLimit{Count: limit, Window: time.Hour})
+	h := srv.Handler()
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		codes = map[int]int{}
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code := postAccount(h, "")
+			mu.Lock()
+			codes[code]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if codes[http.StatusOK] != limit || codes[http.StatusTooManyRequests] != 50-limit {
+		t.Errorf("POST statuses = %v, want %d created and the rest refused", codes, limit)
+	}
+}
+
+// getWithToken requests path of token account and returns response.
+func getWithToken(h http.Handler, path, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Header.Set(tokenHeader, token)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestGetAPIAccountWait(t *testing.T) {
+	srv, st := newTestHTTPServer(t, AccountCreationLimit{})
+	h := srv.Handler()
+
+	if err := st.CreateAccount("token", "alice@tmpmail.test", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	emails := []entity.Email{
+		{ID: "0001", Subject: "news", From: []string{"news@example.com"}},
+		{ID: "0002", Subject: "code", Sender: "auth@example.com", TextBody: "code: 1234"},
+		// Email IDs don't clash with wait route.
+		{ID: "wait", Subject: "wait"},
+	}
+	for _, e := range emails {
+		if err := st.AddEmail("alice@tmpmail.test", e, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := getWithToken(h, "/api/account/wait?from=auth@example.com&body=code&timeout=0s", "token")
+	var got entity.Email
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil || got.ID != "0002" {
+		t.Errorf("GET wait = %d %s, want email 0002", w.Code, got.ID)
+	}
+	if w = getWithToken(h, "/api/account/wait?since=wait&timeout=0s", "token"); w.Code != http.StatusNoContent {
+		t.Errorf("GET wait without new emails status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	w = getWithToken(h, "/api/account/emails/wait", "token")
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil || got.Subject != "wait" {
+		t.Errorf("GET email wait = %d %q, want email with subject wait", w.Code, got.Subject)
+	}
+}
+
+func TestPutAPIAccount(t *testing.T) {
+	tests := []struct {
+		emails string
+		want   int
+	}{
+		{emails: "alice,Bob@TMPMAIL.test", want: http.StatusOK},
+		{emails: "postmaster", want: http.StatusBadRequest},
+		{emails: "postmaster@tmpmail.test", want: http.StatusBadRequest},
+		{emails: "a/b?c", want: http.StatusBadRequest},
+		{emails: "alice+tag@tmpmail.test", want: http.StatusBadRequest},
+		{emails: "bigcasino", want: http.StatusBadRequest},
+		{emails: "alice,", want: http.StatusBadRequest},
+		{emails: "alice@example.com", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.emails, func(t *testing.T) {
+			srv, st := newTestHTTPServer(t, AccountCreationLimit{})
+			form := url.Values{emailsParam: {tt.emails}}
+			r := httptest.NewRequest(http.MethodPut, "/api/account", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set(authHeader, testAuthToken)
+			w := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("PUT status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			infos, err := st.Accounts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := 0
+			if tt.want == http.StatusOK {
+				want = len(strings.Split(tt.emails, ","))
+			}
+			if len(infos) != want {
+				t.Errorf("PUT created %d accounts, want %d", len(infos), want)
+			}
+		})
+	}
+}
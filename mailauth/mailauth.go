@@ -0,0 +1,259 @@
+// Package mailauth checks email sender authentication with SPF, DKIM and
+// DMARC.
+package mailauth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"strings"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+
+	"tmpmail/entity"
+)
+
+// Resolver resolves DNS records, *net.Resolver implements it. Missing records
+// must be reported by *net.DNSError with IsNotFound set.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// maxDKIMVerifications limits number of checked DKIM signatures of email.
+const maxDKIMVerifications = 5
+
+const (
+	resultNone      = "none"
+	resultPass      = "pass"
+	resultFail      = "fail"
+	resultTempError = "temperror"
+	resultPermError = "permerror"
+)
+
+// Verify checks SPF of the connecting ip for MAIL FROM, DKIM signatures of
+// message data and DMARC alignment of From header domain.
+func Verify(ctx context.Context, r Resolver, ip net.IP, helo, mailFrom string, data []byte) entity.Authentication {
+	lookupTXT := func(name string) ([]string, error) {
+		return r.LookupTXT(ctx, name)
+	}
+
+	a := entity.Authentication{
+		SPF:  checkSPF(ctx, r, ip, helo, mailFrom),
+		DKIM: checkDKIM(lookupTXT, data),
+	}
+	a.DMARC = checkDMARC(lookupTXT, a.SPF, a.DKIM, data)
+	return a
+}
+
+func checkSPF(ctx context.Context, r Resolver, ip net.IP, helo, mailFrom string) entity.SPFResult {
+	res := entity.SPFResult{
+		MailFrom: domainOf(mailFrom),
+		HELO:     helo,
+	}
+	result, err := spf.CheckHostWithSender(ip, helo, mailFrom,
+		spf.WithContext(ctx), spf.WithResolver(r))
+	res.Result = string(result)
+	if err != nil && result != spf.Pass {
+		res.Reason = err.Error()
+	}
+	return res
+}
+
+func checkDKIM(lookupTXT func(string) ([]string, error), data []byte) []entity.DKIMResult {
+	vs, err := dkim.VerifyWithOptions(bytes.NewReader(data), &dkim.VerifyOptions{
+		LookupTXT:        lookupTXT,
+		MaxVerifications: maxDKIMVerifications,
+	})
+	if err != nil && !errors.Is(err, dkim.ErrTooManySignatures) {
+		return []entity.DKIMResult{{Result: resultPermError, Reason: err.Error()}}
+	}
+	if len(vs) == 0 {
+		return []entity.DKIMResult{{Result: resultNone}}
+	}
+
+	results := make([]entity.DKIMResult, 0, len(vs))
+	for _, v := range vs {
+		res := entity.DKIMResult{
+			Result:     resultPass,
+			Domain:     v.Domain,
+			Identifier: v.Identifier,
+		}
+		if v.Err != nil {
+			switch {
+			case dkim.IsTempFail(v.Err):
+				res.Result = resultTempError
+			case dkim.IsPermFail(v.Err):
+				res.Result = resultPermError
+			default:
+				res.Result = resultFail
+			}
+			res.Reason = v.Err.Error()
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+func checkDMARC(lookupTXT func(string) ([]string, error), spfRes entity.SPFResult,
+	dkimRes []entity.DKIMResult, data []byte) entity.DMARCResult {
+
+	from, err := headerFromDomain(data)
+	if err != nil {
+		return entity.DMARCResult{Result: resultPermError, Reason: err.Error()}
+	}
+
+	res := entity.DMARCResult{From: from}
+
+	rec, policy, err := lookupDMARC(lookupTXT, from)
+	if err != nil {
+		switch {
+		case errors.Is(err, dmarc.ErrNoPolicy):
+			res.Result = resultNone
+		case dmarc.IsTempFail(err):
+			res.Result = resultTempError
+			res.Reason = err.Error()
+		default:
+			res.Result = resultPermError
+			res.Reason = err.Error()
+		}
+		return res
+	}
+	res.Policy = string(policy)
+
+	spfDomain := spfRes.MailFrom
+	if spfDomain == "" {
+		spfDomain = spfRes.HELO
+	}
+	if spfRes.Result == resultPass && aligned(spfDomain, from, rec.SPFAlignment) {
+		res.Result = resultPass
+		return res
+	}
+	for _, d := range dkimRes {
+		if d.Result == resultPass && aligned(d.Domain, from, rec.DKIMAlignment) {
+			res.Result = resultPass
+			return res
+		}
+	}
+
+	res.Result = resultFail
+	res.Reason = "neither SPF nor DKIM aligned"
+	return res
+}
+
+// lookupDMARC returns DMARC record of domain or of its organizational domain
+// and policy applied to domain.
+func lookupDMARC(lookupTXT func(string) ([]string, error), domain string) (*dmarc.Record, dmarc.Policy, error) {
+	opts := &dmarc.LookupOptions{LookupTXT: lookupTXT}
+
+	rec, err := dmarc.LookupWithOptions(domain, opts)
+	if err == nil {
+		return rec, rec.Policy, nil
+	}
+	if !errors.Is(err, dmarc.ErrNoPolicy) {
+		return nil, "", err
+	}
+
+	org := orgDomain(domain)
+	if org == domain {
+		return nil, "", err
+	}
+	rec, err = dmarc.LookupWithOptions(org, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	if rec.SubdomainPolicy != "" {
+		return rec, rec.SubdomainPolicy, nil
+	}
+	return rec, rec.Policy, nil
+}
+
+// aligned reports whether identifier domain is aligned with From header domain
+// by DMARC mode.
+func aligned(domain, from string, mode dmarc.AlignmentMode) bool {
+	if domain == "" {
+		return false
+	}
+	if mode == dmarc.AlignmentStrict {
+		return strings.EqualFold(domain, from)
+	}
+	return strings.EqualFold(orgDomain(domain), orgDomain(from))
+}
+
+func orgDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(domain))
+	if err != nil {
+		return strings.ToLower(domain)
+	}
+	return org
+}
+
+// headerFromDomain returns domain of From header. DMARC requires all From
+// addresses to be in the same domain.
+func headerFromDomain(data []byte) (string, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	addrs, err := m.Header.AddressList("From")
+	if err != nil {
+		return "", err
+	}
+	var domain string
+	for _, a := range addrs {
+		d := domainOf(a.Address)
+		if d == "" {
+			return "", errors.New("invalid From address")
+		}
+		if domain != "" && domain != d {
+			return "", errors.New("multiple From domains")
+		}
+		domain = d
+	}
+	if domain == "" {
+		return "", errors.New("empty From")
+	}
+	return domain, nil
+}
+
+func domainOf(address string) string {
+	_, domain := entity.SplitAddress(address)
+	return strings.ToLower(domain)
+}
+
+// Header returns Authentication-Results header field with a by authServID
+// like mail server hostname. Results are folded one per line.
+func Header(authServID string, a entity.Authentication) string {
+	results := []authres.Result{
+		&authres.SPFResult{
+			Value:  authres.ResultValue(a.SPF.Result),
+			Reason: a.SPF.Reason,
+			From:   a.SPF.MailFrom,
+			Helo:   a.SPF.HELO,
+		},
+	}
+	for _, d := range a.DKIM {
+		results = append(results, &authres.DKIMResult{
+			Value:      authres.ResultValue(d.Result),
+			Reason:     d.Reason,
+			Domain:     d.Domain,
+			Identifier: d.Identifier,
+		})
+	}
+	results = append(results, &authres.DMARCResult{
+		Value:  authres.ResultValue(a.DMARC.Result),
+		Reason: a.DMARC.Reason,
+		From:   a.DMARC.From,
+	})
+
+	value := authres.Format(authServID, results)
+	return "Authentication-Results: " + strings.ReplaceAll(value, "; ", ";\r\n\t")
+}
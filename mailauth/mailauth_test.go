@@ -0,0 +1,186 @@
+package mailauth_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+
+	"tmpmail/entity"
+	"tmpmail/mailauth"
+	"tmpmail/tmpmailtest"
+)
+
+var senderIP = net.ParseIP("192.0.2.1")
+
+// newResolver returns DNS stub where example.com and its subdomains send mail
+// from senderIP and example.com signs it with DKIM key of selector "sel".
+// mail.example.net sends from senderIP too but has no DMARC record.
+func newResolver(t *testing.T) (*tmpmailtest.Resolver, ed25519.PrivateKey) {
+	t.Helper()
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tmpmailtest.Resolver{
+		TXT: map[string][]string{
+			"example.com":                {"v=spf1 ip4:192.0.2.1 -all"},
+			"news.example.com":           {"v=spf1 ip4:192.0.2.1 -all"},
+			"mail.example.net":           {"v=spf1 ip4:192.0.2.1 -all"},
+			"sel._domainkey.example.com": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+			"_dmarc.example.com":         {"v=DMARC1; p=reject; sp=quarantine"},
+		},
+	}, key
+}
+
+func message(from string) []byte {
+	return []byte("From: " + from + "\r\n" +
+		"To: alice@tmpmail.test\r\n" +
+		"Subject: Your code\r\n" +
+		"\r\n" +
+		"Your code is 123456\r\n")
+}
+
+func sign(t *testing.T, key ed25519.PrivateKey, domain string, data []byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	err := dkim.Sign(&b, bytes.NewReader(data), &dkim.SignOptions{
+		Domain:   domain,
+		Selector: "sel",
+		Signer:   key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestVerify(t *testing.T) {
+	r, key := newResolver(t)
+
+	tests := []struct {
+		name     string
+		ip       net.IP
+		mailFrom string
+		data     []byte
+		spf      string
+		dkim     []string
+		dmarc    string
+		policy   string
+	}{
+		{
+			name:     "aligned SPF and DKIM",
+			ip:       senderIP,
+			mailFrom: "bounce@example.com",
+			data:     sign(t, key, "example.com", message("Shop <noreply@example.com>")),
+			spf:      "pass",
+			dkim:     []string{"pass"},
+			dmarc:    "pass",
+			policy:   "reject",
+		},
+		{
+			name:     "DKIM passes from foreign IP",
+			ip:       net.ParseIP("198.51.100.7"),
+			mailFrom: "bounce@example.com",
+			data:     sign(t, key, "example.com", message("noreply@example.com")),
+			spf:      "fail",
+			dkim:     []string{"pass"},
+			dmarc:    "pass",
+			policy:   "reject",
+		},
+		{
+			name:     "spoofed sender",
+			ip:       net.ParseIP("198.51.100.7"),
+			mailFrom: "bounce@example.com",
+			data:     message("security@example.com"),
+			spf:      "fail",
+			dkim:     []string{"none"},
+			dmarc:    "fail",
+			policy:   "reject",
+		},
+		{
+			name:     "modified body",
+			ip:       net.ParseIP("198.51.100.7"),
+			mailFrom: "bounce@example.com",
+			data: bytes.Replace(sign(t, key, "example.com", message("noreply@example.com")),
+				[]byte("123456"), []byte("654321"), 1),
+			spf:    "fail",
+			dkim:   []string{"fail"},
+			dmarc:  "fail",
+			policy: "reject",
+		},
+		{
+			name:     "subdomain policy of organizational domain",
+			ip:       senderIP,
+			mailFrom: "bounce@news.example.com",
+			data:     message("digest@news.example.com"),
+			spf:      "pass",
+			dkim:     []string{"none"},
+			dmarc:    "pass",
+			policy:   "quarantine",
+		},
+		{
+			name:     "SPF passes for unaligned domain",
+			ip:       senderIP,
+			mailFrom: "bounce@mail.example.net",
+			data:     message("noreply@example.com"),
+			spf:      "pass",
+			dkim:     []string{"none"},
+			dmarc:    "fail",
+			policy:   "reject",
+		},
+		{
+			name:     "no records",
+			ip:       senderIP,
+			mailFrom: "bounce@nodns.test",
+			data:     message("noreply@nodns.test"),
+			spf:      "none",
+			dkim:     []string{"none"},
+			dmarc:    "none",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := mailauth.Verify(context.Background(), r, tt.ip, "mx.example.com", tt.mailFrom, tt.data)
+			if a.SPF.Result != tt.spf {
+				t.Errorf("SPF = %+v, want %s", a.SPF, tt.spf)
+			}
+			var dkimResults []string
+			for _, d := range a.DKIM {
+				dkimResults = append(dkimResults, d.Result)
+			}
+			if !reflect.DeepEqual(dkimResults, tt.dkim) {
+				t.Errorf("DKIM = %+v, want %v", a.DKIM, tt.dkim)
+			}
+			if a.DMARC.Result != tt.dmarc || a.DMARC.Policy != tt.policy {
+				t.Errorf("DMARC = %+v, want %s with policy %q", a.DMARC, tt.dmarc, tt.policy)
+			}
+		})
+	}
+}
+
+func TestHeader(t *testing.T) {
+	a := entity.Authentication{
+		SPF:   entity.SPFResult{Result: "pass", MailFrom: "example.com", HELO: "mx.example.com"},
+		DKIM:  []entity.DKIMResult{{Result: "pass", Domain: "example.com"}},
+		DMARC: entity.DMARCResult{Result: "pass", From: "example.com", Policy: "reject"},
+	}
+	h := mailauth.Header("smtp.tmpmail.test", a)
+
+	if !strings.HasPrefix(h, "Authentication-Results: smtp.tmpmail.test;\r\n\t") {
+		t.Errorf("Header() = %q, want folded Authentication-Results of smtp.tmpmail.test", h)
+	}
+	for _, want := range []string{"spf=pass", "dkim=pass", "header.d=example.com", "dmarc=pass"} {
+		if !strings.Contains(h, want) {
+			t.Errorf("Header() = %q, want it to contain %q", h, want)
+		}
+	}
+}
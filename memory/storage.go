@@ -0,0 +1,571 @@
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"tmpmail/entity"
+	"tmpmail/events"
+)
+
+// sweepInterval also bounds delay of account expiry events.
+const sweepInterval = 10 * time.Second
+
+type token struct {
+	username  string
+	expiresAt time.Time
+}
+
+type account struct {
+	// token is used by admin to prolong account by address.
+	token  string
+	emails []entity.Email
+	// size is a total RawSize of emails.
+	size      int
+	expiresAt time.Time
+}
+
+type counter struct {
+	n         int
+	expiresAt time.Time
+}
+
+func expiresAt(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+func expired(now, expiresAt time.Time) bool {
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
+
+// Storage keeps accounts and emails in process memory. Expired entries are
+// invisible immediately and removed from memory by background sweeper.
+type Storage struct {
+	mu       sync.RWMutex
+	tokens   map[string]token
+	accounts map[string]*account
+	counters map[string]counter
+	apiKeys  map[string]entity.APIKey
+	events   *events.Hub
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewStorage() *Storage {
+	s := &Storage{
+		tokens:   map[string]token{},
+		accounts: map[string]*account{},
+		counters: map[string]counter{},
+		apiKeys:  map[string]entity.APIKey{},
+		events:   events.NewHub(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.sweeper()
+	return s
+}
+
+func (s *Storage) Close() error {
+	close(s.stop)
+	<-s.done
+	return nil
+}
+
+func (s *Storage) sweeper() {
+	defer close(s.done)
+
+	t := time.NewTicker(sweepInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-t.C:
+			s.sweep(now)
+		}
+	}
+}
+
+func (s *Storage) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, t := range s.tokens {
+		if expired(now, t.expiresAt) {
+			delete(s.tokens, k)
+		}
+	}
+	for k, a := range s.accounts {
+		if expired(now, a.expiresAt) {
+			delete(s.accounts, k)
+			s.events.Publish(k, entity.Event{Type: entity.EventAccountExpired})
+		}
+	}
+	for k, c := range s.counters {
+		if expired(now, c.expiresAt) {
+			delete(s.counters, k)
+		}
+	}
+}
+
+// token returns alive token. Must be called with s.mu held.
+func (s *Storage) token(now time.Time, tkn string) (token, bool) {
+	t, exists := s.tokens[tkn]
+	if !exists || expired(now, t.expiresAt) {
+		return token{}, false
+	}
+	return t, true
+}
+
+// account returns alive account. Must be called with s.mu held.
+func (s *Storage) account(now time.Time, username string) (*account, bool) {
+	a, exists := s.accounts[username]
+	if !exists || expired(now, a.expiresAt) {
+		return nil, false
+	}
+	return a, true
+}
+
+// tokenAccount returns alive account of alive token. Must be called with s.mu
+// held.
+func (s *Storage) tokenAccount(now time.Time, tkn string) (*account, bool) {
+	t, exists := s.token(now, tkn)
+	if !exists {
+		return nil, false
+	}
+	return s.account(now, t.username)
+}
+
+func (s *Storage) CreateAccount(tkn, username string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if _, exists := s.token(now, tkn); exists {
+		return entity.ErrTokenAlreadyExists
+	}
+	if _, exists := s.account(now, username); exists {
+		return entity.ErrAccountAlreadyExists
+	}
+	s.tokens[tkn] = token{
+		username:  username,
+		expiresAt: expiresAt(now, ttl),
+	}
+	s.accounts[username] = &account{
+		token:     tkn,
+		expiresAt: expiresAt(now, ttl),
+	}
+	return nil
+}
+
+func (s *Storage) ProlongAccount(tkn string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	t, exists := s.token(now, tkn)
+	if !exists {
+		return entity.ErrAccountDoesntExists
+	}
+	t.expiresAt = expiresAt(now, ttl)
+	s.tokens[tkn] = t
+	if a, exists := s.account(now, t.username); exists {
+		a.expiresAt = expiresAt(now, ttl)
+	}
+	return nil
+}
+
+func (s *Storage) Account(tkn string) (entity.Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	t, exists := s.token(now, tkn)
+	if !exists {
+		return entity.Account{}, entity.ErrAccountDoesntExists
+	}
+	a, exists := s.account(now, t.username)
+	if !exists {
+		return entity.Account{}, entity.ErrAccountDoesntExists
+	}
+	ttl := int64(-1)
+	if !t.expiresAt.IsZero() {
+		ttl = t.expiresAt.Sub(now).Milliseconds()
+	}
+	var emails []entity.Email
+	for i := len(a.emails) - 1; i >= 0; i-- {
+		emails = append(emails, a.emails[i])
+	}
+	return entity.Account{
+		Address: t.username,
+		TTL:     ttl,
+		Emails:  emails,
+	}, nil
+}
+
+func (s *Storage) Emails(tkn string) ([]entity.EmailSummary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	a, exists := s.tokenAccount(time.Now(), tkn)
+	if !exists {
+		return nil, entity.ErrAccountDoesntExists
+	}
+	summaries := make([]entity.EmailSummary, 0, len(a.emails))
+	for i := len(a.emails) - 1; i >= 0; i-- {
+		summaries = append(summaries, a.emails[i].Summary())
+	}
+	return summaries, nil
+}
+
+// email returns email of alive account of alive token. Must be called with
+// s.mu held.
+func (s *Storage) email(now time.Time, tkn, id string) (entity.Email, error) {
+	a, exists := s.tokenAccount(now, tkn)
+	if !exists {
+		return entity.Email{}, entity.ErrAccountDoesntExists
+	}
+	for _, email := range a.emails {
+		if email.ID == id {
+			return email, nil
+		}
+	}
+	return entity.Email{}, entity.ErrEmailDoesntExists
+}
+
+func (s *Storage) Email(tkn, id string) (entity.Email, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.email(time.Now(), tkn, id)
+}
+
+func (s *Storage) Attachment(tkn, emailID string, n int) (entity.Attachment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	email, err := s.email(time.Now(), tkn, emailID)
+	if err != nil {
+		return entity.Attachment{}, err
+	}
+	if n < 0 || n >= len(email.Attachments) {
+		return entity.Attachment{}, entity.ErrFileDoesntExists
+	}
+	return email.Attachments[n], nil
+}
+
+func (s *Storage) EmbeddedFile(tkn, emailID string, n int) (entity.EmbeddedFile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	email, err := s.email(time.Now(), tkn, emailID)
+	if err != nil {
+		return entity.EmbeddedFile{}, err
+	}
+	if n < 0 || n >= len(email.EmbeddedFiles) {
+		return entity.EmbeddedFile{}, entity.ErrFileDoesntExists
+	}
+	return email.EmbeddedFiles[n], nil
+}
+
+func (s *Storage) RawEmail(tkn, id string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	email, err := s.email(time.Now(), tkn, id)
+	if err != nil {
+		return nil, err
+	}
+	if email.Raw == nil {
+		return nil, entity.ErrFileDoesntExists
+	}
+	return email.Raw, nil
+}
+
+func (s *Storage) RemoveEmail(tkn, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, exists := s.tokenAccount(time.Now(), tkn)
+	if !exists {
+		return entity.ErrAccountDoesntExists
+	}
+	for i, email := range a.emails {
+		if email.ID == id {
+			a.emails = append(a.emails[:i], a.emails[i+1:]...)
+			a.size -= email.RawSize
+			s.events.Publish(s.tokens[tkn].username, entity.Event{
+				Type:    entity.EventEmailRemoved,
+				EmailID: id,
+			})
+			return nil
+		}
+	}
+	return entity.ErrEmailDoesntExists
+}
+
+func (s *Storage) RemoveAccount(tkn string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, exists := s.token(time.Now(), tkn)
+	if !exists {
+		return entity.ErrAccountDoesntExists
+	}
+	delete(s.accounts, t.username)
+	delete(s.tokens, tkn)
+	s.events.Publish(t.username, entity.Event{Type: entity.EventAccountRemoved})
+	return nil
+}
+
+func (s *Storage) AccountExists(username string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, exists := s.account(time.Now(), username)
+	return exists, nil
+}
+
+// MailboxSize returns total RawSize of account emails, it is zero for
+// nonexistent accounts.
+func (s *Storage) MailboxSize(username string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	a, exists := s.account(time.Now(), username)
+	if !exists {
+		return 0, nil
+	}
+	return a.size, nil
+}
+
+func (s *Storage) AddEmail(username string, email entity.Email, quota int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, exists := s.account(time.Now(), username)
+	if !exists {
+		return entity.ErrAccountDoesntExists
+	}
+	if quota > 0 && a.size+email.RawSize > quota {
+		return entity.ErrMailboxFull
+	}
+	a.emails = append(a.emails, email)
+	a.size += email.RawSize
+	summary := email.Summary()
+	s.events.Publish(username, entity.Event{
+		Type:  entity.EventEmailAdded,
+		Email: &summary,
+	})
+	return nil
+}
+
+func accountInfo(now time.Time, username string, a *account) entity.AccountInfo {
+	ttl := int64(-1)
+	if !a.expiresAt.IsZero() {
+		ttl = a.expiresAt.Sub(now).Milliseconds()
+	}
+	return entity.AccountInfo{
+		Address: username,
+		TTL:     ttl,
+		Emails:  len(a.emails),
+		Size:    a.size,
+	}
+}
+
+// Accounts returns all alive accounts.
+func (s *Storage) Accounts() ([]entity.AccountInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	var infos []entity.AccountInfo
+	for username := range s.accounts {
+		if a, exists := s.account(now, username); exists {
+			infos = append(infos, accountInfo(now, username, a))
+		}
+	}
+	return infos, nil
+}
+
+func (s *Storage) AccountInfo(username string) (entity.AccountInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	a, exists := s.account(now, username)
+	if !exists {
+		return entity.AccountInfo{}, entity.ErrAccountDoesntExists
+	}
+	return accountInfo(now, username, a), nil
+}
+
+// SetAccountTTL sets TTL of account and its token by address.
+func (s *Storage) SetAccountTTL(username string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	a, exists := s.account(now, username)
+	if !exists {
+		return entity.ErrAccountDoesntExists
+	}
+	a.expiresAt = expiresAt(now, ttl)
+	if t, exists := s.tokens[a.token]; exists && t.username == username {
+		t.expiresAt = a.expiresAt
+		s.tokens[a.token] = t
+	}
+	return nil
+}
+
+// ExpireAccount removes account immediately as if its TTL ran out.
+func (s *Storage) ExpireAccount(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, exists := s.account(time.Now(), username)
+	if !exists {
+		return entity.ErrAccountDoesntExists
+	}
+	delete(s.accounts, username)
+	if t, exists := s.tokens[a.token]; exists && t.username == username {
+		delete(s.tokens, a.token)
+	}
+	s.events.Publish(username, entity.Event{Type: entity.EventAccountExpired})
+	return nil
+}
+
+// RemoveEmailsBySender removes emails sent by sender from all accounts and
+// returns their number.
+func (s *Storage) RemoveEmailsBySender(sender string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for username := range s.accounts {
+		a, exists := s.account(now, username)
+		if !exists {
+			continue
+		}
+		kept := a.emails[:0]
+		for _, email := range a.emails {
+			if !email.SentBy(sender) {
+				kept = append(kept, email)
+				continue
+			}
+			a.size -= email.RawSize
+			removed++
+			s.events.Publish(username, entity.Event{
+				Type:    entity.EventEmailRemoved,
+				EmailID: email.ID,
+			})
+		}
+		a.emails = kept
+	}
+	return removed, nil
+}
+
+// IncrCounter increments counter of key and returns its value. Counter expires
+// in ttl after the first increment.
+func (s *Storage) IncrCounter(key string, ttl time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	c, exists := s.counters[key]
+	if !exists || expired(now, c.expiresAt) {
+		c = counter{expiresAt: expiresAt(now, ttl)}
+	}
+	c.n++
+	s.counters[key] = c
+	return c.n, nil
+}
+
+// DecrCounter decrements counter of key unless it is expired or zero.
+func (s *Storage) DecrCounter(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, exists := s.counters[key]
+	if !exists || expired(time.Now(), c.expiresAt) || c.n == 0 {
+		return nil
+	}
+	c.n--
+	s.counters[key] = c
+	return nil
+}
+
+func (s *Storage) CreateAPIKey(k entity.APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.apiKeys[k.ID]; exists {
+		return entity.ErrAPIKeyAlreadyExists
+	}
+	s.apiKeys[k.ID] = k
+	return nil
+}
+
+func (s *Storage) APIKey(id string) (entity.APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	k, exists := s.apiKeys[id]
+	if !exists {
+		return entity.APIKey{}, entity.ErrAPIKeyDoesntExists
+	}
+	return k, nil
+}
+
+func (s *Storage) APIKeys() ([]entity.APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]entity.APIKey, 0, len(s.apiKeys))
+	for _, k := range s.apiKeys {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (s *Storage) RemoveAPIKey(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.apiKeys[id]; !exists {
+		return entity.ErrAPIKeyDoesntExists
+	}
+	delete(s.apiKeys, id)
+	return nil
+}
+
+func (s *Storage) TouchAPIKey(id string, lastUsedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, exists := s.apiKeys[id]
+	if !exists {
+		return entity.ErrAPIKeyDoesntExists
+	}
+	k.LastUsedAt = lastUsedAt
+	s.apiKeys[id] = k
+	return nil
+}
+
+func (s *Storage) Subscribe(ctx context.Context, tkn string) (<-chan entity.Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, exists := s.token(time.Now(), tkn)
+	if !exists {
+		return nil, entity.ErrAccountDoesntExists
+	}
+	return s.events.Subscribe(ctx, t.username), nil
+}
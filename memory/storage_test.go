@@ -0,0 +1,16 @@
+package memory_test
+
+import (
+	"testing"
+
+	"tmpmail/memory"
+	"tmpmail/storagetest"
+)
+
+func TestStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		s := memory.NewStorage()
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
@@ -0,0 +1,50 @@
+// Package pow implements hashcash-like proof of work. Solution of a challenge
+// is a nonce such that SHA-256 of "challenge:nonce" has at least difficulty
+// leading zero bits.
+package pow
+
+import (
+	"context"
+	"crypto/sha256"
+	"math/bits"
+	"strconv"
+)
+
+// MaxDifficulty is a max number of leading zero bits of SHA-256 hash.
+const MaxDifficulty = sha256.Size * 8
+
+// checkCtxEvery is a number of attempts between checks of context done.
+const checkCtxEvery = 1 << 12
+
+// Check reports whether nonce solves challenge with difficulty.
+func Check(challenge, nonce string, difficulty int) bool {
+	h := sha256.Sum256([]byte(challenge + ":" + nonce))
+	return leadingZeros(h[:]) >= difficulty
+}
+
+func leadingZeros(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c != 0 {
+			return n + bits.LeadingZeros8(c)
+		}
+		n += 8
+	}
+	return n
+}
+
+// Solve finds nonce solving challenge with difficulty. It takes about
+// 2^difficulty hashes.
+func Solve(ctx context.Context, challenge string, difficulty int) (string, error) {
+	for i := uint64(0); ; i++ {
+		if i%checkCtxEvery == 0 {
+			if err := ctx.Err(); err != nil {
+				return "", err
+			}
+		}
+		nonce := strconv.FormatUint(i, 10)
+		if Check(challenge, nonce, difficulty) {
+			return nonce, nil
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package pow
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSolve(t *testing.T) {
+	for _, difficulty := range []int{0, 1, 8, 12} {
+		nonce, err := Solve(context.Background(), "challenge", difficulty)
+		if err != nil {
+			t.Fatalf("Solve(%d) error = %v", difficulty, err)
+		}
+		if !Check("challenge", nonce, difficulty) {
+			t.Errorf("Check() of Solve(%d) nonce %s = false", difficulty, nonce)
+		}
+		// Nonce is bound to challenge.
+		if difficulty >= 8 && Check("other", nonce, difficulty) {
+			t.Errorf("Check() of other challenge with Solve(%d) nonce %s = true", difficulty, nonce)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Solve(ctx, "challenge", MaxDifficulty); !errors.Is(err, context.Canceled) {
+		t.Errorf("Solve() with cancelled context error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestLeadingZeros(t *testing.T) {
+	tests := []struct {
+		b    []byte
+		want int
+	}{
+		{b: []byte{0x80}, want: 0},
+		{b: []byte{0x01}, want: 7},
+		{b: []byte{0x00, 0x40}, want: 9},
+		{b: []byte{0x00, 0x00}, want: 16},
+	}
+	for _, tt := range tests {
+		if got := leadingZeros(tt.b); got != tt.want {
+			t.Errorf("leadingZeros(%x) = %d, want %d", tt.b, got, tt.want)
+		}
+	}
+}
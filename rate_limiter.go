@@ -0,0 +1,167 @@
+package tmpmail
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter is a token bucket rate limiter of keys like client IPs.
+type RateLimiter interface {
+	// Tokens returns number of tokens available to key now.
+	Tokens(key string) (float64, error)
+	// AllowN takes n tokens of key if they are available.
+	AllowN(key string, n int) (bool, error)
+	// ReturnN gives back n tokens taken by AllowN, e.g. when another limit
+	// refused the action. Buckets don't grow above burst.
+	ReturnN(key string, n int) error
+}
+
+// RateLimiterFactory creates rate limiter of r tokens per second with burst b.
+// Name distinguishes limiters sharing the same backend.
+type RateLimiterFactory func(name string, r rate.Limit, b int) RateLimiter
+
+func newRateLimiter(f RateLimiterFactory, name string, r rate.Limit, b int) RateLimiter {
+	if f == nil {
+		return newIPRateLimiter(r, b)
+	}
+	return f(name, r, b)
+}
+
+// maxRateLimiterKeys bounds memory of ipRateLimiter, least recently used keys
+// are evicted above it.
+const maxRateLimiterKeys = 100000
+
+// tokenBucket has tokens at time ts. It is refilled lazily like buckets of
+// redis.RateLimiter, so both limiters behave the same.
+type tokenBucket struct {
+	tokens float64
+	ts     time.Time
+}
+
+type limiterEntry struct {
+	key      string
+	bucket   *tokenBucket
+	lastUsed time.Time
+}
+
+// ipRateLimiter keeps token buckets in process memory. Keys idle for time of
+// full bucket refill are evicted since their fresh buckets are the same.
+type ipRateLimiter struct {
+	mu   sync.Mutex
+	keys map[string]*list.Element
+	// lru has limiterEntry elements, the most recently used first.
+	lru     *list.List
+	r       rate.Limit
+	b       int
+	maxIdle time.Duration
+	maxKeys int
+}
+
+func newIPRateLimiter(r rate.Limit, b int) *ipRateLimiter {
+	var maxIdle time.Duration
+	if r > 0 && r != rate.Inf {
+		maxIdle = time.Duration(float64(b) / float64(r) * float64(time.Second))
+	}
+	return &ipRateLimiter{
+		keys:    map[string]*list.Element{},
+		lru:     list.New(),
+		r:       r,
+		b:       b,
+		maxIdle: maxIdle,
+		maxKeys: maxRateLimiterKeys,
+	}
+}
+
+// bucket returns refilled bucket of key and evicts stale keys. Must be called
+// with i.mu held.
+func (i *ipRateLimiter) bucket(now time.Time, key string) *tokenBucket {
+	if e, exists := i.keys[key]; exists {
+		le := e.Value.(*limiterEntry)
+		le.lastUsed = now
+		i.lru.MoveToFront(e)
+		if now.After(le.bucket.ts) {
+			refilled := le.bucket.tokens + now.Sub(le.bucket.ts).Seconds()*float64(i.r)
+			le.bucket.tokens = math.Min(float64(i.b), refilled)
+			le.bucket.ts = now
+		}
+		return le.bucket
+	}
+
+	le := &limiterEntry{
+		key:      key,
+		bucket:   &tokenBucket{tokens: float64(i.b), ts: now},
+		lastUsed: now,
+	}
+	i.keys[key] = i.lru.PushFront(le)
+
+	for e := i.lru.Back(); e != nil; e = i.lru.Back() {
+		old := e.Value.(*limiterEntry)
+		idle := i.maxIdle > 0 && now.Sub(old.lastUsed) >= i.maxIdle
+		if !idle && i.lru.Len() <= i.maxKeys {
+			break
+		}
+		i.lru.Remove(e)
+		delete(i.keys, old.key)
+	}
+	return le.bucket
+}
+
+func (i *ipRateLimiter) Tokens(key string) (float64, error) {
+	if i.r == rate.Inf {
+		return float64(i.b), nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.bucket(time.Now(), key).tokens, nil
+}
+
+func (i *ipRateLimiter) AllowN(key string, n int) (bool, error) {
+	if i.r == rate.Inf || n <= 0 {
+		return true, nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	b := i.bucket(time.Now(), key)
+	if b.tokens < float64(n) {
+		return false, nil
+	}
+	b.tokens -= float64(n)
+	return true, nil
+}
+
+func (i *ipRateLimiter) ReturnN(key string, n int) error {
+	if i.r == rate.Inf || n <= 0 {
+		return nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	b := i.bucket(time.Now(), key)
+	b.tokens = math.Min(float64(i.b), b.tokens+float64(n))
+	return nil
+}
+
+// ipv6KeyPrefix is a length of IPv6 prefix used as rate limiter key, since one
+// client usually gets the whole /64 network.
+const ipv6KeyPrefix = 64
+
+// ipKey returns rate limiter key of ip: IPv4 address or IPv6 /64 network.
+// Unparsable ip is returned as is.
+func ipKey(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if ip4 := parsed.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	n := net.IPNet{IP: parsed.Mask(net.CIDRMask(ipv6KeyPrefix, 128)), Mask: net.CIDRMask(ipv6KeyPrefix, 128)}
+	return n.String()
+}
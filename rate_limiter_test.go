@@ -0,0 +1,117 @@
+package tmpmail
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestIPRateLimiter(t *testing.T) {
+	l := newIPRateLimiter(rate.Every(time.Hour), 3)
+
+	if ok, _ := l.AllowN("a", 2); !ok {
+		t.Fatal("AllowN(2) of full bucket = false")
+	}
+	if ok, _ := l.AllowN("a", 2); ok {
+		t.Error("AllowN(2) with 1 token left = true")
+	}
+	if ok, _ := l.AllowN("b", 3); !ok {
+		t.Error("AllowN(3) of other key = false")
+	}
+	if err := l.ReturnN("a", 5); err != nil {
+		t.Fatal(err)
+	}
+	if tokens, _ := l.Tokens("a"); int(tokens) != 3 {
+		t.Errorf("Tokens() after ReturnN = %v, want burst 3", tokens)
+	}
+}
+
+func TestIPRateLimiterConcurrent(t *testing.T) {
+	l := newIPRateLimiter(rate.Every(time.Hour), 10)
+
+	var (
+		wg      sync.WaitGroup
+		allowed int32
+	)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := l.AllowN("a", 1); ok {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 10 {
+		t.Errorf("%d of concurrent AllowN() were allowed, want burst 10", allowed)
+	}
+}
+
+func TestSMTPRateLimitersAllow(t *testing.T) {
+	ls := newSMTPRateLimiters(SMTPRateLimits{
+		IP:      SMTPRateLimit{Interval: time.Hour, Burst: 1},
+		Sender:  SMTPRateLimit{Interval: time.Hour, Burst: 5},
+		Mailbox: SMTPRateLimit{Interval: time.Hour, Burst: 1},
+	}, nil)
+
+	if _, ok, _ := ls.allowRcpt("example.com", "a@tmpmail.test"); !ok {
+		t.Fatal("allowRcpt() of full buckets = false")
+	}
+	kind, ok, err := ls.allowRcpt("example.com", "a@tmpmail.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || kind != rateLimitMailbox {
+		t.Errorf("allowRcpt() of exhausted mailbox = %q, %v, want %q, false", kind, ok, rateLimitMailbox)
+	}
+	if tokens, _ := ls.sender.Tokens("example.com"); int(tokens) != 4 {
+		t.Errorf("sender tokens after refused recipient = %v, want 4", tokens)
+	}
+
+	// Recipients of message refused by IP limit are given back.
+	if _, ok, _ := ls.allowMessage("192.0.2.1", "example.com", []string{"a@tmpmail.test"}); !ok {
+		t.Fatal("allowMessage() of full bucket = false")
+	}
+	if _, ok, _ := ls.allowRcpt("example.com", "b@tmpmail.test"); !ok {
+		t.Fatal("allowRcpt() of other mailbox = false")
+	}
+	kind, ok, err = ls.allowMessage("192.0.2.1", "example.com", []string{"b@tmpmail.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || kind != rateLimitIP {
+		t.Errorf("allowMessage() of exhausted IP = %q, %v, want %q, false", kind, ok, rateLimitIP)
+	}
+	if tokens, _ := ls.sender.Tokens("example.com"); int(tokens) != 4 {
+		t.Errorf("sender tokens after refused message = %v, want 4", tokens)
+	}
+	if tokens, _ := ls.mailbox.Tokens("b@tmpmail.test"); int(tokens) != 1 {
+		t.Errorf("mailbox tokens after refused message = %v, want 1", tokens)
+	}
+
+	// Concurrent recipients can't overrun sender limit.
+	var (
+		wg      sync.WaitGroup
+		allowed int32
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, ok, _ := ls.allowRcpt("example.org", fmt.Sprintf("u%d@tmpmail.test", i)); ok {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if allowed != 5 {
+		t.Errorf("%d of concurrent recipients were allowed, want sender burst 5", allowed)
+	}
+}
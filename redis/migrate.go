@@ -0,0 +1,186 @@
+package redis
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"tmpmail/entity"
+)
+
+// legacyAccountKeyPrefix is a prefix of accounts of the first version. They
+// are lists of emails JSONs from newest to oldest ending with sentinel.
+const legacyAccountKeyPrefix = "accs/"
+
+// legacyFile is an attachment or embedded file of the first version which
+// was kept in email JSON.
+type legacyFile struct {
+	Filename    string `json:"filename,omitempty"`
+	CID         string `json:"cid,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Data        []byte `json:"data,omitempty"`
+}
+
+type legacyEmail struct {
+	entity.Email
+	Attachments   []legacyFile `json:"attachments,omitempty"`
+	EmbeddedFiles []legacyFile `json:"embeddedFiles,omitempty"`
+}
+
+func fileHash(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// convertAccountScript creates account hash KEYS[2] with TTL of legacy
+// account list KEYS[1] and removes the list. Nothing is done if list is gone
+// or hash already exists. ARGV are hash fields and values.
+var convertAccountScript = redis.NewScript(`
+if redis.call("TYPE", KEYS[1]).ok ~= "list" or redis.call("EXISTS", KEYS[2]) == 1 then
+	return 0
+end
+local ttl = redis.call("PTTL", KEYS[1])
+redis.call("HSET", KEYS[2], unpack(ARGV))
+if ttl > 0 then
+	redis.call("PEXPIRE", KEYS[2], ttl)
+end
+redis.call("DEL", KEYS[1])
+return 1
+`)
+
+// convertAccount moves legacy account list of username to its account hash.
+// Emails get IDs ordered as in the list and older than new emails.
+func (s *Storage) convertAccount(username string) (bool, error) {
+	ctx := context.Background()
+	emailJSONs, err := s.redis.LRange(ctx, legacyAccountKeyPrefix+username, 0, -1).Result()
+	if err != nil {
+		return false, fmt.Errorf("lrange legacy account: %w", err)
+	}
+
+	args := []interface{}{accountSentinel, "", mailboxSizeField, 0}
+	now := time.Now().UnixNano()
+	for i, emailJSON := range emailJSONs {
+		if emailJSON == accountSentinel {
+			continue
+		}
+		var le legacyEmail
+		if err = json.Unmarshal([]byte(emailJSON), &le); err != nil {
+			return false, fmt.Errorf("json unmarshal legacy email: %w", err)
+		}
+		email := le.Email
+		email.ID = fmt.Sprintf("%016x%04d", now, len(emailJSONs)-i)
+		for n, f := range le.Attachments {
+			email.Attachments = append(email.Attachments, entity.Attachment{
+				Filename:    f.Filename,
+				ContentType: f.ContentType,
+				Size:        len(f.Data),
+				SHA256:      fileHash(f.Data),
+			})
+			args = append(args, attachmentField(email.ID, n), f.Data)
+		}
+		for n, f := range le.EmbeddedFiles {
+			email.EmbeddedFiles = append(email.EmbeddedFiles, entity.EmbeddedFile{
+				CID:         f.CID,
+				ContentType: f.ContentType,
+				Size:        len(f.Data),
+				SHA256:      fileHash(f.Data),
+			})
+			args = append(args, embeddedFileField(email.ID, n), f.Data)
+		}
+		data, err := json.Marshal(email)
+		if err != nil {
+			return false, fmt.Errorf("json marshal email: %w", err)
+		}
+		args = append(args, email.ID, data)
+	}
+
+	converted, err := convertAccountScript.Run(ctx, s.redis,
+		[]string{legacyAccountKeyPrefix + username, accountKey(username)}, args...).Int()
+	if err != nil {
+		return false, fmt.Errorf("run convert account script: %w", err)
+	}
+	return converted == 1, nil
+}
+
+// schemaVersionKey keeps version of the last migration applied to keyspace,
+// so migrations scan it only once.
+const schemaVersionKey = "schm/version"
+
+// Schema versions set by migrations.
+const (
+	schemaAccountHashes  = 1
+	schemaAccountDomains = 2
+)
+
+// setSchemaVersionScript sets schema version KEYS[1] to ARGV[1] unless it is
+// newer already.
+var setSchemaVersionScript = redis.NewScript(`
+local v = tonumber(redis.call("GET", KEYS[1]) or "0")
+if v < tonumber(ARGV[1]) then
+	redis.call("SET", KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// migrate runs fn unless keyspace has schema version v already and sets v
+// once fn succeeds. Concurrently started instances may both run fn, so
+// migrations must be idempotent.
+func (s *Storage) migrate(v int, fn func(ctx context.Context) (int, error)) (int, error) {
+	ctx := context.Background()
+	current, err := s.redis.Get(ctx, schemaVersionKey).Int()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, fmt.Errorf("get schema version: %w", err)
+	}
+	if current >= v {
+		return 0, nil
+	}
+	n, err := fn(ctx)
+	if err != nil {
+		return n, err
+	}
+	if err = setSchemaVersionScript.Run(ctx, s.redis, []string{schemaVersionKey}, v).Err(); err != nil {
+		return n, fmt.Errorf("run set schema version script: %w", err)
+	}
+	return n, nil
+}
+
+func scanKeys(ctx context.Context, c *redis.Client, prefix string, fn func(key string) error) error {
+	it := c.Scan(ctx, 0, prefix+"*", 1000).Iterator()
+	for it.Next(ctx) {
+		if err := fn(it.Val()); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return fmt.Errorf("scan %s keys: %w", prefix, err)
+	}
+	return nil
+}
+
+// MigrateLegacyAccounts converts email lists of the first version to account
+// hashes keyed by the same username. It returns number of converted accounts
+// and is a no-op once storage is converted.
+func (s *Storage) MigrateLegacyAccounts() (int, error) {
+	return s.migrate(schemaAccountHashes, func(ctx context.Context) (int, error) {
+		migrated := 0
+		err := scanKeys(ctx, s.redis, legacyAccountKeyPrefix, func(key string) error {
+			username := strings.TrimPrefix(key, legacyAccountKeyPrefix)
+			converted, err := s.convertAccount(username)
+			if err != nil {
+				return fmt.Errorf("convert account %s: %w", username, err)
+			}
+			if converted {
+				migrated++
+			}
+			return nil
+		})
+		return migrated, err
+	})
+}
@@ -0,0 +1,83 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// convertTokenScript sets username of token KEYS[1] to ARGV[2] keeping its
+// TTL if it is still ARGV[1], and stores token ARGV[3] in account hash
+// KEYS[2] under tokenField for admin API.
+var convertTokenScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl > 0 then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ttl)
+else
+	redis.call("SET", KEYS[1], ARGV[2])
+end
+if redis.call("TYPE", KEYS[2]).ok == "hash" then
+	redis.call("HSET", KEYS[2], ARGV[4], ARGV[3])
+end
+return 1
+`)
+
+// MigrateAccountDomains re-keys accounts and tokens of versions before
+// multiple domains, whose usernames have no domain, to addresses of domain.
+// It returns number of re-keyed accounts and is a no-op once storage is
+// migrated.
+func (s *Storage) MigrateAccountDomains(domain string) (int, error) {
+	return s.migrate(schemaAccountDomains, func(ctx context.Context) (int, error) {
+		return s.migrateAccountDomains(ctx, domain)
+	})
+}
+
+func (s *Storage) migrateAccountDomains(ctx context.Context, domain string) (int, error) {
+	migrated := 0
+
+	err := scanKeys(ctx, s.redis, accountKeyPrefix, func(key string) error {
+		username := strings.TrimPrefix(key, accountKeyPrefix)
+		if strings.Contains(username, "@") {
+			return nil
+		}
+		renamed, err := s.redis.RenameNX(ctx, key, accountKey(username+"@"+domain)).Result()
+		if err != nil {
+			return fmt.Errorf("rename account %s: %w", username, err)
+		}
+		if renamed {
+			migrated++
+		}
+		return nil
+	})
+	if err != nil {
+		return migrated, err
+	}
+
+	err = scanKeys(ctx, s.redis, tokenKey(""), func(key string) error {
+		username, err := s.redis.Get(ctx, key).Result()
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				return nil
+			}
+			return fmt.Errorf("get token username: %w", err)
+		}
+		if strings.Contains(username, "@") {
+			return nil
+		}
+		address := username + "@" + domain
+		token := strings.TrimPrefix(key, tokenKey(""))
+		_, err = convertTokenScript.Run(ctx, s.redis, []string{key, accountKey(address)},
+			username, address, token, tokenField).Result()
+		if err != nil {
+			return fmt.Errorf("run convert token script: %w", err)
+		}
+		return nil
+	})
+	return migrated, err
+}
@@ -0,0 +1,115 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/time/rate"
+)
+
+func rateLimiterKey(name, key string) string {
+	return "rl/" + name + "/" + key
+}
+
+// tokenBucketScript refills token bucket of KEYS[1] by ARGV[1] tokens per
+// millisecond up to ARGV[2] tokens at time ARGV[3] and takes ARGV[4] tokens if
+// they are available. Zero ARGV[4] only reads the bucket, negative one gives
+// tokens back up to ARGV[2]. It returns whether tokens were taken and tokens
+// left as string, since Redis truncates Lua numbers to integers. Buckets
+// expire when they are full again.
+var tokenBucketScript = redis.NewScript(`
+local r = tonumber(ARGV[1])
+local b = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+
+local bucket = redis.call("HMGET", KEYS[1], "t", "ts")
+local t = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if t == nil or ts == nil then
+	t = b
+	ts = now
+end
+if now > ts then
+	t = math.min(b, t + (now - ts) * r)
+	ts = now
+end
+
+if n == 0 or t < n then
+	return {0, tostring(t)}
+end
+t = math.min(b, t - n)
+redis.call("HSET", KEYS[1], "t", tostring(t), "ts", ts)
+redis.call("PEXPIRE", KEYS[1], math.ceil((b - t) / r) + 1)
+return {1, tostring(t)}
+`)
+
+// RateLimiter is a token bucket rate limiter shared by all instances.
+type RateLimiter struct {
+	redis *redis.Client
+	name  string
+	// perMs is a number of tokens added per millisecond.
+	perMs float64
+	burst int
+}
+
+// NewRateLimiter creates rate limiter of r tokens per second with burst b.
+// Limiters with the same name share buckets.
+func (s *Storage) NewRateLimiter(name string, r rate.Limit, b int) *RateLimiter {
+	return &RateLimiter{
+		redis: s.redis,
+		name:  name,
+		perMs: float64(r) / 1000,
+		burst: b,
+	}
+}
+
+func (l *RateLimiter) run(key string, n int) (bool, float64, error) {
+	if math.IsInf(l.perMs, 1) {
+		return true, float64(l.burst), nil
+	}
+	res, err := tokenBucketScript.Run(context.Background(), l.redis,
+		[]string{rateLimiterKey(l.name, key)},
+		l.perMs, l.burst, time.Now().UnixMilli(), n).Slice()
+	if err != nil {
+		return false, 0, fmt.Errorf("run token bucket script: %w", err)
+	}
+	if len(res) != 2 {
+		return false, 0, fmt.Errorf("unexpected token bucket script result: %v", res)
+	}
+	taken, _ := res[0].(int64)
+	tokensStr, _ := res[1].(string)
+	tokens, err := strconv.ParseFloat(tokensStr, 64)
+	if err != nil {
+		return false, 0, fmt.Errorf("parse tokens: %w", err)
+	}
+	return taken == 1, tokens, nil
+}
+
+// Tokens returns number of tokens available to key now.
+func (l *RateLimiter) Tokens(key string) (float64, error) {
+	_, tokens, err := l.run(key, 0)
+	return tokens, err
+}
+
+// AllowN takes n tokens of key if they are available.
+func (l *RateLimiter) AllowN(key string, n int) (bool, error) {
+	if n <= 0 {
+		return true, nil
+	}
+	taken, _, err := l.run(key, n)
+	return taken, err
+}
+
+// ReturnN gives back n tokens taken by AllowN, buckets don't grow above burst.
+func (l *RateLimiter) ReturnN(key string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	_, _, err := l.run(key, -n)
+	return err
+}
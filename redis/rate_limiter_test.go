@@ -0,0 +1,33 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestRateLimiter(t *testing.T) {
+	s, _ := newTestStorage(t)
+	l := s.NewRateLimiter("test", rate.Every(time.Hour), 3)
+	other := s.NewRateLimiter("other", rate.Every(time.Hour), 3)
+
+	if ok, err := l.AllowN("a", 2); err != nil || !ok {
+		t.Fatalf("AllowN(2) of full bucket = %v, %v, want true", ok, err)
+	}
+	if ok, _ := l.AllowN("a", 2); ok {
+		t.Error("AllowN(2) with 1 token left = true")
+	}
+	if tokens, _ := other.Tokens("a"); int(tokens) != 3 {
+		t.Errorf("Tokens() of other limiter = %v, want 3", tokens)
+	}
+	if err := l.ReturnN("a", 5); err != nil {
+		t.Fatalf("ReturnN() error = %v", err)
+	}
+	if tokens, _ := l.Tokens("a"); int(tokens) != 3 {
+		t.Errorf("Tokens() after ReturnN = %v, want burst 3", tokens)
+	}
+	if ok, _ := l.AllowN("a", 3); !ok {
+		t.Error("AllowN(3) after ReturnN = false")
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -32,51 +35,134 @@ func tokenKey(token string) string {
 	return "tkns/" + token
 }
 
+func counterKey(key string) string {
+	return "cntr/" + key
+}
+
+// apiKeyKey is a hash of API key JSON under apiKeyField and last use Unix
+// time in milliseconds under apiKeyLastUsedField, so uses don't rewrite JSON.
+func apiKeyKey(id string) string {
+	return apiKeyKeyPrefix + id
+}
+
+const (
+	apiKeyKeyPrefix     = "apik/"
+	apiKeyField         = "key"
+	apiKeyLastUsedField = "lastUsed"
+)
+
+// accountKey is a hash of account emails JSONs keyed by email ID. Email IDs
+// are time ordered. Attachments, embedded files data and raw emails are kept
+// in the same hash under fields from attachmentField, embeddedFileField and
+// rawEmailField, mailbox size is kept under mailboxSizeField and account token
+// under tokenField.
 func accountKey(username string) string {
-	return "accs/" + username
+	return accountKeyPrefix + username
 }
 
-func (s *Storage) CreateAccount(token, username string, ttl time.Duration) error {
-	tKey := tokenKey(token)
-	exists, err := s.redis.Exists(context.Background(), tKey).Result()
+const accountKeyPrefix = "mbxs/"
+
+// eventsChannel is a pub/sub channel of account events shared by all
+// instances.
+func eventsChannel(username string) string {
+	return "evts/" + username
+}
+
+// keyspaceChannel gets account key notifications if Redis has
+// notify-keyspace-events including "Kx", it is used for account expiry
+// events.
+func (s *Storage) keyspaceChannel(username string) string {
+	return fmt.Sprintf("__keyspace@%d__:%s", s.redis.Options().DB, accountKey(username))
+}
+
+func (s *Storage) publish(username string, e entity.Event) error {
+	eventJSON, err := json.Marshal(e)
 	if err != nil {
-		return fmt.Errorf("check token exists: %w", err)
-	}
-	if exists == 1 {
-		return fmt.Errorf("token already exists")
+		return fmt.Errorf("json marshal event: %w", err)
 	}
-	_, err = s.redis.Set(context.Background(), tKey, username, ttl).Result()
+	err = s.redis.Publish(context.Background(), eventsChannel(username), eventJSON).Err()
 	if err != nil {
-		return fmt.Errorf("set token")
+		return fmt.Errorf("publish event: %w", err)
 	}
-	aKey := accountKey(username)
-	exists, err = s.redis.Exists(context.Background(), aKey).Result()
+	return nil
+}
+
+func attachmentField(emailID string, n int) string {
+	return emailID + "/a/" + strconv.Itoa(n)
+}
+
+func embeddedFileField(emailID string, n int) string {
+	return emailID + "/e/" + strconv.Itoa(n)
+}
+
+func rawEmailField(emailID string) string {
+	return emailID + "/raw"
+}
+
+// mailboxSizeField is a hash field of total RawSize of account emails.
+const mailboxSizeField = "/size"
+
+// tokenField is a hash field of account token used by admin to prolong
+// account by address. Accounts created by older versions don't have it.
+const tokenField = "/token"
+
+func isEmailField(field string) bool {
+	return field != accountSentinel && !strings.Contains(field, "/")
+}
+
+// accountSentinel is a hash field which keeps empty account existing.
+const accountSentinel = "-"
+
+// createAccountScript sets token and account keys with the same TTL only if
+// neither of them exists.
+var createAccountScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 1
+end
+if redis.call("EXISTS", KEYS[2]) == 1 then
+	return 2
+end
+local ttl = tonumber(ARGV[2])
+if ttl > 0 then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ttl)
+else
+	redis.call("SET", KEYS[1], ARGV[1])
+end
+redis.call("HSET", KEYS[2], ARGV[3], "", ARGV[4], ARGV[5])
+if ttl > 0 then
+	redis.call("PEXPIRE", KEYS[2], ttl)
+end
+return 0
+`)
+
+func (s *Storage) CreateAccount(token, username string, ttl time.Duration) error {
+	res, err := createAccountScript.Run(context.Background(), s.redis,
+		[]string{tokenKey(token), accountKey(username)},
+		username, ttl.Milliseconds(), accountSentinel, tokenField, token).Int()
 	if err != nil {
-		return fmt.Errorf("check account exists: %w", err)
+		return fmt.Errorf("run create account script: %w", err)
 	}
-	if exists == 1 {
-		return fmt.Errorf("account already exists")
-	}
-	_, err = s.redis.LPush(context.Background(), aKey, "-").Result()
-	if err != nil {
-		return fmt.Errorf("lpush account: %w", err)
-	}
-	_, err = s.redis.Expire(context.Background(), aKey, ttl).Result()
-	if err != nil {
-		return fmt.Errorf("expire account: %w", err)
+	switch res {
+	case 1:
+		return entity.ErrTokenAlreadyExists
+	case 2:
+		return entity.ErrAccountAlreadyExists
 	}
 	return nil
 }
 
 func (s *Storage) ProlongAccount(token string, ttl time.Duration) error {
 	tKey := tokenKey(token)
-	_, err := s.redis.Expire(context.Background(), tKey, ttl).Result()
+	ok, err := s.redis.Expire(context.Background(), tKey, ttl).Result()
 	if err != nil {
 		return fmt.Errorf("expire token: %w", err)
 	}
-	username, err := s.redis.Get(context.Background(), tKey).Result()
+	if !ok {
+		return entity.ErrAccountDoesntExists
+	}
+	username, err := s.tokenUsername(token)
 	if err != nil {
-		return fmt.Errorf("get token username: %w", err)
+		return err
 	}
 	_, err = s.redis.Expire(context.Background(), accountKey(username), ttl).Result()
 	if err != nil {
@@ -85,71 +171,259 @@ func (s *Storage) ProlongAccount(token string, ttl time.Duration) error {
 	return err
 }
 
-func (s *Storage) Account(token string) (entity.Account, error) {
-	tKey := tokenKey(token)
-	username, err := s.redis.Get(context.Background(), tKey).Result()
+func (s *Storage) tokenUsername(token string) (string, error) {
+	username, err := s.redis.Get(context.Background(), tokenKey(token)).Result()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
-			return entity.Account{}, entity.ErrAccountDoesntExists
+			return "", entity.ErrAccountDoesntExists
 		}
-		return entity.Account{}, fmt.Errorf("get token username: %w", err)
+		return "", fmt.Errorf("get token username: %w", err)
 	}
-	ttl, err := s.redis.TTL(context.Background(), tKey).Result()
+	return username, nil
+}
+
+// isWrongType reports whether err is a reply to command on key of another
+// type, e.g. on account of older version which isn't migrated yet.
+func isWrongType(err error) bool {
+	return strings.HasPrefix(err.Error(), "WRONGTYPE")
+}
+
+// accountEmails returns account emails from newest to oldest. Keys which
+// aren't account hashes are treated as missing accounts.
+func (s *Storage) accountEmails(username string) ([]entity.Email, error) {
+	aKey := accountKey(username)
+	fields, err := s.redis.HKeys(context.Background(), aKey).Result()
 	if err != nil {
-		return entity.Account{}, fmt.Errorf("account ttl: %w", err)
+		if isWrongType(err) {
+			return nil, entity.ErrAccountDoesntExists
+		}
+		return nil, fmt.Errorf("hkeys account: %w", err)
 	}
-	if ttl == 0 {
-		return entity.Account{}, entity.ErrAccountDoesntExists
+	if len(fields) == 0 {
+		return nil, entity.ErrAccountDoesntExists
 	}
-	aKey := accountKey(username)
-	emailLen, err := s.redis.LLen(context.Background(), aKey).Result()
-	if err != nil {
-		return entity.Account{}, fmt.Errorf("llen account: %w", err)
+	var ids []string
+	for _, field := range fields {
+		if isEmailField(field) {
+			ids = append(ids, field)
+		}
 	}
-	if emailLen == 0 {
-		return entity.Account{}, entity.ErrAccountDoesntExists
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	emailJSONs, err := s.redis.HMGet(context.Background(), aKey, ids...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("hmget account emails: %w", err)
 	}
 	var emails []entity.Email
-	if emailLen > 1 {
-		emailJSONs, err := s.redis.LRange(context.Background(), aKey, 0, emailLen-2).Result()
-		if err != nil {
-			return entity.Account{}, fmt.Errorf("lrange account: %w", err)
+	for _, emailJSON := range emailJSONs {
+		// Email removed between HKEYS and HMGET.
+		emailJSON, ok := emailJSON.(string)
+		if !ok {
+			continue
 		}
-		for _, emailJSON := range emailJSONs {
-			var email entity.Email
-			err := json.Unmarshal([]byte(emailJSON), &email)
-			if err != nil {
-				return entity.Account{}, fmt.Errorf("json unmarshal email json: %w", err)
-			}
-			emails = append(emails, email)
+		var email entity.Email
+		err := json.Unmarshal([]byte(emailJSON), &email)
+		if err != nil {
+			return nil, fmt.Errorf("json unmarshal email json: %w", err)
 		}
+		emails = append(emails, email)
+	}
+	sort.Slice(emails, func(i, j int) bool {
+		return emails[i].ID > emails[j].ID
+	})
+	return emails, nil
+}
+
+func (s *Storage) Account(token string) (entity.Account, error) {
+	username, err := s.tokenUsername(token)
+	if err != nil {
+		return entity.Account{}, err
+	}
+	ttl, err := s.redis.TTL(context.Background(), tokenKey(token)).Result()
+	if err != nil {
+		return entity.Account{}, fmt.Errorf("account ttl: %w", err)
+	}
+	if ttl == 0 {
+		return entity.Account{}, entity.ErrAccountDoesntExists
+	}
+	emails, err := s.accountEmails(username)
+	if err != nil {
+		return entity.Account{}, err
 	}
 	return entity.Account{
-		Username: username,
-		TTL:      ttl.Milliseconds(),
-		Emails:   emails,
+		Address: username,
+		TTL:     ttl.Milliseconds(),
+		Emails:  emails,
 	}, nil
 }
 
-func (s *Storage) RemoveAccount(token string) error {
-	tKey := tokenKey(token)
-	username, err := s.redis.Get(context.Background(), tKey).Result()
+func (s *Storage) Emails(token string) ([]entity.EmailSummary, error) {
+	username, err := s.tokenUsername(token)
+	if err != nil {
+		return nil, err
+	}
+	emails, err := s.accountEmails(username)
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]entity.EmailSummary, 0, len(emails))
+	for _, email := range emails {
+		summaries = append(summaries, email.Summary())
+	}
+	return summaries, nil
+}
+
+func (s *Storage) email(username, id string) (entity.Email, error) {
+	if !isEmailField(id) {
+		return entity.Email{}, entity.ErrEmailDoesntExists
+	}
+	emailJSON, err := s.redis.HGet(context.Background(), accountKey(username), id).Result()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
-			return entity.ErrAccountDoesntExists
+			return entity.Email{}, entity.ErrEmailDoesntExists
 		}
-		return fmt.Errorf("get token username: %w", err)
+		return entity.Email{}, fmt.Errorf("hget account email: %w", err)
 	}
-	aKey := accountKey(username)
-	_, err = s.redis.Del(context.Background(), aKey).Result()
+	var email entity.Email
+	err = json.Unmarshal([]byte(emailJSON), &email)
+	if err != nil {
+		return entity.Email{}, fmt.Errorf("json unmarshal email json: %w", err)
+	}
+	return email, nil
+}
+
+func (s *Storage) Email(token, id string) (entity.Email, error) {
+	username, err := s.tokenUsername(token)
+	if err != nil {
+		return entity.Email{}, err
+	}
+	return s.email(username, id)
+}
+
+func (s *Storage) fileData(username, field string) ([]byte, error) {
+	data, err := s.redis.HGet(context.Background(), accountKey(username), field).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, entity.ErrFileDoesntExists
+		}
+		return nil, fmt.Errorf("hget account file: %w", err)
+	}
+	return data, nil
+}
+
+func (s *Storage) Attachment(token, emailID string, n int) (entity.Attachment, error) {
+	username, err := s.tokenUsername(token)
+	if err != nil {
+		return entity.Attachment{}, err
+	}
+	email, err := s.email(username, emailID)
+	if err != nil {
+		return entity.Attachment{}, err
+	}
+	if n < 0 || n >= len(email.Attachments) {
+		return entity.Attachment{}, entity.ErrFileDoesntExists
+	}
+	a := email.Attachments[n]
+	a.Data, err = s.fileData(username, attachmentField(emailID, n))
+	if err != nil {
+		return entity.Attachment{}, err
+	}
+	return a, nil
+}
+
+func (s *Storage) EmbeddedFile(token, emailID string, n int) (entity.EmbeddedFile, error) {
+	username, err := s.tokenUsername(token)
+	if err != nil {
+		return entity.EmbeddedFile{}, err
+	}
+	email, err := s.email(username, emailID)
+	if err != nil {
+		return entity.EmbeddedFile{}, err
+	}
+	if n < 0 || n >= len(email.EmbeddedFiles) {
+		return entity.EmbeddedFile{}, entity.ErrFileDoesntExists
+	}
+	ef := email.EmbeddedFiles[n]
+	ef.Data, err = s.fileData(username, embeddedFileField(emailID, n))
+	if err != nil {
+		return entity.EmbeddedFile{}, err
+	}
+	return ef, nil
+}
+
+func (s *Storage) RawEmail(token, id string) ([]byte, error) {
+	username, err := s.tokenUsername(token)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.email(username, id); err != nil {
+		return nil, err
+	}
+	return s.fileData(username, rawEmailField(id))
+}
+
+// removeEmailScript removes email fields and decreases mailbox size if email
+// wasn't removed concurrently. ARGV are mailbox size field, email size, email
+// field and its files fields.
+var removeEmailScript = redis.NewScript(`
+if redis.call("HDEL", KEYS[1], ARGV[3]) == 0 then
+	return 0
+end
+redis.call("HDEL", KEYS[1], unpack(ARGV, 4))
+redis.call("HINCRBY", KEYS[1], ARGV[1], -tonumber(ARGV[2]))
+return 1
+`)
+
+func (s *Storage) RemoveEmail(token, id string) error {
+	username, err := s.tokenUsername(token)
+	if err != nil {
+		return err
+	}
+	email, err := s.email(username, id)
+	if err != nil {
+		return err
+	}
+	return s.removeEmail(username, email)
+}
+
+func (s *Storage) removeEmail(username string, email entity.Email) error {
+	id := email.ID
+	args := []interface{}{mailboxSizeField, email.RawSize, id, rawEmailField(id)}
+	for n := range email.Attachments {
+		args = append(args, attachmentField(id, n))
+	}
+	for n := range email.EmbeddedFiles {
+		args = append(args, embeddedFileField(id, n))
+	}
+	removed, err := removeEmailScript.Run(context.Background(), s.redis,
+		[]string{accountKey(username)}, args...).Int()
+	if err != nil {
+		return fmt.Errorf("run remove email script: %w", err)
+	}
+	if removed == 0 {
+		return entity.ErrEmailDoesntExists
+	}
+	return s.publish(username, entity.Event{
+		Type:    entity.EventEmailRemoved,
+		EmailID: id,
+	})
+}
+
+func (s *Storage) RemoveAccount(token string) error {
+	username, err := s.tokenUsername(token)
+	if err != nil {
+		return err
+	}
+	_, err = s.redis.Del(context.Background(), accountKey(username)).Result()
 	if err != nil {
 		return fmt.Errorf("remove account: %w", err)
 	}
-	_, err = s.redis.Del(context.Background(), tKey).Result()
+	_, err = s.redis.Del(context.Background(), tokenKey(token)).Result()
 	if err != nil {
 		return fmt.Errorf("remove account: %w", err)
 	}
-	return nil
+	return s.publish(username, entity.Event{Type: entity.EventAccountRemoved})
 }
 
 func (s *Storage) AccountExists(username string) (bool, error) {
@@ -160,22 +434,413 @@ func (s *Storage) AccountExists(username string) (bool, error) {
 	return exists == 1, nil
 }
 
-func (s *Storage) AddEmail(username string, email entity.Email) error {
-	key := accountKey(username)
-	exists, err := s.redis.Exists(context.Background(), key).Result()
+// MailboxSize returns total RawSize of account emails, it is zero for
+// nonexistent accounts.
+func (s *Storage) MailboxSize(username string) (int, error) {
+	size, err := s.redis.HGet(context.Background(), accountKey(username), mailboxSizeField).Int()
 	if err != nil {
-		return fmt.Errorf("check account exists: %w", err)
-	}
-	if exists == 0 {
-		return entity.ErrAccountDoesntExists
+		if errors.Is(err, redis.Nil) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("hget mailbox size: %w", err)
 	}
+	return size, nil
+}
+
+// addEmailScript adds email with its files only to existing account, so it
+// never creates account hash without TTL. Email isn't added if mailbox size
+// would exceed positive quota. ARGV are mailbox size field, email size, quota
+// and a list of hash fields and values.
+var addEmailScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+local size = tonumber(ARGV[2])
+local quota = tonumber(ARGV[3])
+local used = tonumber(redis.call("HGET", KEYS[1], ARGV[1]) or "0")
+if quota > 0 and used + size > quota then
+	return 2
+end
+redis.call("HINCRBY", KEYS[1], ARGV[1], size)
+redis.call("HSET", KEYS[1], unpack(ARGV, 4))
+return 1
+`)
+
+func (s *Storage) AddEmail(username string, email entity.Email, quota int) error {
 	emailJSON, err := json.Marshal(email)
 	if err != nil {
 		return fmt.Errorf("json marshal email: %w", err)
 	}
-	_, err = s.redis.LPush(context.Background(), key, emailJSON).Result()
+	args := []interface{}{mailboxSizeField, email.RawSize, quota, email.ID, emailJSON}
+	for n, a := range email.Attachments {
+		args = append(args, attachmentField(email.ID, n), a.Data)
+	}
+	for n, ef := range email.EmbeddedFiles {
+		args = append(args, embeddedFileField(email.ID, n), ef.Data)
+	}
+	if email.Raw != nil {
+		args = append(args, rawEmailField(email.ID), email.Raw)
+	}
+	added, err := addEmailScript.Run(context.Background(), s.redis,
+		[]string{accountKey(username)}, args...).Int()
 	if err != nil {
-		return fmt.Errorf("lpush account email: %w", err)
+		return fmt.Errorf("run add email script: %w", err)
 	}
+	switch added {
+	case 0:
+		return entity.ErrAccountDoesntExists
+	case 2:
+		return entity.ErrMailboxFull
+	}
+	// Email is already stored and failed notification mustn't make SMTP
+	// client resend it, subscribers still see it on the next fetch.
+	summary := email.Summary()
+	_ = s.publish(username, entity.Event{
+		Type:  entity.EventEmailAdded,
+		Email: &summary,
+	})
 	return nil
 }
+
+// usernames returns addresses of all accounts.
+func (s *Storage) usernames() ([]string, error) {
+	var usernames []string
+	it := s.redis.Scan(context.Background(), 0, accountKeyPrefix+"*", 1000).Iterator()
+	for it.Next(context.Background()) {
+		usernames = append(usernames, strings.TrimPrefix(it.Val(), accountKeyPrefix))
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("scan accounts: %w", err)
+	}
+	return usernames, nil
+}
+
+// accountInfoScript returns TTL in milliseconds, number of emails and mailbox
+// size of account or nil if it doesn't exist or isn't a hash. ARGV are mailbox
+// size field and account sentinel.
+var accountInfoScript = redis.NewScript(`
+if redis.call("TYPE", KEYS[1]).ok ~= "hash" then
+	return nil
+end
+local ttl = redis.call("PTTL", KEYS[1])
+local emails = 0
+for _, field in ipairs(redis.call("HKEYS", KEYS[1])) do
+	if field ~= ARGV[2] and not string.find(field, "/", 1, true) then
+		emails = emails + 1
+	end
+end
+local size = tonumber(redis.call("HGET", KEYS[1], ARGV[1]) or "0")
+return {ttl, emails, size}
+`)
+
+func (s *Storage) AccountInfo(username string) (entity.AccountInfo, error) {
+	res, err := accountInfoScript.Run(context.Background(), s.redis,
+		[]string{accountKey(username)}, mailboxSizeField, accountSentinel).Int64Slice()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return entity.AccountInfo{}, entity.ErrAccountDoesntExists
+		}
+		return entity.AccountInfo{}, fmt.Errorf("run account info script: %w", err)
+	}
+	if len(res) != 3 {
+		return entity.AccountInfo{}, fmt.Errorf("unexpected account info script result: %v", res)
+	}
+	return entity.AccountInfo{
+		Address: username,
+		TTL:     res[0],
+		Emails:  int(res[1]),
+		Size:    int(res[2]),
+	}, nil
+}
+
+// Accounts returns all accounts. Accounts are scanned one by one, so it is
+// slow for large databases.
+func (s *Storage) Accounts() ([]entity.AccountInfo, error) {
+	usernames, err := s.usernames()
+	if err != nil {
+		return nil, err
+	}
+	var infos []entity.AccountInfo
+	for _, username := range usernames {
+		info, err := s.AccountInfo(username)
+		if err != nil {
+			// Account expired during scan.
+			if errors.Is(err, entity.ErrAccountDoesntExists) {
+				continue
+			}
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// accountToken returns account token or empty string if account doesn't have
+// tokenField.
+func (s *Storage) accountToken(username string) (string, error) {
+	token, err := s.redis.HGet(context.Background(), accountKey(username), tokenField).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return "", fmt.Errorf("hget account token: %w", err)
+	}
+	return token, nil
+}
+
+// SetAccountTTL sets TTL of account and its token by address. TTL must be
+// positive.
+func (s *Storage) SetAccountTTL(username string, ttl time.Duration) error {
+	token, err := s.accountToken(username)
+	if err != nil {
+		return err
+	}
+	ok, err := s.redis.PExpire(context.Background(), accountKey(username), ttl).Result()
+	if err != nil {
+		return fmt.Errorf("expire account: %w", err)
+	}
+	if !ok {
+		return entity.ErrAccountDoesntExists
+	}
+	if token == "" {
+		return nil
+	}
+	_, err = s.redis.PExpire(context.Background(), tokenKey(token), ttl).Result()
+	if err != nil {
+		return fmt.Errorf("expire token: %w", err)
+	}
+	return nil
+}
+
+// ExpireAccount removes account immediately as if its TTL ran out.
+func (s *Storage) ExpireAccount(username string) error {
+	token, err := s.accountToken(username)
+	if err != nil {
+		return err
+	}
+	n, err := s.redis.Del(context.Background(), accountKey(username)).Result()
+	if err != nil {
+		return fmt.Errorf("remove account: %w", err)
+	}
+	if n == 0 {
+		return entity.ErrAccountDoesntExists
+	}
+	if token != "" {
+		_, err = s.redis.Del(context.Background(), tokenKey(token)).Result()
+		if err != nil {
+			return fmt.Errorf("remove token: %w", err)
+		}
+	}
+	return s.publish(username, entity.Event{Type: entity.EventAccountExpired})
+}
+
+// RemoveEmailsBySender removes emails sent by sender from all accounts and
+// returns their number.
+func (s *Storage) RemoveEmailsBySender(sender string) (int, error) {
+	usernames, err := s.usernames()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, username := range usernames {
+		emails, err := s.accountEmails(username)
+		if err != nil {
+			if errors.Is(err, entity.ErrAccountDoesntExists) {
+				continue
+			}
+			return removed, err
+		}
+		for _, email := range emails {
+			if !email.SentBy(sender) {
+				continue
+			}
+			err := s.removeEmail(username, email)
+			if err != nil {
+				if errors.Is(err, entity.ErrEmailDoesntExists) {
+					continue
+				}
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// incrCounterScript increments counter and sets its TTL on the first
+// increment.
+var incrCounterScript = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+if n == 1 and tonumber(ARGV[1]) > 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return n
+`)
+
+// IncrCounter increments counter of key and returns its value. Counter expires
+// in ttl after the first increment. Counters are shared by all instances.
+func (s *Storage) IncrCounter(key string, ttl time.Duration) (int, error) {
+	n, err := incrCounterScript.Run(context.Background(), s.redis,
+		[]string{counterKey(key)}, ttl.Milliseconds()).Int()
+	if err != nil {
+		return 0, fmt.Errorf("run incr counter script: %w", err)
+	}
+	return n, nil
+}
+
+// decrCounterScript decrements existing positive counter keeping its TTL.
+var decrCounterScript = redis.NewScript(`
+local n = tonumber(redis.call("GET", KEYS[1]))
+if n ~= nil and n > 0 then
+	redis.call("DECR", KEYS[1])
+end
+return 0
+`)
+
+// DecrCounter decrements counter of key unless it is expired or zero.
+func (s *Storage) DecrCounter(key string) error {
+	err := decrCounterScript.Run(context.Background(), s.redis, []string{counterKey(key)}).Err()
+	if err != nil {
+		return fmt.Errorf("run decr counter script: %w", err)
+	}
+	return nil
+}
+
+func (s *Storage) CreateAPIKey(k entity.APIKey) error {
+	keyJSON, err := json.Marshal(k)
+	if err != nil {
+		return fmt.Errorf("json marshal api key: %w", err)
+	}
+	created, err := s.redis.HSetNX(context.Background(), apiKeyKey(k.ID), apiKeyField, keyJSON).Result()
+	if err != nil {
+		return fmt.Errorf("hsetnx api key: %w", err)
+	}
+	if !created {
+		return entity.ErrAPIKeyAlreadyExists
+	}
+	return nil
+}
+
+func apiKeyFromFields(fields map[string]string) (entity.APIKey, error) {
+	var k entity.APIKey
+	if err := json.Unmarshal([]byte(fields[apiKeyField]), &k); err != nil {
+		return entity.APIKey{}, fmt.Errorf("json unmarshal api key: %w", err)
+	}
+	if lastUsed, err := strconv.ParseInt(fields[apiKeyLastUsedField], 10, 64); err == nil {
+		k.LastUsedAt = time.UnixMilli(lastUsed).UTC()
+	}
+	return k, nil
+}
+
+func (s *Storage) APIKey(id string) (entity.APIKey, error) {
+	fields, err := s.redis.HGetAll(context.Background(), apiKeyKey(id)).Result()
+	if err != nil {
+		return entity.APIKey{}, fmt.Errorf("hgetall api key: %w", err)
+	}
+	if _, exists := fields[apiKeyField]; !exists {
+		return entity.APIKey{}, entity.ErrAPIKeyDoesntExists
+	}
+	return apiKeyFromFields(fields)
+}
+
+func (s *Storage) APIKeys() ([]entity.APIKey, error) {
+	keys := []entity.APIKey{}
+	it := s.redis.Scan(context.Background(), 0, apiKeyKeyPrefix+"*", 1000).Iterator()
+	for it.Next(context.Background()) {
+		k, err := s.APIKey(strings.TrimPrefix(it.Val(), apiKeyKeyPrefix))
+		if err != nil {
+			// Key revoked during scan.
+			if errors.Is(err, entity.ErrAPIKeyDoesntExists) {
+				continue
+			}
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("scan api keys: %w", err)
+	}
+	return keys, nil
+}
+
+func (s *Storage) RemoveAPIKey(id string) error {
+	n, err := s.redis.Del(context.Background(), apiKeyKey(id)).Result()
+	if err != nil {
+		return fmt.Errorf("remove api key: %w", err)
+	}
+	if n == 0 {
+		return entity.ErrAPIKeyDoesntExists
+	}
+	return nil
+}
+
+// touchAPIKeyScript sets last use time only if key exists, so revoked key
+// isn't recreated.
+var touchAPIKeyScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[2], ARGV[3])
+return 1
+`)
+
+func (s *Storage) TouchAPIKey(id string, lastUsedAt time.Time) error {
+	touched, err := touchAPIKeyScript.Run(context.Background(), s.redis,
+		[]string{apiKeyKey(id)}, apiKeyField, apiKeyLastUsedField, lastUsedAt.UnixMilli()).Int()
+	if err != nil {
+		return fmt.Errorf("run touch api key script: %w", err)
+	}
+	if touched == 0 {
+		return entity.ErrAPIKeyDoesntExists
+	}
+	return nil
+}
+
+// Subscribe returns account events published by any instance. Channel is
+// closed when ctx is done or subscription fails.
+func (s *Storage) Subscribe(ctx context.Context, token string) (<-chan entity.Event, error) {
+	username, err := s.tokenUsername(token)
+	if err != nil {
+		return nil, err
+	}
+	ksChannel := s.keyspaceChannel(username)
+	ps := s.redis.Subscribe(ctx, eventsChannel(username), ksChannel)
+	if _, err = ps.Receive(ctx); err != nil {
+		ps.Close()
+		return nil, fmt.Errorf("subscribe account events: %w", err)
+	}
+
+	events := make(chan entity.Event)
+	go func() {
+		defer close(events)
+		defer ps.Close()
+
+		msgs := ps.Channel()
+		for {
+			var msg *redis.Message
+			select {
+			case <-ctx.Done():
+				return
+			case m, ok := <-msgs:
+				if !ok {
+					return
+				}
+				msg = m
+			}
+
+			var e entity.Event
+			if msg.Channel == ksChannel {
+				if msg.Payload != "expired" {
+					continue
+				}
+				e.Type = entity.EventAccountExpired
+			} else if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil {
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case events <- e:
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,289 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"tmpmail/entity"
+	"tmpmail/storagetest"
+)
+
+func newTestStorage(t *testing.T) (*Storage, *miniredis.Miniredis) {
+	t.Helper()
+	m := miniredis.RunT(t)
+	s := NewStorage(m.Addr())
+	t.Cleanup(func() { s.Close() })
+	return s, m
+}
+
+func TestStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		s, _ := newTestStorage(t)
+		return s
+	})
+}
+
+func TestCreateAccount(t *testing.T) {
+	s, m := newTestStorage(t)
+
+	if err := s.CreateAccount("token1", "alice@tmp-mail.ru", time.Hour); err != nil {
+		t.Fatalf("CreateAccount() error = %v", err)
+	}
+	for _, key := range []string{tokenKey("token1"), accountKey("alice@tmp-mail.ru")} {
+		if ttl := m.TTL(key); ttl != time.Hour {
+			t.Errorf("%s TTL = %s, want %s", key, ttl, time.Hour)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		username string
+		wantErr  error
+	}{
+		{name: "token collision", token: "token1", username: "bob@tmp-mail.ru", wantErr: entity.ErrTokenAlreadyExists},
+		{name: "username collision", token: "token2", username: "alice@tmp-mail.ru", wantErr: entity.ErrAccountAlreadyExists},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.CreateAccount(tt.token, tt.username, time.Hour)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CreateAccount() error = %v, want %v", err, tt.wantErr)
+			}
+			// Failed creation leaves no keys behind.
+			if tt.token != "token1" && m.Exists(tokenKey(tt.token)) {
+				t.Errorf("token %s was created", tt.token)
+			}
+			if tt.username != "alice@tmp-mail.ru" && m.Exists(accountKey(tt.username)) {
+				t.Errorf("account %s was created", tt.username)
+			}
+		})
+	}
+}
+
+func TestAccountTTL(t *testing.T) {
+	s, m := newTestStorage(t)
+
+	if err := s.CreateAccount("token", "alice@tmp-mail.ru", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddEmail("alice@tmp-mail.ru", entity.Email{ID: "1", RawSize: 10}, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Adding email keeps account TTL.
+	if ttl := m.TTL(accountKey("alice@tmp-mail.ru")); ttl != time.Minute {
+		t.Errorf("account TTL after AddEmail = %s, want %s", ttl, time.Minute)
+	}
+
+	if err := s.ProlongAccount("token", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{tokenKey("token"), accountKey("alice@tmp-mail.ru")} {
+		if ttl := m.TTL(key); ttl != time.Hour {
+			t.Errorf("%s TTL = %s, want %s", key, ttl, time.Hour)
+		}
+	}
+
+	if err := s.ProlongAccount("unknown", time.Hour); !errors.Is(err, entity.ErrAccountDoesntExists) {
+		t.Errorf("ProlongAccount() of unknown token error = %v, want %v", err, entity.ErrAccountDoesntExists)
+	}
+
+	m.FastForward(time.Hour)
+	if _, err := s.Account("token"); !errors.Is(err, entity.ErrAccountDoesntExists) {
+		t.Errorf("Account() of expired account error = %v, want %v", err, entity.ErrAccountDoesntExists)
+	}
+	// Expired account doesn't get emails and isn't recreated without TTL.
+	err := s.AddEmail("alice@tmp-mail.ru", entity.Email{ID: "2"}, 0)
+	if !errors.Is(err, entity.ErrAccountDoesntExists) {
+		t.Errorf("AddEmail() to expired account error = %v, want %v", err, entity.ErrAccountDoesntExists)
+	}
+	if m.Exists(accountKey("alice@tmp-mail.ru")) {
+		t.Error("AddEmail() recreated expired account")
+	}
+}
+
+func TestRemoveEmail(t *testing.T) {
+	s, m := newTestStorage(t)
+	const username = "alice@tmp-mail.ru"
+	if err := s.CreateAccount("token", username, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	email := entity.Email{
+		ID:          "1",
+		RawSize:     50,
+		Attachments: []entity.Attachment{{Filename: "a.txt", Data: []byte("data")}},
+		Raw:         []byte("raw"),
+	}
+	if err := s.AddEmail(username, email, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RemoveEmail("token", "1"); err != nil {
+		t.Fatalf("RemoveEmail() error = %v", err)
+	}
+	if err := s.RemoveEmail("token", "1"); !errors.Is(err, entity.ErrEmailDoesntExists) {
+		t.Errorf("second RemoveEmail() error = %v, want %v", err, entity.ErrEmailDoesntExists)
+	}
+	// Size is freed, files are removed and empty account still exists.
+	if size, _ := s.MailboxSize(username); size != 0 {
+		t.Errorf("MailboxSize() = %d, want 0", size)
+	}
+	fields, err := s.redis.HKeys(context.Background(), accountKey(username)).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fields {
+		if f != accountSentinel && f != mailboxSizeField && f != tokenField {
+			t.Errorf("field %q left after RemoveEmail()", f)
+		}
+	}
+	if ttl := m.TTL(accountKey(username)); ttl != time.Hour {
+		t.Errorf("account TTL = %s, want %s", ttl, time.Hour)
+	}
+}
+
+func TestIncrCounter(t *testing.T) {
+	s, m := newTestStorage(t)
+
+	for want := 1; want <= 3; want++ {
+		n, err := s.IncrCounter("ip", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("IncrCounter() = %d, want %d", n, want)
+		}
+	}
+	// TTL is set by the first increment only.
+	m.FastForward(time.Minute)
+	if n, _ := s.IncrCounter("ip", time.Minute); n != 1 {
+		t.Errorf("IncrCounter() after TTL = %d, want 1", n)
+	}
+}
+
+func TestMigrateLegacyAccounts(t *testing.T) {
+	s, m := newTestStorage(t)
+
+	// Account of the first version with two emails, the newest first.
+	m.Push(legacyAccountKeyPrefix+"alice", `{"subject":"second"}`, `{"subject":"first"}`, accountSentinel)
+	m.SetTTL(legacyAccountKeyPrefix+"alice", time.Minute)
+
+	n, err := s.MigrateLegacyAccounts()
+	if err != nil {
+		t.Fatalf("MigrateLegacyAccounts() error = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("MigrateLegacyAccounts() = %d, want 1", n)
+	}
+	if m.Exists(legacyAccountKeyPrefix + "alice") {
+		t.Error("legacy account wasn't removed")
+	}
+	if ttl := m.TTL(accountKey("alice")); ttl != time.Minute {
+		t.Errorf("account TTL = %s, want %s", ttl, time.Minute)
+	}
+
+	// Converted storage isn't scanned again.
+	m.Push(legacyAccountKeyPrefix+"bob", accountSentinel)
+	if n, err = s.MigrateLegacyAccounts(); err != nil || n != 0 {
+		t.Errorf("second MigrateLegacyAccounts() = %d, %v, want 0, nil", n, err)
+	}
+	if !m.Exists(legacyAccountKeyPrefix + "bob") {
+		t.Error("legacy account was converted by second migration")
+	}
+}
+
+func TestMigrateAccountDomains(t *testing.T) {
+	s, m := newTestStorage(t)
+
+	// Account of the first version with two emails, the newest first.
+	m.Set(tokenKey("old-token"), "alice")
+	m.SetTTL(tokenKey("old-token"), time.Minute)
+	m.Push(legacyAccountKeyPrefix+"alice",
+		`{"subject":"second","attachments":[{"filename":"a.txt","contentType":"text/plain","data":"ZGF0YQ=="}]}`,
+		`{"subject":"first"}`,
+		accountSentinel)
+	m.SetTTL(legacyAccountKeyPrefix+"alice", time.Minute)
+	// Account of version before multiple domains.
+	m.HSet(accountKeyPrefix+"bob", accountSentinel, "")
+	// Key of other type must not break admin API before migration.
+	m.Push(accountKeyPrefix+"carol@tmp-mail.ru", accountSentinel)
+
+	if _, err := s.Accounts(); err != nil {
+		t.Fatalf("Accounts() before migration error = %v", err)
+	}
+	if _, err := s.RemoveEmailsBySender("spam@example.com"); err != nil {
+		t.Fatalf("RemoveEmailsBySender() before migration error = %v", err)
+	}
+
+	if _, err := s.MigrateLegacyAccounts(); err != nil {
+		t.Fatalf("MigrateLegacyAccounts() error = %v", err)
+	}
+	n, err := s.MigrateAccountDomains("tmp-mail.ru")
+	if err != nil {
+		t.Fatalf("MigrateAccountDomains() error = %v", err)
+	}
+	if n != 2 {
+		t.Errorf("MigrateAccountDomains() = %d, want 2", n)
+	}
+
+	a, err := s.Account("old-token")
+	if err != nil {
+		t.Fatalf("Account() error = %v", err)
+	}
+	if a.Address != "alice@tmp-mail.ru" {
+		t.Errorf("Account() address = %q, want %q", a.Address, "alice@tmp-mail.ru")
+	}
+	var subjects []string
+	for _, e := range a.Emails {
+		subjects = append(subjects, e.Subject)
+	}
+	if want := []string{"second", "first"}; !reflect.DeepEqual(subjects, want) {
+		t.Fatalf("Account() subjects = %q, want %q", subjects, want)
+	}
+	att, err := s.Attachment("old-token", a.Emails[0].ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(att.Data) != "data" || att.Filename != "a.txt" {
+		t.Errorf("Attachment() = %q %q, want %q %q", att.Filename, att.Data, "a.txt", "data")
+	}
+	if m.Exists(legacyAccountKeyPrefix + "alice") {
+		t.Error("legacy account wasn't removed")
+	}
+	if ttl := m.TTL(accountKey("alice@tmp-mail.ru")); ttl != time.Minute {
+		t.Errorf("account TTL = %s, want %s", ttl, time.Minute)
+	}
+	if ttl := m.TTL(tokenKey("old-token")); ttl != time.Minute {
+		t.Errorf("token TTL = %s, want %s", ttl, time.Minute)
+	}
+	// Migrated account can be prolonged by admin.
+	if err = s.SetAccountTTL("alice@tmp-mail.ru", time.Hour); err != nil {
+		t.Errorf("SetAccountTTL() error = %v", err)
+	}
+	if ok, _ := s.AccountExists("bob@tmp-mail.ru"); !ok {
+		t.Error("account bob@tmp-mail.ru doesn't exist")
+	}
+
+	infos, err := s.Accounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addresses []string
+	for _, info := range infos {
+		addresses = append(addresses, info.Address)
+	}
+	sort.Strings(addresses)
+	if want := []string{"alice@tmp-mail.ru", "bob@tmp-mail.ru"}; !reflect.DeepEqual(addresses, want) {
+		t.Errorf("Accounts() = %q, want %q", addresses, want)
+	}
+
+	if n, err = s.MigrateAccountDomains("tmp-mail.ru"); err != nil || n != 0 {
+		t.Errorf("second MigrateAccountDomains() = %d, %v, want 0, nil", n, err)
+	}
+}
@@ -0,0 +1,194 @@
+package tmpmail
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// SMTPRateLimit is a token bucket limit of received messages: one message per
+// Interval with bursts up to Burst messages. Zero Interval means unlimited.
+type SMTPRateLimit struct {
+	Interval time.Duration
+	Burst    int
+}
+
+func (l SMTPRateLimit) limiter(f RateLimiterFactory, name string) RateLimiter {
+	if l.Interval <= 0 {
+		return nil
+	}
+	return newRateLimiter(f, name, rate.Every(l.Interval), l.Burst)
+}
+
+// SMTPRateLimits of received messages per remote IP and of recipients per
+// MAIL FROM domain and per mailbox.
+type SMTPRateLimits struct {
+	IP      SMTPRateLimit
+	Sender  SMTPRateLimit
+	Mailbox SMTPRateLimit
+}
+
+// smtpRateLimited counts messages and connections refused by SMTP rate limits
+// by limit kind.
+var smtpRateLimited = expvar.NewMap("smtp_rate_limited")
+
+const (
+	rateLimitConnection = "connection"
+	rateLimitIP         = "ip"
+	rateLimitSender     = "sender"
+	rateLimitMailbox    = "mailbox"
+)
+
+// errRateLimited is a temporary refusal, so client retries later.
+var errRateLimited = errors.New("451 4.7.1 Rate limit exceeded, try again later")
+
+// smtpRateLimiters are nil for unlimited kinds. Limits are keyed by ipKey of
+// remote IP, lower case sender domain and account address.
+type smtpRateLimiters struct {
+	ip      RateLimiter
+	sender  RateLimiter
+	mailbox RateLimiter
+}
+
+func newSMTPRateLimiters(l SMTPRateLimits, f RateLimiterFactory) smtpRateLimiters {
+	return smtpRateLimiters{
+		ip:      l.IP.limiter(f, "smtp-ip"),
+		sender:  l.Sender.limiter(f, "smtp-sender"),
+		mailbox: l.Mailbox.limiter(f, "smtp-mailbox"),
+	}
+}
+
+// ipExhausted reports whether ip can't send any message now.
+func (ls smtpRateLimiters) ipExhausted(ip string) (bool, error) {
+	if ls.ip == nil {
+		return false, nil
+	}
+	tokens, err := ls.ip.Tokens(ipKey(ip))
+	if err != nil {
+		return false, err
+	}
+	return tokens < 1, nil
+}
+
+// allowRcpt takes one recipient from limits of sender domain and mailbox, so
+// flooding senders are refused before DATA. Nothing is taken if any limit is
+// exceeded, its kind is returned then.
+func (ls smtpRateLimiters) allowRcpt(sender, mailbox string) (kind string, ok bool, err error) {
+	return takeAll([]limitCheck{
+		{rateLimitSender, ls.sender, sender, 1},
+		{rateLimitMailbox, ls.mailbox, mailbox, 1},
+	})
+}
+
+// allowMessage takes one message from limit of ip. If it's exceeded,
+// recipients taken by allowRcpt for sender and mailboxes are given back.
+func (ls smtpRateLimiters) allowMessage(ip, sender string, mailboxes []string) (kind string, ok bool, err error) {
+	kind, ok, err = takeAll([]limitCheck{{rateLimitIP, ls.ip, ipKey(ip), 1}})
+	if ok || err != nil {
+		return kind, ok, err
+	}
+	checks := make([]limitCheck, 0, 2*len(mailboxes))
+	for _, m := range mailboxes {
+		checks = append(checks,
+			limitCheck{rateLimitSender, ls.sender, sender, 1},
+			limitCheck{rateLimitMailbox, ls.mailbox, m, 1})
+	}
+	return kind, false, returnAll(checks)
+}
+
+type limitCheck struct {
+	kind    string
+	limiter RateLimiter
+	key     string
+	n       int
+}
+
+// takeAll takes tokens of checks one by one, so concurrent sessions can't
+// overrun limits. If a limit is exceeded, tokens taken before are given back
+// and its kind is returned.
+func takeAll(checks []limitCheck) (kind string, ok bool, err error) {
+	for i, c := range checks {
+		if c.limiter == nil {
+			continue
+		}
+		ok, err := c.limiter.AllowN(c.key, c.n)
+		if err == nil && ok {
+			continue
+		}
+		if rerr := returnAll(checks[:i]); rerr != nil && err == nil {
+			err = rerr
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return c.kind, false, nil
+	}
+	return "", true, nil
+}
+
+// returnAll gives back tokens taken by checks.
+func returnAll(checks []limitCheck) error {
+	var firstErr error
+	for _, c := range checks {
+		if c.limiter == nil {
+			continue
+		}
+		if err := c.limiter.ReturnN(c.key, c.n); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func remoteIP(addr net.Addr) string {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// refuseTimeout limits writing of reply to refused connection.
+const refuseTimeout = 10 * time.Second
+
+// rateLimitedListener refuses connections from IPs which exhausted their
+// message limit with 421 before SMTP session starts. Connections are accepted
+// if limit can't be checked.
+type rateLimitedListener struct {
+	net.Listener
+	limiters smtpRateLimiters
+	hostname string
+	logger   *zap.Logger
+}
+
+func (l rateLimitedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		exhausted, err := l.limiters.ipExhausted(remoteIP(conn.RemoteAddr()))
+		if err != nil {
+			l.logger.Error("check IP rate limit", zap.Error(err))
+		}
+		if !exhausted {
+			return conn, nil
+		}
+		smtpRateLimited.Add(rateLimitConnection, 1)
+		go l.refuse(conn)
+	}
+}
+
+func (l rateLimitedListener) refuse(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetWriteDeadline(time.Now().Add(refuseTimeout))
+	_, _ = fmt.Fprintf(conn, "421 4.7.0 %s Too many messages, try again later\r\n", l.hostname)
+}
@@ -2,11 +2,13 @@ package tmpmail
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"strings"
 	"sync"
@@ -17,18 +19,67 @@ import (
 
 	"tmpmail/email"
 	"tmpmail/entity"
+	"tmpmail/mailauth"
 )
 
+// SMTPServerStorage accounts are identified by full address like
+// alice@tmp-mail.ru.
+// Mailbox size is a total RawSize of account emails.
 type SMTPServerStorage interface {
-	AccountExists(username string) (bool, error)
-	AddEmail(username string, email entity.Email) error
+	AccountExists(address string) (bool, error)
+	MailboxSize(address string) (int, error)
+	// AddEmail fails with entity.ErrMailboxFull if mailbox size would exceed
+	// quota, zero quota means unlimited.
+	AddEmail(address string, email entity.Email, quota int) error
 }
 
+// gzipData compresses concatenated parts, so they don't need to be copied
+// into one slice before.
+func gzipData(parts ...[]byte) ([]byte, error) {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	for _, p := range parts {
+		if _, err := zw.Write(p); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// smtpTimeout is a read and write timeout of SMTP session.
+const smtpTimeout = 5 * time.Minute
+
 type SMTPServer struct {
-	server *smtpd.Server
+	server   *smtpd.Server
+	limiters smtpRateLimiters
+	logger   *zap.Logger
 }
 
-func NewSMTPServer(l *zap.Logger, s SMTPServerStorage, tc *tls.Config, addr, domain, mailDomain string) *SMTPServer {
+// NewSMTPServer creates SMTP server receiving emails for domains. STARTTLS is
+// not offered if tc is nil. Sender authentication is checked with DNS records
+// resolved by r, it isn't checked if r is nil.
+//
+// Messages larger than maxMessageSize are refused with 552 during DATA, the
+// limit is advertised by SIZE extension. Messages with attachments or
+// embedded files larger than maxAttachmentSize are refused with 552, as well
+// as messages exceeding mailboxQuota of all recipients. Original messages
+// larger than maxRawEmailSize are stored parsed only. Zero sizes mean
+// unlimited. Recipients with full mailboxes are refused with 550 before DATA.
+//
+// Recipients exceeding sender or mailbox limits of rl are refused before
+// DATA, with 550 since smtpd has no other reply to RCPT. Messages exceeding IP
+// limit are refused with 451, connections from IPs which exhausted it are
+// refused with 421. Limiters are created by rlf,
+// nil rlf means limiters in process memory.
+func NewSMTPServer(l *zap.Logger, s SMTPServerStorage, tc *tls.Config, addr string,
+	domains []string, mailDomain string, r mailauth.Resolver,
+	maxMessageSize, maxAttachmentSize, mailboxQuota, maxRawEmailSize int, rl SMTPRateLimits,
+	rlf RateLimiterFactory) *SMTPServer {
+
+	limiters := newSMTPRateLimiters(rl, rlf)
 
 	smtpd.Debug = true
 
@@ -37,6 +88,46 @@ func NewSMTPServer(l *zap.Logger, s SMTPServerStorage, tc *tls.Config, addr, dom
 		Appname:   "tmpmail",
 		TLSConfig: tc,
 		Handler: func(remoteAddr net.Addr, from string, to []string, data []byte) error {
+			logger := l.With(
+				zap.String("remote_addr", remoteAddr.String()),
+				zap.String("mail_from", from))
+
+			// Every subaddress gets its own copy of email, so mailbox can tell
+			// apart emails sent to different tags.
+			rcpts := make(map[recipient]string, len(to))
+			// Every accepted RCPT took tokens of its mailbox.
+			mailboxes := make([]string, 0, len(to))
+			for _, rcpt := range to {
+				address, tag, ok := accountAddress(rcpt, domains)
+				if !ok {
+					logger.Warn("recipient outside of domains", zap.String("rcpt", rcpt))
+					continue
+				}
+				mailboxes = append(mailboxes, address)
+				r := recipient{address: address, tag: tag}
+				if _, exists := rcpts[r]; exists {
+					continue
+				}
+				rcpts[r] = rcpt
+			}
+
+			if len(rcpts) == 0 {
+				logger.Warn("email without recipients")
+				return nil
+			}
+
+			kind, ok, err := limiters.allowMessage(remoteIP(remoteAddr), senderKey(from), mailboxes)
+			if err != nil {
+				// Emails aren't lost because of rate limiter failures.
+				logger.Error("check rate limits", zap.Error(err))
+				ok = true
+			}
+			if !ok {
+				smtpRateLimited.Add(kind, 1)
+				logger.Warn("rate limit exceeded", zap.String("limit", kind))
+				return errRateLimited
+			}
+
 			m, err := email.Parse(bytes.NewReader(data))
 			if err != nil {
 				return fmt.Errorf("parse email: %w", err)
@@ -52,6 +143,25 @@ func NewSMTPServer(l *zap.Logger, s SMTPServerStorage, tc *tls.Config, addr, dom
 				ContentType:     m.ContentType,
 				HTMLBody:        m.HTMLBody,
 				TextBody:        m.TextBody,
+				Codes:           email.ExtractCodes(m.Subject, m.TextBody, m.HTMLBody),
+				Links:           email.ExtractLinks(m.TextBody, m.HTMLBody),
+			}
+
+			var authHeader []byte
+			if r != nil {
+				a := authenticate(r, remoteAddr, from, data)
+				mm.Authentication = &a
+				authHeader = []byte(mailauth.Header(mailDomain, a) + "\r\n")
+			}
+
+			mm.RawSize = len(authHeader) + len(data)
+			if maxRawEmailSize <= 0 || mm.RawSize <= maxRawEmailSize {
+				mm.Raw, err = gzipData(authHeader, data)
+				if err != nil {
+					return fmt.Errorf("compress raw email: %w", err)
+				}
+			} else {
+				logger.Info("raw email too large to keep", zap.Int("size", mm.RawSize))
 			}
 
 			if mm.Date.IsZero() {
@@ -93,78 +203,129 @@ func NewSMTPServer(l *zap.Logger, s SMTPServerStorage, tc *tls.Config, addr, dom
 			for _, i := range m.ResentBcc {
 				mm.ResentBcc = append(mm.ResentBcc, i.String())
 			}
+
+			logger = logger.With(zap.Strings("from", mm.From))
+
 			for _, a := range m.Attachments {
-				data, err := io.ReadAll(a.Data)
-				if err != nil {
-					return fmt.Errorf("read attachment: %w", err)
+				if maxAttachmentSize > 0 && len(a.Data) > maxAttachmentSize {
+					logger.Warn("attachment too large",
+						zap.String("filename", a.Filename),
+						zap.Int("size", len(a.Data)))
+					return errAttachmentTooLarge(maxAttachmentSize)
 				}
 				mm.Attachments = append(mm.Attachments, entity.Attachment{
 					Filename:    a.Filename,
 					ContentType: a.ContentType,
-					Data:        data,
+					Size:        len(a.Data),
+					SHA256:      sha256Hex(a.Data),
+					Data:        a.Data,
 				})
 			}
 			for _, a := range m.EmbeddedFiles {
-				data, err := io.ReadAll(a.Data)
-				if err != nil {
-					return fmt.Errorf("read embedded file: %w", err)
+				if maxAttachmentSize > 0 && len(a.Data) > maxAttachmentSize {
+					logger.Warn("embedded file too large",
+						zap.String("cid", a.CID),
+						zap.Int("size", len(a.Data)))
+					return errAttachmentTooLarge(maxAttachmentSize)
 				}
 				mm.EmbeddedFiles = append(mm.EmbeddedFiles, entity.EmbeddedFile{
 					CID:         a.CID,
 					ContentType: a.ContentType,
-					Data:        data,
+					Size:        len(a.Data),
+					SHA256:      sha256Hex(a.Data),
+					Data:        a.Data,
 				})
 			}
 
-			logger := l.With(
-				zap.String("remote_addr", remoteAddr.String()),
-				zap.Strings("from", mm.From))
-
-			if len(mm.To) == 0 {
-				logger.Warn("email without recipients")
-				return nil
-			}
-
-			var wg sync.WaitGroup
-			for i := range m.To {
+			var (
+				wg    sync.WaitGroup
+				mu    sync.Mutex
+				dErrs deliveryErrors
+			)
+			for r, rcpt := range rcpts {
 				wg.Add(1)
-				go func(i int) {
+				go func(r recipient, rcpt string) {
 					defer wg.Done()
 
-					username := strings.TrimSuffix(m.To[i].Address, "@"+domain)
-					if len(username) == len(m.To[i].Address) {
-						return
-					}
+					logger := logger.With(
+						zap.String("rcpt", rcpt),
+						zap.String("account", r.address))
 
-					logger = logger.With(
-						zap.String("to", mm.To[i]),
-						zap.String("username", username))
+					email := mm
+					email.ID = newEmailID()
+					email.Tag = r.tag
 
-					err = s.AddEmail(username, mm)
+					err := s.AddEmail(r.address, email, mailboxQuota)
 					if err != nil {
 						logger.Error("add email data to storage", zap.Error(err))
+						mu.Lock()
+						dErrs = append(dErrs, deliveryError{rcpt: rcpt, err: err})
+						mu.Unlock()
 						return
 					}
 
-					logger.Info("email data added")
-				}(i)
+					logger.Info("email data added", zap.String("id", email.ID))
+				}(r, rcpt)
 			}
 			wg.Wait()
+
+			// Message is accepted once any recipient stored it, otherwise
+			// client resends it and the others get duplicates.
+			if len(dErrs) == len(rcpts) {
+				logger.Warn("email refused", zap.Error(dErrs))
+				return dErrs
+			}
+			if len(dErrs) > 0 {
+				logger.Warn("email partially delivered", zap.Error(dErrs),
+					zap.Int("delivered", len(rcpts)-len(dErrs)))
+				return dErrs.partialReply()
+			}
 			return nil
 		},
 		HandlerRcpt: func(remoteAddr net.Addr, from string, to string) bool {
-			username := strings.TrimSuffix(to, "@"+domain)
-			if len(username) == len(to) {
+			address, _, ok := accountAddress(to, domains)
+			if !ok {
 				return false
 			}
-			exist, err := s.AccountExists(username)
+			exist, err := s.AccountExists(address)
+			if err != nil {
+				l.Error("check account exists", zap.String("account", address), zap.Error(err))
+				return false
+			}
+			if !exist {
+				return false
+			}
+			if mailboxQuota > 0 {
+				size, err := s.MailboxSize(address)
+				if err != nil {
+					l.Error("get mailbox size", zap.String("account", address), zap.Error(err))
+					return false
+				}
+				if size >= mailboxQuota {
+					l.Info("mailbox is full", zap.String("account", address), zap.Int("size", size))
+					return false
+				}
+			}
+			kind, ok, err := limiters.allowRcpt(senderKey(from), address)
 			if err != nil {
-				l.Error("check account exists", zap.String("account", username))
+				// Emails aren't lost because of rate limiter failures.
+				l.Error("check rate limits", zap.String("account", address), zap.Error(err))
+				return true
+			}
+			if !ok {
+				smtpRateLimited.Add(kind, 1)
+				l.Warn("rate limit exceeded",
+					zap.String("remote_addr", remoteAddr.String()),
+					zap.String("mail_from", from),
+					zap.String("account", address),
+					zap.String("limit", kind))
 				return false
 			}
-			return exist
+			return true
 		},
 		Hostname: mailDomain,
+		MaxSize:  maxMessageSize,
+		Timeout:  smtpTimeout,
 		LogRead: func(remoteIP, verb, line string) {
 			l.Debug("smtp read",
 				zap.String("remote_ip", remoteIP),
@@ -177,16 +338,171 @@ func NewSMTPServer(l *zap.Logger, s SMTPServerStorage, tc *tls.Config, addr, dom
 		},
 	}
 
-	return &SMTPServer{server: srv}
+	return &SMTPServer{server: srv, limiters: limiters, logger: l}
+}
+
+// senderKey is a key of sender domain limit.
+func senderKey(from string) string {
+	_, domain := entity.SplitAddress(from)
+	return strings.ToLower(domain)
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// newEmailID returns unique email ID. IDs are ordered by arrival time.
+func newEmailID() string {
+	return fmt.Sprintf("%016x", time.Now().UnixNano()) + generateRandomString(4)
+}
+
+// authTimeout limits DNS lookups of email sender authentication.
+const authTimeout = 20 * time.Second
+
+// authenticate checks email sender authentication of message data.
+func authenticate(r mailauth.Resolver, remoteAddr net.Addr, from string, data []byte) entity.Authentication {
+	ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+	defer cancel()
+
+	var ip net.IP
+	if a, ok := remoteAddr.(*net.TCPAddr); ok {
+		ip = a.IP
+	}
+	return mailauth.Verify(ctx, r, ip, receivedHELO(data), from, data)
+}
+
+// receivedHELO returns HELO domain from Received header prepended by smtpd
+// like "Received: from helo.domain (host [ip])" since smtpd doesn't pass it to
+// handler.
+func receivedHELO(data []byte) string {
+	const prefix = "Received: from "
+	if !bytes.HasPrefix(data, []byte(prefix)) {
+		return ""
+	}
+	line := data[len(prefix):]
+	if i := bytes.IndexAny(line, " \r\n"); i >= 0 {
+		line = line[:i]
+	}
+	return string(line)
+}
+
+// subaddressSeparator separates username and tag in local part like
+// user+tag.
+const subaddressSeparator = "+"
+
+type recipient struct {
+	address string
+	tag     string
+}
+
+// accountAddress returns account address and lower case tag of the email
+// address if it belongs to one of domains. Usernames are lower case and
+// domain of the returned address is the configured one, so accounts don't
+// depend on address case.
+func accountAddress(addr string, domains []string) (address, tag string, ok bool) {
+	username, domain := entity.SplitAddress(strings.ToLower(addr))
+	if i := strings.Index(username, subaddressSeparator); i >= 0 {
+		username, tag = username[:i], username[i+1:]
+	}
+	if username == "" {
+		return "", "", false
+	}
+	for _, d := range domains {
+		if strings.EqualFold(domain, d) {
+			return username + "@" + d, tag, true
+		}
+	}
+	return "", "", false
+}
+
+// Handler errors starting with reply code are replied by smtpd as is, other
+// errors are replied with 451, so client retries later. Refusals which won't
+// pass on retry are permanent.
+func errAttachmentTooLarge(limit int) error {
+	return fmt.Errorf("552 5.3.4 Attachment exceeds %d bytes", limit)
+}
+
+type deliveryError struct {
+	rcpt string
+	err  error
+}
+
+// reason of failed delivery for SMTP reply, storage errors are only logged.
+func (de deliveryError) reason() string {
+	if errors.Is(de.err, entity.ErrMailboxFull) {
+		return "mailbox full"
+	}
+	return "local error"
+}
+
+// deliveryErrors collects failed deliveries of one message, one per
+// recipient. Message is refused only if all deliveries failed. Its text is an
+// SMTP reply listing failed recipients.
+type deliveryErrors []deliveryError
+
+// mailboxesFull reports whether all deliveries exceeded mailbox quota.
+func (e deliveryErrors) mailboxesFull() bool {
+	for _, de := range e {
+		if !errors.Is(de.err, entity.ErrMailboxFull) {
+			return false
+		}
+	}
+	return len(e) > 0
+}
+
+// recipients lists failed recipients, optionally with reasons.
+func (e deliveryErrors) recipients(reasons bool) string {
+	var b strings.Builder
+	for i, de := range e {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(de.rcpt)
+		if reasons {
+			fmt.Fprintf(&b, " (%s)", de.reason())
+		}
+	}
+	return b.String()
+}
+
+// Error is a reply refusing message: permanent if all mailboxes are full and
+// temporary otherwise.
+func (e deliveryErrors) Error() string {
+	if e.mailboxesFull() {
+		return "552 5.2.2 Mailbox full: " + e.recipients(false)
+	}
+	return "451 4.3.0 Delivery failed, try again later: " + e.recipients(true)
+}
+
+// partialReply accepts message delivered to some of recipients and reports
+// the others, since smtpd replies handler errors with any code as is.
+func (e deliveryErrors) partialReply() error {
+	return errors.New("250 2.0.0 Ok: queued, not delivered to " + e.recipients(true))
 }
 
 func (s *SMTPServer) ListenAndServe() error {
-	err := s.server.ListenAndServe()
+	l, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts SMTP connections on l, it is useful when listener is already
+// bound, e.g. on random port.
+func (s *SMTPServer) Serve(l net.Listener) error {
+	err := s.server.Serve(rateLimitedListener{
+		Listener: l,
+		limiters: s.limiters,
+		hostname: s.server.Hostname,
+		logger:   s.logger,
+	})
 	if err != nil {
 		if errors.Is(err, net.ErrClosed) {
 			return nil
 		}
-		return fmt.Errorf("listen and server: %w", err)
+		return fmt.Errorf("serve: %w", err)
 	}
 	return nil
 }
@@ -0,0 +1,265 @@
+package tmpmail
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"tmpmail/entity"
+	"tmpmail/memory"
+)
+
+// failingStorage fails to add emails to account failAddress.
+type failingStorage struct {
+	*memory.Storage
+	failAddress string
+}
+
+func (s failingStorage) AddEmail(address string, email entity.Email, quota int) error {
+	if address == s.failAddress {
+		return errors.New("storage is down")
+	}
+	return s.Storage.AddEmail(address, email, quota)
+}
+
+// testSMTPConfig is NewSMTPServer configuration of tests. Emails to
+// failAddress can't be stored.
+type testSMTPConfig struct {
+	maxAttachmentSize int
+	mailboxQuota      int
+	maxRawEmailSize   int
+	failAddress       string
+	rateLimits        SMTPRateLimits
+}
+
+// newTestSMTPServer serves SMTP server with memory storage and accounts
+// alice@tmpmail.test and bob@tmpmail.test on random localhost port.
+func newTestSMTPServer(t *testing.T, c testSMTPConfig) (string, *memory.Storage) {
+	t.Helper()
+	st := memory.NewStorage()
+	for _, a := range []string{"alice@tmpmail.test", "bob@tmpmail.test"} {
+		if err := st.CreateAccount(a, a, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewSMTPServer(zap.NewNop(), failingStorage{st, c.failAddress}, nil, l.Addr().String(),
+		[]string{"tmpmail.test"}, "tmpmail.test", nil, 0, c.maxAttachmentSize, c.mailboxQuota,
+		c.maxRawEmailSize, c.rateLimits, nil)
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+		st.Close()
+	})
+	return l.Addr().String(), st
+}
+
+func testMessage(body string) []byte {
+	return []byte("From: sender@example.com\r\nTo: alice@tmpmail.test\r\nSubject: Test\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nhello\r\n" +
+		"--b\r\nContent-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=\"a.bin\"\r\n\r\n" + body + "\r\n" +
+		"--b--\r\n")
+}
+
+// sendMail sends msg to rcpts and returns reply to the end of its data, which
+// smtp.SendMail hides on success.
+func sendMail(t *testing.T, addr string, rcpts []string, msg []byte) (int, string) {
+	t.Helper()
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, _, err = c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	cmd := func(code int, format string, args ...interface{}) {
+		t.Helper()
+		if err := c.PrintfLine(format, args...); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.ReadResponse(code); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd(250, "HELO localhost")
+	cmd(250, "MAIL FROM:<sender@example.com>")
+	for _, rcpt := range rcpts {
+		cmd(250, "RCPT TO:<%s>", rcpt)
+	}
+	cmd(354, "DATA")
+	w := c.DotWriter()
+	if _, err = w.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	code, reply, err := c.ReadResponse(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, reply
+}
+
+func TestSMTPServerRefusals(t *testing.T) {
+	small := testMessage("data")
+	medium := testMessage(strings.Repeat("x", 400))
+	large := testMessage(strings.Repeat("x", 2000))
+
+	tests := []struct {
+		name       string
+		config     testSMTPConfig
+		rcpts      []string
+		msgs       [][]byte
+		wantCode   int
+		wantReply  string
+		wantEmails map[string]int
+	}{
+		{
+			name:       "accepted",
+			rcpts:      []string{"alice@tmpmail.test"},
+			msgs:       [][]byte{small},
+			wantCode:   250,
+			wantReply:  "2.0.0 Ok: queued",
+			wantEmails: map[string]int{"alice@tmpmail.test": 1},
+		},
+		{
+			name:      "attachment too large",
+			config:    testSMTPConfig{maxAttachmentSize: 1000},
+			rcpts:     []string{"alice@tmpmail.test"},
+			msgs:      [][]byte{large},
+			wantCode:  552,
+			wantReply: "5.3.4 Attachment exceeds 1000 bytes",
+		},
+		{
+			name:      "mailbox quota exceeded",
+			config:    testSMTPConfig{mailboxQuota: 1000},
+			rcpts:     []string{"alice@tmpmail.test"},
+			msgs:      [][]byte{large},
+			wantCode:  552,
+			wantReply: "5.2.2 Mailbox full: alice@tmpmail.test",
+		},
+		{
+			// Message is accepted if any recipient stored it.
+			name:       "one of mailboxes has room",
+			config:     testSMTPConfig{mailboxQuota: 1000},
+			rcpts:      []string{"alice@tmpmail.test", "bob@tmpmail.test"},
+			msgs:       [][]byte{medium, medium},
+			wantCode:   250,
+			wantReply:  "2.0.0 Ok: queued, not delivered to alice@tmpmail.test (mailbox full)",
+			wantEmails: map[string]int{"alice@tmpmail.test": 1, "bob@tmpmail.test": 1},
+		},
+		{
+			name:      "storage failure",
+			config:    testSMTPConfig{failAddress: "alice@tmpmail.test"},
+			rcpts:     []string{"alice@tmpmail.test"},
+			msgs:      [][]byte{small},
+			wantCode:  451,
+			wantReply: "4.3.0 Delivery failed, try again later: alice@tmpmail.test (local error)",
+		},
+		{
+			name:       "storage failure of one recipient",
+			config:     testSMTPConfig{failAddress: "bob@tmpmail.test"},
+			rcpts:      []string{"alice@tmpmail.test", "bob@tmpmail.test"},
+			msgs:       [][]byte{small},
+			wantCode:   250,
+			wantReply:  "2.0.0 Ok: queued, not delivered to bob@tmpmail.test (local error)",
+			wantEmails: map[string]int{"alice@tmpmail.test": 1, "bob@tmpmail.test": 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, st := newTestSMTPServer(t, tt.config)
+			// Preceding messages fill alice mailbox only.
+			for _, msg := range tt.msgs[:len(tt.msgs)-1] {
+				if err := smtp.SendMail(addr, nil, "sender@example.com", tt.rcpts[:1], msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			code, reply := sendMail(t, addr, tt.rcpts, tt.msgs[len(tt.msgs)-1])
+			if code != tt.wantCode || reply != tt.wantReply {
+				t.Errorf("DATA reply = %d %s, want %d %s", code, reply, tt.wantCode, tt.wantReply)
+			}
+			for account, want := range tt.wantEmails {
+				// Account token is its address.
+				emails, err := st.Emails(account)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(emails) != want {
+					t.Errorf("%s has %d emails, want %d", account, len(emails), want)
+				}
+			}
+		})
+	}
+}
+
+func TestSMTPServerRcptRateLimit(t *testing.T) {
+	addr, _ := newTestSMTPServer(t, testSMTPConfig{rateLimits: SMTPRateLimits{
+		Mailbox: SMTPRateLimit{Interval: time.Hour, Burst: 1},
+	}})
+	if code, reply := sendMail(t, addr, []string{"alice@tmpmail.test"}, testMessage("data")); code != 250 {
+		t.Fatalf("DATA reply = %d %s, want 250", code, reply)
+	}
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Mail("sender@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// Flooded mailbox is refused before message data is sent.
+	var tpErr *textproto.Error
+	if err = c.Rcpt("alice@tmpmail.test"); !errors.As(err, &tpErr) || tpErr.Code != 550 {
+		t.Errorf("RCPT to exhausted mailbox error = %v, want 550", err)
+	}
+	if err = c.Rcpt("bob@tmpmail.test"); err != nil {
+		t.Errorf("RCPT to other mailbox error = %v", err)
+	}
+}
+
+func TestSMTPServerRawEmailSize(t *testing.T) {
+	small := testMessage("data")
+	large := testMessage(strings.Repeat("x", 2000))
+
+	addr, st := newTestSMTPServer(t, testSMTPConfig{maxRawEmailSize: 1000})
+	for _, msg := range [][]byte{small, large} {
+		if err := smtp.SendMail(addr, nil, "sender@example.com", []string{"alice@tmpmail.test"}, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	emails, err := st.Emails("alice@tmpmail.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 2 {
+		t.Fatalf("alice@tmpmail.test has %d emails, want 2", len(emails))
+	}
+	// Summaries are the newest first.
+	for i, wantRaw := range []bool{false, true} {
+		_, err := st.RawEmail("alice@tmpmail.test", emails[i].ID)
+		if gotRaw := err == nil; gotRaw != wantRaw {
+			t.Errorf("email %d has raw data = %v (%v), want %v", i, gotRaw, err, wantRaw)
+		}
+	}
+}
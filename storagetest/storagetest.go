@@ -0,0 +1,614 @@
+// Package storagetest checks that storages of accounts and emails behave
+// alike, so servers don't depend on which one is configured.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"tmpmail"
+	"tmpmail/entity"
+)
+
+// Storage is a storage of SMTP and HTTP servers.
+type Storage interface {
+	tmpmail.SMTPServerStorage
+	tmpmail.HTTPServerStorage
+}
+
+const (
+	alice = "alice@tmp-mail.ru"
+	bob   = "bob@tmp-mail.ru"
+)
+
+// eventTimeout bounds delivery of events by storages which publish them
+// through external service.
+const eventTimeout = 5 * time.Second
+
+// Run runs conformance tests of storage. newStorage is called for every test
+// and returns empty storage, which is closed on test cleanup.
+func Run(t *testing.T, newStorage func(t *testing.T) Storage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s Storage)
+	}{
+		{name: "Account", test: testAccount},
+		{name: "RemoveAccount", test: testRemoveAccount},
+		{name: "Emails", test: testEmails},
+		{name: "Quota", test: testQuota},
+		{name: "Admin", test: testAdmin},
+		{name: "RemoveEmailsBySender", test: testRemoveEmailsBySender},
+		{name: "Counter", test: testCounter},
+		{name: "APIKeys", test: testAPIKeys},
+		{name: "Subscribe", test: testSubscribe},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+func testAccount(t *testing.T, s Storage) {
+	if err := s.CreateAccount("token1", alice, time.Hour); err != nil {
+		t.Fatalf("CreateAccount() error = %v", err)
+	}
+	if err := s.CreateAccount("token1", bob, time.Hour); !errors.Is(err, entity.ErrTokenAlreadyExists) {
+		t.Errorf("CreateAccount() of taken token error = %v, want %v", err, entity.ErrTokenAlreadyExists)
+	}
+	if err := s.CreateAccount("token2", alice, time.Hour); !errors.Is(err, entity.ErrAccountAlreadyExists) {
+		t.Errorf("CreateAccount() of taken address error = %v, want %v", err, entity.ErrAccountAlreadyExists)
+	}
+	// Failed creations leave no account behind.
+	if exists, err := s.AccountExists(bob); err != nil || exists {
+		t.Errorf("AccountExists(%s) = %t, %v, want false", bob, exists, err)
+	}
+
+	a, err := s.Account("token1")
+	if err != nil {
+		t.Fatalf("Account() error = %v", err)
+	}
+	if a.Address != alice {
+		t.Errorf("Account() address = %q, want %q", a.Address, alice)
+	}
+	if a.TTL <= 0 || a.TTL > time.Hour.Milliseconds() {
+		t.Errorf("Account() TTL = %d, want in (0, %d]", a.TTL, time.Hour.Milliseconds())
+	}
+	if exists, err := s.AccountExists(alice); err != nil || !exists {
+		t.Errorf("AccountExists(%s) = %t, %v, want true", alice, exists, err)
+	}
+
+	if err = s.ProlongAccount("token1", 24*time.Hour); err != nil {
+		t.Fatalf("ProlongAccount() error = %v", err)
+	}
+	if a, err = s.Account("token1"); err != nil {
+		t.Fatal(err)
+	}
+	if a.TTL <= time.Hour.Milliseconds() {
+		t.Errorf("Account() TTL after ProlongAccount() = %d, want > %d", a.TTL, time.Hour.Milliseconds())
+	}
+	if err = s.ProlongAccount("unknown", time.Hour); !errors.Is(err, entity.ErrAccountDoesntExists) {
+		t.Errorf("ProlongAccount() of unknown token error = %v, want %v", err, entity.ErrAccountDoesntExists)
+	}
+}
+
+func testRemoveAccount(t *testing.T, s Storage) {
+	if err := s.CreateAccount("token1", alice, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddEmail(alice, entity.Email{ID: "1", RawSize: 10}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveAccount("token1"); err != nil {
+		t.Fatalf("RemoveAccount() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{name: "Account", call: func() error { _, err := s.Account("token1"); return err }},
+		{name: "ProlongAccount", call: func() error { return s.ProlongAccount("token1", time.Hour) }},
+		{name: "RemoveAccount", call: func() error { return s.RemoveAccount("token1") }},
+		{name: "Emails", call: func() error { _, err := s.Emails("token1"); return err }},
+		{name: "Email", call: func() error { _, err := s.Email("token1", "1"); return err }},
+		{name: "RemoveEmail", call: func() error { return s.RemoveEmail("token1", "1") }},
+		{name: "AddEmail", call: func() error { return s.AddEmail(alice, entity.Email{ID: "2"}, 0) }},
+		{name: "AccountInfo", call: func() error { _, err := s.AccountInfo(alice); return err }},
+		{name: "Subscribe", call: func() error { _, err := s.Subscribe(context.Background(), "token1"); return err }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); !errors.Is(err, entity.ErrAccountDoesntExists) {
+				t.Errorf("%s() of removed account error = %v, want %v", tt.name, err, entity.ErrAccountDoesntExists)
+			}
+		})
+	}
+
+	if exists, err := s.AccountExists(alice); err != nil || exists {
+		t.Errorf("AccountExists() of removed account = %t, %v, want false", exists, err)
+	}
+	// Address is free again and the new account has no old emails.
+	if err := s.CreateAccount("token2", alice, time.Hour); err != nil {
+		t.Fatalf("CreateAccount() of removed address error = %v", err)
+	}
+	if emails, err := s.Emails("token2"); err != nil || len(emails) != 0 {
+		t.Errorf("Emails() of recreated account = %v, %v, want none", emails, err)
+	}
+	if size, err := s.MailboxSize(alice); err != nil || size != 0 {
+		t.Errorf("MailboxSize() of recreated account = %d, %v, want 0", size, err)
+	}
+}
+
+func testEmails(t *testing.T, s Storage) {
+	if err := s.AddEmail(alice, entity.Email{ID: "1"}, 0); !errors.Is(err, entity.ErrAccountDoesntExists) {
+		t.Errorf("AddEmail() to unknown account error = %v, want %v", err, entity.ErrAccountDoesntExists)
+	}
+	if err := s.CreateAccount("token1", alice, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	emails := []entity.Email{
+		{
+			ID:      "1",
+			Subject: "Plain",
+			From:    []string{"carol@example.com"},
+			RawSize: 30,
+		},
+		{
+			ID:      "2",
+			Subject: "With files",
+			From:    []string{"dave@example.com"},
+			Codes:   []string{"482913"},
+			Attachments: []entity.Attachment{
+				{Filename: "a.txt", ContentType: "text/plain", Size: 5, Data: []byte("hello")},
+			},
+			EmbeddedFiles: []entity.EmbeddedFile{
+				{CID: "logo", ContentType: "image/png", Size: 4, Data: []byte("\x89PNG")},
+			},
+			RawSize: 70,
+			Raw:     []byte("gzipped raw"),
+		},
+	}
+	for _, e := range emails {
+		if err := s.AddEmail(alice, e, 0); err != nil {
+			t.Fatalf("AddEmail(%s) error = %v", e.ID, err)
+		}
+	}
+
+	summaries, err := s.Emails("token1")
+	if err != nil {
+		t.Fatalf("Emails() error = %v", err)
+	}
+	// The newest email goes first.
+	want := []entity.EmailSummary{emails[1].Summary(), emails[0].Summary()}
+	if !reflect.DeepEqual(summaries, want) {
+		t.Errorf("Emails() = %+v, want %+v", summaries, want)
+	}
+	if size, err := s.MailboxSize(alice); err != nil || size != 100 {
+		t.Errorf("MailboxSize() = %d, %v, want 100", size, err)
+	}
+
+	e, err := s.Email("token1", "2")
+	if err != nil {
+		t.Fatalf("Email() error = %v", err)
+	}
+	if e.Subject != emails[1].Subject || !reflect.DeepEqual(e.Codes, emails[1].Codes) ||
+		len(e.Attachments) != 1 || e.Attachments[0].Filename != "a.txt" ||
+		len(e.EmbeddedFiles) != 1 || e.EmbeddedFiles[0].CID != "logo" {
+		t.Errorf("Email() = %+v, want %+v", e, emails[1])
+	}
+
+	a, err := s.Attachment("token1", "2", 0)
+	if err != nil {
+		t.Fatalf("Attachment() error = %v", err)
+	}
+	if a.Filename != "a.txt" || !bytes.Equal(a.Data, []byte("hello")) {
+		t.Errorf("Attachment() = %q with data %q, want a.txt with data %q", a.Filename, a.Data, "hello")
+	}
+	f, err := s.EmbeddedFile("token1", "2", 0)
+	if err != nil {
+		t.Fatalf("EmbeddedFile() error = %v", err)
+	}
+	if f.CID != "logo" || !bytes.Equal(f.Data, []byte("\x89PNG")) {
+		t.Errorf("EmbeddedFile() = %q with data %q, want logo with data %q", f.CID, f.Data, "\x89PNG")
+	}
+	raw, err := s.RawEmail("token1", "2")
+	if err != nil {
+		t.Fatalf("RawEmail() error = %v", err)
+	}
+	if !bytes.Equal(raw, emails[1].Raw) {
+		t.Errorf("RawEmail() = %q, want %q", raw, emails[1].Raw)
+	}
+
+	notFound := []struct {
+		name    string
+		call    func() error
+		wantErr error
+	}{
+		{name: "Email", call: func() error { _, err := s.Email("token1", "3"); return err }, wantErr: entity.ErrEmailDoesntExists},
+		{name: "RemoveEmail", call: func() error { return s.RemoveEmail("token1", "3") }, wantErr: entity.ErrEmailDoesntExists},
+		{name: "Attachment out of range", call: func() error { _, err := s.Attachment("token1", "2", 1); return err }, wantErr: entity.ErrFileDoesntExists},
+		{name: "Attachment of email without files", call: func() error { _, err := s.Attachment("token1", "1", 0); return err }, wantErr: entity.ErrFileDoesntExists},
+		{name: "EmbeddedFile out of range", call: func() error { _, err := s.EmbeddedFile("token1", "2", 1); return err }, wantErr: entity.ErrFileDoesntExists},
+		{name: "RawEmail of email without raw", call: func() error { _, err := s.RawEmail("token1", "1"); return err }, wantErr: entity.ErrFileDoesntExists},
+		{name: "Email of unknown token", call: func() error { _, err := s.Email("unknown", "1"); return err }, wantErr: entity.ErrAccountDoesntExists},
+		{name: "Attachment of unknown token", call: func() error { _, err := s.Attachment("unknown", "2", 0); return err }, wantErr: entity.ErrAccountDoesntExists},
+		{name: "RawEmail of unknown token", call: func() error { _, err := s.RawEmail("unknown", "2"); return err }, wantErr: entity.ErrAccountDoesntExists},
+	}
+	for _, tt := range notFound {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err = s.RemoveEmail("token1", "2"); err != nil {
+		t.Fatalf("RemoveEmail() error = %v", err)
+	}
+	if _, err = s.Email("token1", "2"); !errors.Is(err, entity.ErrEmailDoesntExists) {
+		t.Errorf("Email() of removed email error = %v, want %v", err, entity.ErrEmailDoesntExists)
+	}
+	if _, err = s.Attachment("token1", "2", 0); err == nil {
+		t.Error("Attachment() of removed email succeeded")
+	}
+	if _, err = s.RawEmail("token1", "2"); err == nil {
+		t.Error("RawEmail() of removed email succeeded")
+	}
+	if size, err := s.MailboxSize(alice); err != nil || size != 30 {
+		t.Errorf("MailboxSize() after RemoveEmail() = %d, %v, want 30", size, err)
+	}
+	if summaries, err = s.Emails("token1"); err != nil || len(summaries) != 1 || summaries[0].ID != "1" {
+		t.Errorf("Emails() after RemoveEmail() = %+v, %v, want email 1", summaries, err)
+	}
+}
+
+func testQuota(t *testing.T, s Storage) {
+	if size, err := s.MailboxSize(alice); err != nil || size != 0 {
+		t.Errorf("MailboxSize() of unknown account = %d, %v, want 0", size, err)
+	}
+	if err := s.CreateAccount("token1", alice, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		email    entity.Email
+		quota    int
+		wantErr  error
+		wantSize int
+	}{
+		{email: entity.Email{ID: "1", RawSize: 40}, quota: 100, wantSize: 40},
+		{email: entity.Email{ID: "2", RawSize: 60}, quota: 100, wantSize: 100},
+		{email: entity.Email{ID: "3", RawSize: 1}, quota: 100, wantErr: entity.ErrMailboxFull, wantSize: 100},
+		// Zero quota is unlimited.
+		{email: entity.Email{ID: "4", RawSize: 1000}, wantSize: 1100},
+	}
+	for _, tt := range tests {
+		err := s.AddEmail(alice, tt.email, tt.quota)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("AddEmail(%s) error = %v, want %v", tt.email.ID, err, tt.wantErr)
+		}
+		if size, err := s.MailboxSize(alice); err != nil || size != tt.wantSize {
+			t.Errorf("MailboxSize() after AddEmail(%s) = %d, %v, want %d", tt.email.ID, size, err, tt.wantSize)
+		}
+	}
+	// Rejected email isn't stored.
+	if _, err := s.Email("token1", "3"); !errors.Is(err, entity.ErrEmailDoesntExists) {
+		t.Errorf("Email() of rejected email error = %v, want %v", err, entity.ErrEmailDoesntExists)
+	}
+}
+
+func testAdmin(t *testing.T, s Storage) {
+	for _, a := range []struct{ token, address string }{{"token1", alice}, {"token2", bob}} {
+		if err := s.CreateAccount(a.token, a.address, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.AddEmail(alice, entity.Email{ID: "1", RawSize: 30}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := s.Accounts()
+	if err != nil {
+		t.Fatalf("Accounts() error = %v", err)
+	}
+	var addresses []string
+	for _, info := range infos {
+		addresses = append(addresses, info.Address)
+	}
+	sort.Strings(addresses)
+	if want := []string{alice, bob}; !reflect.DeepEqual(addresses, want) {
+		t.Errorf("Accounts() addresses = %q, want %q", addresses, want)
+	}
+
+	info, err := s.AccountInfo(alice)
+	if err != nil {
+		t.Fatalf("AccountInfo() error = %v", err)
+	}
+	if info.Address != alice || info.Emails != 1 || info.Size != 30 || info.TTL <= 0 || info.TTL > time.Hour.Milliseconds() {
+		t.Errorf("AccountInfo() = %+v, want %s with 1 email of size 30 and TTL up to an hour", info, alice)
+	}
+
+	// Admin prolongs account and its token.
+	if err = s.SetAccountTTL(alice, 48*time.Hour); err != nil {
+		t.Fatalf("SetAccountTTL() error = %v", err)
+	}
+	if info, err = s.AccountInfo(alice); err != nil || info.TTL <= 24*time.Hour.Milliseconds() {
+		t.Errorf("AccountInfo() TTL after SetAccountTTL() = %d, %v, want > %d", info.TTL, err, 24*time.Hour.Milliseconds())
+	}
+	a, err := s.Account("token1")
+	if err != nil || a.TTL <= 24*time.Hour.Milliseconds() {
+		t.Errorf("Account() TTL after SetAccountTTL() = %d, %v, want > %d", a.TTL, err, 24*time.Hour.Milliseconds())
+	}
+
+	if err = s.ExpireAccount(bob); err != nil {
+		t.Fatalf("ExpireAccount() error = %v", err)
+	}
+	if _, err = s.Account("token2"); !errors.Is(err, entity.ErrAccountDoesntExists) {
+		t.Errorf("Account() of expired account error = %v, want %v", err, entity.ErrAccountDoesntExists)
+	}
+	if _, err = s.AccountInfo(bob); !errors.Is(err, entity.ErrAccountDoesntExists) {
+		t.Errorf("AccountInfo() of expired account error = %v, want %v", err, entity.ErrAccountDoesntExists)
+	}
+
+	unknown := []struct {
+		name string
+		call func() error
+	}{
+		{name: "AccountInfo", call: func() error { _, err := s.AccountInfo("carol@tmp-mail.ru"); return err }},
+		{name: "SetAccountTTL", call: func() error { return s.SetAccountTTL("carol@tmp-mail.ru", time.Hour) }},
+		{name: "ExpireAccount", call: func() error { return s.ExpireAccount(bob) }},
+	}
+	for _, tt := range unknown {
+		t.Run(tt.name+" unknown", func(t *testing.T) {
+			if err := tt.call(); !errors.Is(err, entity.ErrAccountDoesntExists) {
+				t.Errorf("%s() error = %v, want %v", tt.name, err, entity.ErrAccountDoesntExists)
+			}
+		})
+	}
+}
+
+func testRemoveEmailsBySender(t *testing.T, s Storage) {
+	for _, a := range []struct{ token, address string }{{"token1", alice}, {"token2", bob}} {
+		if err := s.CreateAccount(a.token, a.address, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	emails := []struct {
+		address string
+		email   entity.Email
+	}{
+		{alice, entity.Email{ID: "1", From: []string{"Spam <spam@example.com>"}, RawSize: 10}},
+		{alice, entity.Email{ID: "2", From: []string{"friend@example.org"}, RawSize: 20}},
+		{bob, entity.Email{ID: "3", Sender: "SPAM@example.com", RawSize: 30}},
+		{bob, entity.Email{ID: "4", From: []string{"news@example.com"}, RawSize: 40}},
+	}
+	for _, e := range emails {
+		if err := s.AddEmail(e.address, e.email, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		sender    string
+		want      int
+		wantSizes map[string]int
+	}{
+		{sender: "spam@example.com", want: 2, wantSizes: map[string]int{alice: 20, bob: 40}},
+		{sender: "nobody@example.com", want: 0, wantSizes: map[string]int{alice: 20, bob: 40}},
+		// Sender without "@" matches the whole domain.
+		{sender: "example.com", want: 1, wantSizes: map[string]int{alice: 20, bob: 0}},
+	}
+	for _, tt := range tests {
+		n, err := s.RemoveEmailsBySender(tt.sender)
+		if err != nil {
+			t.Fatalf("RemoveEmailsBySender(%s) error = %v", tt.sender, err)
+		}
+		if n != tt.want {
+			t.Errorf("RemoveEmailsBySender(%s) = %d, want %d", tt.sender, n, tt.want)
+		}
+		for address, want := range tt.wantSizes {
+			if size, err := s.MailboxSize(address); err != nil || size != want {
+				t.Errorf("MailboxSize(%s) after RemoveEmailsBySender(%s) = %d, %v, want %d",
+					address, tt.sender, size, err, want)
+			}
+		}
+	}
+	if summaries, err := s.Emails("token1"); err != nil || len(summaries) != 1 || summaries[0].ID != "2" {
+		t.Errorf("Emails() = %+v, %v, want email 2", summaries, err)
+	}
+}
+
+func testCounter(t *testing.T, s Storage) {
+	// Releasing unknown counter doesn't create it.
+	if err := s.DecrCounter("a"); err != nil {
+		t.Fatalf("DecrCounter() error = %v", err)
+	}
+	steps := []struct {
+		key  string
+		decr bool
+		want int
+	}{
+		{key: "a", want: 1},
+		{key: "a", want: 2},
+		{key: "b", want: 1},
+		{key: "a", decr: true},
+		{key: "a", want: 2},
+		{key: "b", decr: true},
+		{key: "b", decr: true},
+		{key: "b", want: 1},
+	}
+	for i, st := range steps {
+		if st.decr {
+			if err := s.DecrCounter(st.key); err != nil {
+				t.Fatalf("step %d: DecrCounter(%s) error = %v", i, st.key, err)
+			}
+			continue
+		}
+		n, err := s.IncrCounter(st.key, time.Hour)
+		if err != nil {
+			t.Fatalf("step %d: IncrCounter(%s) error = %v", i, st.key, err)
+		}
+		if n != st.want {
+			t.Errorf("step %d: IncrCounter(%s) = %d, want %d", i, st.key, n, st.want)
+		}
+	}
+}
+
+func testAPIKeys(t *testing.T, s Storage) {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	keys := []entity.APIKey{
+		{
+			ID:        "key1",
+			Name:      "ci",
+			Hash:      "hash1",
+			Scopes:    []string{entity.ScopeBulkCreate},
+			CreatedAt: created,
+			ExpiresAt: created.Add(90 * 24 * time.Hour),
+		},
+		{
+			ID:        "key2",
+			Name:      "admin",
+			Hash:      "hash2",
+			Scopes:    []string{entity.ScopeAdminRead, entity.ScopeAdminWrite},
+			CreatedAt: created,
+		},
+	}
+	for _, k := range keys {
+		if err := s.CreateAPIKey(k); err != nil {
+			t.Fatalf("CreateAPIKey(%s) error = %v", k.ID, err)
+		}
+	}
+	if err := s.CreateAPIKey(keys[0]); !errors.Is(err, entity.ErrAPIKeyAlreadyExists) {
+		t.Errorf("CreateAPIKey() of taken ID error = %v, want %v", err, entity.ErrAPIKeyAlreadyExists)
+	}
+
+	k, err := s.APIKey("key1")
+	if err != nil {
+		t.Fatalf("APIKey() error = %v", err)
+	}
+	if !equalAPIKeys(k, keys[0]) {
+		t.Errorf("APIKey() = %+v, want %+v", k, keys[0])
+	}
+	list, err := s.APIKeys()
+	if err != nil {
+		t.Fatalf("APIKeys() error = %v", err)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	if len(list) != 2 || !equalAPIKeys(list[0], keys[0]) || !equalAPIKeys(list[1], keys[1]) {
+		t.Errorf("APIKeys() = %+v, want %+v", list, keys)
+	}
+
+	used := created.Add(time.Hour)
+	if err = s.TouchAPIKey("key1", used); err != nil {
+		t.Fatalf("TouchAPIKey() error = %v", err)
+	}
+	if k, err = s.APIKey("key1"); err != nil || !k.LastUsedAt.Equal(used) {
+		t.Errorf("APIKey() LastUsedAt after TouchAPIKey() = %s, %v, want %s", k.LastUsedAt, err, used)
+	}
+
+	if err = s.RemoveAPIKey("key1"); err != nil {
+		t.Fatalf("RemoveAPIKey() error = %v", err)
+	}
+	unknown := []struct {
+		name string
+		call func() error
+	}{
+		{name: "APIKey", call: func() error { _, err := s.APIKey("key1"); return err }},
+		{name: "RemoveAPIKey", call: func() error { return s.RemoveAPIKey("key1") }},
+		{name: "TouchAPIKey", call: func() error { return s.TouchAPIKey("key1", used) }},
+	}
+	for _, tt := range unknown {
+		t.Run(tt.name+" removed", func(t *testing.T) {
+			if err := tt.call(); !errors.Is(err, entity.ErrAPIKeyDoesntExists) {
+				t.Errorf("%s() error = %v, want %v", tt.name, err, entity.ErrAPIKeyDoesntExists)
+			}
+		})
+	}
+	if list, err = s.APIKeys(); err != nil || len(list) != 1 || list[0].ID != "key2" {
+		t.Errorf("APIKeys() after RemoveAPIKey() = %+v, %v, want key2", list, err)
+	}
+}
+
+// equalAPIKeys compares keys with times of any location.
+func equalAPIKeys(a, b entity.APIKey) bool {
+	return a.ID == b.ID && a.Name == b.Name && a.Hash == b.Hash &&
+		reflect.DeepEqual(a.Scopes, b.Scopes) &&
+		a.CreatedAt.Equal(b.CreatedAt) && a.ExpiresAt.Equal(b.ExpiresAt) &&
+		a.LastUsedAt.Equal(b.LastUsedAt)
+}
+
+func testSubscribe(t *testing.T, s Storage) {
+	if err := s.CreateAccount("token1", alice, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := s.Subscribe(ctx, "unknown"); !errors.Is(err, entity.ErrAccountDoesntExists) {
+		t.Errorf("Subscribe() of unknown token error = %v, want %v", err, entity.ErrAccountDoesntExists)
+	}
+	events, err := s.Subscribe(ctx, "token1")
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	email := entity.Email{ID: "1", Subject: "Hi", RawSize: 10}
+	summary := email.Summary()
+	steps := []struct {
+		name   string
+		action func() error
+		want   entity.Event
+	}{
+		{
+			name:   "AddEmail",
+			action: func() error { return s.AddEmail(alice, email, 0) },
+			want:   entity.Event{Type: entity.EventEmailAdded, Email: &summary},
+		},
+		{
+			name:   "RemoveEmail",
+			action: func() error { return s.RemoveEmail("token1", "1") },
+			want:   entity.Event{Type: entity.EventEmailRemoved, EmailID: "1"},
+		},
+		{
+			name:   "RemoveAccount",
+			action: func() error { return s.RemoveAccount("token1") },
+			want:   entity.Event{Type: entity.EventAccountRemoved},
+		},
+	}
+	for _, st := range steps {
+		if err = st.action(); err != nil {
+			t.Fatalf("%s() error = %v", st.name, err)
+		}
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatalf("events closed before %s event", st.name)
+			}
+			if !reflect.DeepEqual(e, st.want) {
+				t.Errorf("%s event = %+v, want %+v", st.name, e, st.want)
+			}
+		case <-time.After(eventTimeout):
+			t.Fatalf("no event of %s", st.name)
+		}
+	}
+
+	// Cancelled subscription closes events.
+	cancel()
+	timeout := time.After(eventTimeout)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("events aren't closed after cancel")
+		}
+	}
+}
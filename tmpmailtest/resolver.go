@@ -0,0 +1,58 @@
+package tmpmailtest
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Resolver is a DNS stub for email sender authentication checks. Keys are
+// domain names without trailing dot, e.g. "example.com" or
+// "selector._domainkey.example.com".
+type Resolver struct {
+	TXT  map[string][]string
+	MX   map[string][]*net.MX
+	IP   map[string][]net.IP
+	Addr map[string][]string
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func key(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func (r *Resolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if txt, exists := r.TXT[key(name)]; exists {
+		return txt, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *Resolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	if mx, exists := r.MX[key(name)]; exists {
+		return mx, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *Resolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	ips, exists := r.IP[key(host)]
+	if !exists {
+		return nil, notFound(host)
+	}
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	return addrs, nil
+}
+
+func (r *Resolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	if names, exists := r.Addr[addr]; exists {
+		return names, nil
+	}
+	return nil, notFound(addr)
+}
@@ -0,0 +1,262 @@
+// Package tmpmailtest runs in-process tmpmail SMTP and HTTP servers for
+// hermetic email flow tests.
+package tmpmailtest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"tmpmail"
+	"tmpmail/client"
+	"tmpmail/entity"
+	"tmpmail/mailauth"
+	"tmpmail/memory"
+)
+
+const (
+	// Domain is a mail domain of test server accounts.
+	Domain = "tmpmail.test"
+
+	authToken  = "tmpmailtest"
+	accountTTL = time.Hour
+
+	// DefaultWaitTimeout is used by Inbox.WaitFor.
+	DefaultWaitTimeout = 10 * time.Second
+)
+
+// Server is a tmpmail stack with memory storage and without TLS listening on
+// random localhost ports.
+type Server struct {
+	// SMTPAddr is host:port of SMTP server.
+	SMTPAddr string
+	// URL is base URL of HTTP API like http://127.0.0.1:12345.
+	URL string
+	// AuthToken is admin token for bulk accounts creation.
+	AuthToken string
+	// Client is an API client of the server.
+	Client *client.Client
+	// Storage is the server storage.
+	Storage *memory.Storage
+
+	smtpServer *tmpmail.SMTPServer
+	httpServer *tmpmail.HTTPServer
+}
+
+// NewServer starts server which is stopped when t finishes. Email sender
+// authentication isn't checked.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+
+	return NewServerWithResolver(t, nil)
+}
+
+// NewServerWithResolver starts server which checks email sender
+// authentication with DNS records resolved by r, e.g. by Resolver stub.
+func NewServerWithResolver(t testing.TB, r mailauth.Resolver) *Server {
+	t.Helper()
+
+	smtpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("tmpmailtest: listen smtp: %v", err)
+	}
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		smtpListener.Close()
+		t.Fatalf("tmpmailtest: listen http: %v", err)
+	}
+
+	l := zap.NewNop()
+	st := memory.NewStorage()
+
+	s := &Server{
+		SMTPAddr:  smtpListener.Addr().String(),
+		URL:       "http://" + httpListener.Addr().String(),
+		AuthToken: authToken,
+		Storage:   st,
+		smtpServer: tmpmail.NewSMTPServer(l, st, nil, smtpListener.Addr().String(),
+			[]string{Domain}, Domain, r, 0, 0, 0, 0, tmpmail.SMTPRateLimits{}, nil),
+		httpServer: tmpmail.NewHTTPServer(l, st, httpListener.Addr().String(), nil,
+			[]string{Domain}, nil, authToken, accountTTL, nil, nil,
+			tmpmail.AccountCreationLimit{}, nil, nil),
+	}
+	s.Client = client.New(s.URL, nil, 0, 0)
+
+	go s.smtpServer.Serve(smtpListener)
+	go s.httpServer.Serve(httpListener)
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.smtpServer.Shutdown(ctx)
+		s.httpServer.Shutdown(ctx)
+		st.Close()
+	})
+
+	return s
+}
+
+// Send sends message to recipients through SMTP server. Message must be in
+// RFC 5322 format with CRLF line endings.
+func (s *Server) Send(t testing.TB, from string, to []string, msg []byte) {
+	t.Helper()
+
+	err := smtp.SendMail(s.SMTPAddr, nil, from, to, msg)
+	if err != nil {
+		t.Fatalf("tmpmailtest: send mail: %v", err)
+	}
+}
+
+// NewInbox creates account with random username.
+func (s *Server) NewInbox(t testing.TB) *Inbox {
+	t.Helper()
+
+	ctx := context.Background()
+
+	token, err := s.Client.CreateAccount(ctx, "", "")
+	if err != nil {
+		t.Fatalf("tmpmailtest: create account: %v", err)
+	}
+	a, err := s.Client.Account(ctx, token)
+	if err != nil {
+		t.Fatalf("tmpmailtest: get account: %v", err)
+	}
+
+	return &Inbox{
+		Address: a.Address,
+		Token:   token,
+		t:       t,
+		server:  s,
+	}
+}
+
+// Inbox is a test account.
+type Inbox struct {
+	// Address is email address of the account.
+	Address string
+	// Token is API token of the account.
+	Token string
+
+	t      testing.TB
+	server *Server
+}
+
+// Subaddress returns inbox address with tag like user+tag@domain. Emails sent
+// to it are delivered to the inbox with the tag.
+func (i *Inbox) Subaddress(tag string) string {
+	username, domain := entity.SplitAddress(i.Address)
+	return username + "+" + tag + "@" + domain
+}
+
+// Last returns the latest email of the inbox. False is returned if the
+// inbox is empty.
+func (i *Inbox) Last() (entity.Email, bool) {
+	i.t.Helper()
+
+	emails, err := i.server.Storage.Emails(i.Token)
+	if err != nil {
+		i.t.Fatalf("tmpmailtest: get emails: %v", err)
+	}
+	if len(emails) == 0 {
+		return entity.Email{}, false
+	}
+	e, err := i.server.Storage.Email(i.Token, emails[0].ID)
+	if err != nil {
+		i.t.Fatalf("tmpmailtest: get email: %v", err)
+	}
+	return e, true
+}
+
+// WaitFor waits DefaultWaitTimeout for email matching m and fails t if
+// there is none. Emails already in the inbox are matched too. Nil m matches
+// any email.
+func (i *Inbox) WaitFor(t testing.TB, m func(entity.Email) bool) entity.Email {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultWaitTimeout)
+	defer cancel()
+
+	e, err := i.wait(ctx, m)
+	if err != nil {
+		t.Fatalf("tmpmailtest: wait for email to %s: %v", i.Address, err)
+	}
+	return e
+}
+
+func (i *Inbox) wait(ctx context.Context, m func(entity.Email) bool) (entity.Email, error) {
+	if m == nil {
+		m = func(entity.Email) bool { return true }
+	}
+
+	st := i.server.Storage
+
+	// Slow subscribers are closed by storage, emails are looked through again
+	// then.
+	for ctx.Err() == nil {
+		// Subscribe before looking through existing emails so email added
+		// in between is not missed.
+		events, err := st.Subscribe(ctx, i.Token)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return entity.Email{}, err
+		}
+
+		emails, err := st.Emails(i.Token)
+		if err != nil {
+			return entity.Email{}, err
+		}
+		for j := len(emails) - 1; j >= 0; j-- {
+			e, err := st.Email(i.Token, emails[j].ID)
+			if err != nil {
+				if errors.Is(err, entity.ErrEmailDoesntExists) {
+					continue
+				}
+				return entity.Email{}, err
+			}
+			if m(e) {
+				return e, nil
+			}
+		}
+
+		for ev := range events {
+			switch ev.Type {
+			case entity.EventAccountRemoved, entity.EventAccountExpired:
+				return entity.Email{}, entity.ErrAccountDoesntExists
+			case entity.EventEmailAdded:
+				e, err := st.Email(i.Token, ev.Email.ID)
+				if err != nil {
+					if errors.Is(err, entity.ErrEmailDoesntExists) {
+						continue
+					}
+					return entity.Email{}, err
+				}
+				if m(e) {
+					return e, nil
+				}
+			}
+		}
+	}
+	return entity.Email{}, errors.New("timeout")
+}
+
+// Tag returns matcher of emails sent to user+tag subaddress.
+func Tag(tag string) func(entity.Email) bool {
+	return func(e entity.Email) bool {
+		return strings.EqualFold(e.Tag, tag)
+	}
+}
+
+// Subject returns matcher of emails with exact subject.
+func Subject(subject string) func(entity.Email) bool {
+	return func(e entity.Email) bool {
+		return e.Subject == subject
+	}
+}
@@ -0,0 +1,57 @@
+// Captcha widgets of providers supported by server. All of them have the same
+// explicit rendering API under different globals.
+
+const providers = {
+  hcaptcha: {
+    script: 'https://js.hcaptcha.com/1/api.js',
+    global: 'hcaptcha',
+  },
+  recaptcha: {
+    script: 'https://www.google.com/recaptcha/api.js',
+    global: 'grecaptcha',
+  },
+  turnstile: {
+    script: 'https://challenges.cloudflare.com/turnstile/v0/api.js',
+    global: 'turnstile',
+  },
+};
+
+const loaded = {};
+
+function load(provider) {
+  if (!loaded[provider]) {
+    const { script, global } = providers[provider];
+    loaded[provider] = new Promise((resolve, reject) => {
+      const onload = 'onCaptchaLoad_' + provider;
+      window[onload] = () => resolve(window[global]);
+      const el = document.createElement('script');
+      el.src = script + '?render=explicit&onload=' + onload;
+      el.async = true;
+      el.onerror = () => {
+        delete loaded[provider];
+        el.remove();
+        reject(new Error('failed to load ' + provider + ' captcha'));
+      };
+      document.head.appendChild(el);
+    });
+  }
+  return loaded[provider];
+}
+
+export function supported(provider) {
+  return Object.prototype.hasOwnProperty.call(providers, provider);
+}
+
+// solve renders captcha widget of provider with siteKey in el and resolves
+// with its token once user solves it.
+export async function solve(el, provider, siteKey) {
+  const widgets = await load(provider);
+  return new Promise((resolve, reject) => {
+    el.replaceChildren();
+    widgets.render(el, {
+      sitekey: siteKey,
+      callback: resolve,
+      'error-callback': () => reject(new Error(provider + ' captcha error')),
+    });
+  });
+}
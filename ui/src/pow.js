@@ -0,0 +1,35 @@
+// Proof of work solver compatible with tmpmail/pow: nonce solves challenge
+// if SHA-256 of "challenge:nonce" has at least difficulty leading zero bits.
+
+const batchSize = 256;
+
+function leadingZeros(hash) {
+  const bytes = new Uint8Array(hash);
+  let n = 0;
+  for (const b of bytes) {
+    if (b !== 0) {
+      return n + Math.clz32(b) - 24;
+    }
+    n += 8;
+  }
+  return n;
+}
+
+export async function solve(challenge, difficulty) {
+  const encoder = new TextEncoder();
+  for (let i = 0; ; i += batchSize) {
+    const nonces = [];
+    for (let j = i; j < i + batchSize; j++) {
+      nonces.push(String(j));
+    }
+    const hashes = await Promise.all(
+      nonces.map((nonce) =>
+        crypto.subtle.digest('SHA-256', encoder.encode(challenge + ':' + nonce))
+      )
+    );
+    const k = hashes.findIndex((h) => leadingZeros(h) >= difficulty);
+    if (k >= 0) {
+      return nonces[k];
+    }
+  }
+}
@@ -3,5 +3,15 @@ import vue from '@vitejs/plugin-vue'
 
 // https://vitejs.dev/config/
 export default defineConfig({
-  plugins: [vue()]
+  plugins: [vue()],
+  server: {
+    // Development server proxies API to instance at TMPMAIL_URL.
+    proxy: {
+      '/api': {
+        target: process.env.TMPMAIL_URL || 'https://localhost',
+        changeOrigin: true,
+        secure: false
+      }
+    }
+  }
 })
@@ -0,0 +1,79 @@
+package tmpmail
+
+import (
+	"errors"
+	"strings"
+)
+
+// maxUsernameLength is a max length of local part by RFC 5321.
+const maxUsernameLength = 64
+
+var (
+	errInvalidUsername  = errors.New("invalid username")
+	errReservedUsername = errors.New("reserved username")
+	errDeniedUsername   = errors.New("denied username")
+)
+
+// reservedUsernames are role mailboxes of RFC 2142 and other common service
+// addresses which must not be given to users.
+var reservedUsernames = map[string]struct{}{
+	"abuse":         {},
+	"admin":         {},
+	"administrator": {},
+	"hostmaster":    {},
+	"info":          {},
+	"mailer-daemon": {},
+	"marketing":     {},
+	"no-reply":      {},
+	"noc":           {},
+	"noreply":       {},
+	"postmaster":    {},
+	"root":          {},
+	"sales":         {},
+	"security":      {},
+	"support":       {},
+	"usenet":        {},
+	"uucp":          {},
+	"webmaster":     {},
+	"www":           {},
+}
+
+// isAtext reports whether c is allowed in dot-atom by RFC 5322. Characters
+// "/", "?", "#" and "%" are special in URL paths, so they are rejected for
+// accounts to be addressable in admin API.
+func isAtext(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!$&'*+-=^_`{|}~", c) >= 0
+}
+
+// validateUsername checks that username is a dot-atom local part by RFC 5321
+// which is neither reserved nor contains any of denylist words. Quoted local
+// parts and subaddress separator are not allowed. Username must be lower case.
+func validateUsername(username string, denylist []string) error {
+	if username == "" || len(username) > maxUsernameLength {
+		return errInvalidUsername
+	}
+	if strings.Contains(username, subaddressSeparator) {
+		return errInvalidUsername
+	}
+	if username[0] == '.' || username[len(username)-1] == '.' || strings.Contains(username, "..") {
+		return errInvalidUsername
+	}
+	for i := 0; i < len(username); i++ {
+		if username[i] != '.' && !isAtext(username[i]) {
+			return errInvalidUsername
+		}
+	}
+	if _, reserved := reservedUsernames[username]; reserved {
+		return errReservedUsername
+	}
+	for _, word := range denylist {
+		if word != "" && strings.Contains(username, strings.ToLower(word)) {
+			return errDeniedUsername
+		}
+	}
+	return nil
+}
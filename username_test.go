@@ -0,0 +1,54 @@
+package tmpmail
+
+import "testing"
+
+func TestValidateUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		want     error
+	}{
+		{username: "qa-checkout", want: nil},
+		{username: "o'brien.j", want: nil},
+		{username: "a!b$c&d*e=f^g_h`i{j|k}l~m", want: nil},
+		{username: "", want: errInvalidUsername},
+		{username: ".alice", want: errInvalidUsername},
+		{username: "al..ice", want: errInvalidUsername},
+		{username: "alice+tag", want: errInvalidUsername},
+		{username: "a/b", want: errInvalidUsername},
+		{username: "a?b", want: errInvalidUsername},
+		{username: "a#b", want: errInvalidUsername},
+		{username: "a%2fb", want: errInvalidUsername},
+		{username: "postmaster", want: errReservedUsername},
+		{username: "casino-bonus", want: errDeniedUsername},
+	}
+
+	for _, tt := range tests {
+		if err := validateUsername(tt.username, []string{"Casino"}); err != tt.want {
+			t.Errorf("validateUsername(%q) = %v, want %v", tt.username, err, tt.want)
+		}
+	}
+}
+
+func TestAccountAddress(t *testing.T) {
+	domains := []string{"tmp-mail.ru", "Example.com"}
+	tests := []struct {
+		addr    string
+		address string
+		tag     string
+		ok      bool
+	}{
+		{addr: "alice@tmp-mail.ru", address: "alice@tmp-mail.ru", ok: true},
+		{addr: "QA-Checkout@TMP-MAIL.RU", address: "qa-checkout@tmp-mail.ru", ok: true},
+		{addr: "Alice+Shop@example.com", address: "alice@Example.com", tag: "shop", ok: true},
+		{addr: "+tag@tmp-mail.ru", ok: false},
+		{addr: "alice@other.ru", ok: false},
+	}
+
+	for _, tt := range tests {
+		address, tag, ok := accountAddress(tt.addr, domains)
+		if address != tt.address || tag != tt.tag || ok != tt.ok {
+			t.Errorf("accountAddress(%q) = %q, %q, %v, want %q, %q, %v",
+				tt.addr, address, tag, ok, tt.address, tt.tag, tt.ok)
+		}
+	}
+}